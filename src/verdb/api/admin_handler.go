@@ -0,0 +1,52 @@
+package api
+
+import (
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+RegistryCache 返回本实例缓存的注册信息和数据库中的修订号
+
+	GET /api/admin/registries
+
+stale为true表示缓存和数据库不一致，会在下一次同步时更新
+*/
+func RegistryCache(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	status, err := rm.CacheStatus(sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, bson.M{"registries": status})
+}
+
+/*
+ReloadRegistries 从数据库重新加载本实例缓存的所有注册信息
+
+	POST /api/admin/registries/reload
+
+返回重新加载和删除的注册信息名称，以及加载之后的缓存状态
+*/
+func ReloadRegistries(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	result, err := rm.Sync(true, sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	status, err := rm.CacheStatus(sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, bson.M{"loaded": result.Loaded, "removed": result.Removed, "registries": status})
+}
@@ -6,9 +6,42 @@ Registry
   - 查询：POST /api/registry/search
   - 修改：PUT /api/registry/:id
   - 删除：DELETE /api/registry/:id
+  - 迁移进度：GET /api/migrations/:id
+  - 重新开始失败的迁移：POST /api/migrations/:id/restart
 
 Versionize
 	POST /api/ver
+	POST /api/versionize/:database/:collection/batch
+	DELETE /api/versionize/:database/:collection/:key
+	POST /api/restore/:database/:collection/:key
+	POST /api/undo/:database/:collection/:key
+	POST /api/touch/:database/:collection/:key?hash=
+
+	写入的版本在 _meta 中记录提交来源，来自请求头 X-Verdb-Source(或参数source), X-Request-Id
+
+History
+	GET /api/history/:database/:collection/:key?source=&since=&until=
+	GET /api/diff/:database/:collection/:key
+
+Changes
+	GET /api/changes/:database/:collection
+	GET /api/changes/:database/:collection/stream
+	GET /api/churn/:database/:collection?from=&to=&top=&bucket=
+	POST /api/transitions/:database/:collection?from=&to=
+
+Webhooks
+  - 新建：POST /api/webhooks
+  - 查询：GET /api/webhooks?registry=
+  - 删除：DELETE /api/webhooks/:id
+  - 投递记录：GET /api/webhooks/:id/deliveries?status=
+  - 重新投递：POST /api/deliveries/:id/redeliver
+
+Maintenance
+	POST /api/compact/:database/:collection?dryRun=true
+
+Admin
+  - 注册缓存：GET /api/admin/registries
+  - 重新加载：POST /api/admin/registries/reload
 */
 func setupAPI(server *Server) {
 	r := server
@@ -18,11 +51,44 @@ func setupAPI(server *Server) {
 	r.POST("/api/registry/search", SearchRegistry)
 	r.PUT("/api/registry/:id", UpdateRegistry)
 	r.DELETE("/api/registry/:id", DeleteRegistry)
+	r.GET("/api/migrations/:id", GetMigration)
+	r.POST("/api/migrations/:id/restart", RestartMigration)
 
 	// 版本化存储
 	r.POST("/api/versionize/:database/:collection", Versionize)
+	r.POST("/api/versionize/:database/:collection/batch", VersionizeBatch)
+	r.DELETE("/api/versionize/:database/:collection/:key", DeleteEntity)
+	r.POST("/api/restore/:database/:collection/:key", Restore)
+	r.POST("/api/undo/:database/:collection/:key", Undo)
+	r.POST("/api/touch/:database/:collection/:key", Touch)
 
 	// 结果查询
 	r.POST("/api/search/:database/:collection", SearchInfo)
 
+	// 实体历史版本
+	r.GET("/api/history/:database/:collection/:key", History)
+	r.GET("/api/diff/:database/:collection/:key", Diff)
+
+	// 变更日志
+	r.GET("/api/changes/:database/:collection", Changes)
+	r.GET("/api/changes/:database/:collection/stream", StreamChanges)
+
+	// 版本变化统计
+	r.GET("/api/churn/:database/:collection", Churn)
+	r.POST("/api/transitions/:database/:collection", Transitions)
+
+	// Webhooks
+	r.POST("/api/webhooks", NewWebhook)
+	r.GET("/api/webhooks", ListWebhooks)
+	r.DELETE("/api/webhooks/:id", DeleteWebhook)
+	r.GET("/api/webhooks/:id/deliveries", ListDeliveries)
+	r.POST("/api/deliveries/:id/redeliver", Redeliver)
+
+	// 维护
+	r.POST("/api/compact/:database/:collection", Compact)
+
+	// 注册缓存
+	r.GET("/api/admin/registries", RegistryCache)
+	r.POST("/api/admin/registries/reload", ReloadRegistries)
+
 }
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSetupAPI(t *testing.T) {
+	// 路由冲突时gin会panic
+	defer func() {
+		if err := recover(); err != nil {
+			t.Errorf("路由注册失败 %v\n", err)
+		}
+	}()
+	setupAPI(&Server{Engine: gin.New()})
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"time"
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/manucorporat/sse"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ChangesPollInterval 实时订阅时查询新变更的间隔
+var ChangesPollInterval = 500 * time.Millisecond
+
+/*
+Changes 从游标after之后读取变更日志
+
+	GET /api/changes/:database/:collection?after=0&limit=100
+
+返回变更列表和新的游标，下次请求使用返回的after继续读取
+*/
+func Changes(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+	after, err := queryInt(c, "after", 0)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	limit, err := queryInt(c, "limit", 100)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+
+	records, err := reg.Changes(int64(after), limit, sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	cursor := int64(after)
+	if len(records) > 0 {
+		cursor = records[len(records)-1].Seq
+	}
+	jsonOk(c, bson.M{"changes": records, "after": cursor})
+}
+
+/*
+StreamChanges 通过Server-Sent Events实时推送变更日志
+
+	GET /api/changes/:database/:collection/stream?after=0
+
+每条变更是一个 change 事件，事件id为序号，断线重连时浏览器发送的
+Last-Event-ID 优先于after参数
+*/
+func StreamChanges(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+	after, err := queryInt(c, "after", 0)
+	if id := c.Request.Header.Get("Last-Event-ID"); id != "" {
+		after, err = strconv.Atoi(id)
+	}
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+
+	cursor := int64(after)
+	c.Stream(func(w io.Writer) bool {
+		records, err := reg.Changes(cursor, 100, sess)
+		if err != nil {
+			sse.Encode(w, sse.Event{Event: "error", Data: err.Error()})
+			return false
+		}
+		for _, record := range records {
+			sse.Encode(w, sse.Event{
+				Event: "change",
+				Id:    strconv.FormatInt(record.Seq, 10),
+				Data:  record,
+			})
+			cursor = record.Seq
+		}
+		if len(records) == 0 {
+			time.Sleep(ChangesPollInterval)
+		}
+		return true
+	})
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+)
+
+func TestStreamChangesAPI(t *testing.T) {
+	const (
+		testdb         = "testdb"
+		testcollection = "teststream"
+	)
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	// 初始化数据库
+	sess.DB(MetaDB).C(RegCollection).DropCollection()
+	for _, name := range []string{"", ".changes", ".counters"} {
+		sess.DB(testdb).C(testcollection + name).DropCollection()
+	}
+
+	// 初始化server并注册
+	server := NewServer(gin.Default(), sess)
+	reg := &models.Registry{
+		DatabaseName:   testdb,
+		CollectionName: testcollection,
+		CompareKey:     "pk",
+		VerInterval:    models.Daily,
+		VerKeys:        []models.VerKey{{Path: "a"}},
+	}
+	if _, err := server.rm.CreateRegistry(reg, sess); err != nil {
+		t.Errorf("注册错误 %s\n", err)
+		return
+	}
+
+	// ResponseRecorder不支持CloseNotify，使用真实的连接
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	res, err := http.Get(fmt.Sprintf("%s/api/changes/%s/%s/stream", ts.URL, testdb, testcollection))
+	if err != nil {
+		t.Errorf("无法订阅变更 %s\n", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("订阅变更错误 %d\n", res.StatusCode)
+		return
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type错误 %s\n", ct)
+	}
+	if cc := res.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Cache-Control错误 %s\n", cc)
+	}
+}
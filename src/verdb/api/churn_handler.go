@@ -0,0 +1,64 @@
+package api
+
+import (
+	"errors"
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+)
+
+/*
+Churn 统计一段时间内因为VerKeys改变生成的新版本
+
+	GET /api/churn/:database/:collection?from=<ver|time>&to=<ver|time>&top=10&bucket=1
+
+from默认为最早，to默认为当前版本号，top为返回的VerKeys和实体数目，
+bucket为每组的版本号个数，例如verInterval为一小时时 bucket=24 按天统计
+*/
+func Churn(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+
+	q, err := churnQuery(c, reg)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	report, err := reg.Churn(q, sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, report)
+}
+
+func churnQuery(c *gin.Context, reg *models.Registry) (q models.ChurnQuery, err error) {
+	from, err := queryVer(c, reg, "from")
+	if err != nil {
+		return
+	}
+	to, err := queryVer(c, reg, "to")
+	if err != nil {
+		return
+	}
+	q.To = reg.GenVer()
+	if from != nil {
+		q.From = *from
+	}
+	if to != nil {
+		q.To = *to
+	}
+	if q.Top, err = queryInt(c, "top", models.DefaultChurnTop); err != nil {
+		return
+	}
+	bucket, err := queryInt(c, "bucket", 1)
+	q.Bucket = int64(bucket)
+	return
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"errors"
+	"time"
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+)
+
+/*
+Compact 按照注册信息的保留策略压缩历史版本
+
+	POST /api/compact/:database/:collection?dryRun=true
+
+dryRun为true时只返回将被合并和删除的版本，不修改数据
+*/
+func Compact(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+	if reg.Retention == nil {
+		jsonError(c, errors.New("Registry has no retention policy"))
+		return
+	}
+
+	report, err := reg.Compact(time.Now(), c.Query("dryRun") == "true", sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, report)
+}
@@ -1,6 +1,15 @@
 package api
 
+import "time"
+
 const (
 	MetaDB        = "metadb"
 	RegCollection = "regs"
+
+	// MaintainInterval 按照保留策略压缩历史版本的间隔
+	MaintainInterval = time.Hour
+	// WebhookInterval 投递webhook的间隔
+	WebhookInterval = time.Second
+	// RegSyncInterval 和其他实例同步注册缓存的间隔
+	RegSyncInterval = 5 * time.Second
 )
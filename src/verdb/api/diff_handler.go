@@ -0,0 +1,69 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+Diff 比对一个实体的两个版本
+
+	GET /api/diff/:database/:collection/:key?from=<ver|time>&to=<ver|time>&id=disks:serial,nics:mac
+
+from, to 为需要比对的两个版本，id 指定文档列表中元素的标识键
+*/
+func Diff(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+
+	from, err := queryVer(c, reg, "from")
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	to, err := queryVer(c, reg, "to")
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	if from == nil || to == nil {
+		jsonError(c, errors.New("from and to are required"))
+		return
+	}
+
+	opts := models.DiffOptions{IDKeys: map[string]string{}}
+	for _, item := range strings.Split(c.Query("id"), ",") {
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			jsonError(c, errors.New("id must be in format path:key, got "+item))
+			return
+		}
+		opts.IDKeys[parts[0]] = parts[1]
+	}
+
+	key, err := reg.ResolveKey(c.Param("key"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	changes, err := reg.DiffVersions(key, *from, *to, opts, sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, bson.M{"changes": changes})
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"errors"
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+History 按版本顺序返回一个实体的所有版本
+
+	GET /api/history/:database/:collection/:key?from=<ver|time>&to=<ver|time>&skip=0&limit=10
+	GET /api/history/:database/:collection/:key?source=collector-bj-03&since=2016-01-02T00:00:00+08:00
+
+key为实体key(多个标识键时为json列表)，from, to 限定版本的有效区间，skip, limit 用于分页，
+source, since, until 按照版本的提交来源和提交时间(RFC3339)过滤
+*/
+func History(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+
+	q, err := historyQuery(c, reg)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+
+	key, err := reg.ResolveKey(c.Param("key"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	versions, total, err := reg.History(key, q, sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, bson.M{"total": total, "versions": versions})
+}
+
+func historyQuery(c *gin.Context, reg *models.Registry) (q models.HistoryQuery, err error) {
+	if q.From, err = queryVer(c, reg, "from"); err != nil {
+		return
+	}
+	if q.To, err = queryVer(c, reg, "to"); err != nil {
+		return
+	}
+	if q.Meta, err = metaFilter(c); err != nil {
+		return
+	}
+	if q.Skip, err = queryInt(c, "skip", 0); err != nil {
+		return
+	}
+	q.Limit, err = queryInt(c, "limit", 0)
+	return
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestHistoryAPI(t *testing.T) {
+	const (
+		testdb         = "testdb"
+		testcollection = "testhistory"
+	)
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	// 初始化数据库
+	sess.DB(MetaDB).C(RegCollection).DropCollection()
+	coll := sess.DB(testdb).C(testcollection)
+	coll.DropCollection()
+
+	// 初始化server并注册
+	server := NewServer(gin.Default(), sess)
+	reg := &models.Registry{
+		DatabaseName:   testdb,
+		CollectionName: testcollection,
+		CompareKey:     "pk",
+		VerInterval:    models.Daily,
+		VerKeys:        []models.VerKey{{Path: "a"}},
+	}
+	if _, err := server.rm.CreateRegistry(reg, sess); err != nil {
+		t.Errorf("注册错误 %s\n", err)
+		return
+	}
+
+	// 实体1: 10个版本 [0, 1] [2, 3] ... [18, 19]
+	const num = 10
+	for i := 0; i < num; i++ {
+		coll.Insert(bson.M{"pk": 1, "a": i, "_ver": 2 * i, "_next": 2*i + 1, "_is_latest": i == num-1})
+	}
+	coll.Insert(bson.M{"pk": 2, "a": 0, "_ver": 0, "_next": 0, "_is_latest": true})
+
+	history := func(params string) (total int, vers []int64, err error) {
+		res := httptest.NewRecorder()
+		url := fmt.Sprintf("/api/history/%s/%s/1%s", testdb, testcollection, params)
+		req, _ := http.NewRequest("GET", url, nil)
+		server.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			return 0, nil, fmt.Errorf("无法查询历史 %s", res.Body.String())
+		}
+		var result struct {
+			Msg struct {
+				Total    int
+				Versions []models.Version
+			}
+		}
+		if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+			return
+		}
+		for _, v := range result.Msg.Versions {
+			if !v.ValidFrom.Equal(reg.VerTime(v.Ver)) {
+				return 0, nil, fmt.Errorf("版本起始时间错误 %+v", v)
+			}
+			if v.IsLatest != (v.ValidTo == nil) {
+				return 0, nil, fmt.Errorf("版本结束时间错误 %+v", v)
+			}
+			vers = append(vers, v.Ver)
+		}
+		return result.Msg.Total, vers, nil
+	}
+
+	cases := []struct {
+		params string
+		total  int
+		vers   []int64
+	}{
+		{"?limit=3", num, []int64{0, 2, 4}},
+		{"?skip=8&limit=3", num, []int64{16, 18}},
+		{"?from=5&to=8", 3, []int64{4, 6, 8}},
+		{"?from=17", 2, []int64{16, 18}},
+	}
+	for _, cs := range cases {
+		total, vers, err := history(cs.params)
+		if err != nil {
+			t.Errorf("%s\n", err)
+			return
+		}
+		if total != cs.total || !reflect.DeepEqual(vers, cs.vers) {
+			t.Errorf("%s 返回版本错误 %v %v\n", cs.params, total, vers)
+			return
+		}
+	}
+
+	// 全部是数字的字符串key
+	coll.Insert(bson.M{"pk": "12345", "a": 0, "_ver": 0, "_next": 0, "_is_latest": true})
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/history/%s/%s/12345", testdb, testcollection), nil)
+	server.ServeHTTP(res, req)
+	var result struct {
+		Msg struct {
+			Total int
+		}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil || result.Msg.Total != 1 {
+		t.Errorf("数字字符串key查询历史错误 %v %+v\n", err, result)
+	}
+}
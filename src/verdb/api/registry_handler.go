@@ -85,3 +85,31 @@ func DeleteRegistry(c *gin.Context) {
 	}
 	jsonOk(c, *reg)
 }
+
+// 迁移进度：GET /api/migrations/:id
+// 修改注册信息的VerKeys或者版本时钟后，返回的注册信息中的migration为迁移任务id
+func GetMigration(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	job, err := rm.GetMigration(c.Params.ByName("id"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, job)
+}
+
+// 重新开始失败的迁移：POST /api/migrations/:id/restart
+// 已经迁移的实体会被跳过，任务由本实例执行
+func RestartMigration(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	job, err := rm.RestartMigration(c.Params.ByName("id"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, job)
+}
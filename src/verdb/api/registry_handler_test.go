@@ -42,7 +42,12 @@ func TestRegistryAPI(t *testing.T) {
 			"a.b",
 			"a.c.d",
 			"a.e.f"
-		]
+		],
+		"updateKeys": [
+			"owner",
+			{"path": "meta.location", "scope": "all"}
+		],
+		"excludeKeys": ["a.c.uptime"]
 	}
 	`
 	var reg models.Registry
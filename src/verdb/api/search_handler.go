@@ -1,21 +1,60 @@
 package api
 
 import (
+	"errors"
+	"verdb/models"
+
 	"github.com/gin-gonic/gin"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-// SearchInfo 收集特定表的数据，使用mongodb自带是搜寻语法
+/*
+SearchInfo 收集特定表的数据，使用mongodb自带是搜寻语法
+
+	POST /api/search/:database/:collection?asOf=<ver|time>
+	POST /api/search/:database/:collection?during=<ver|time>,<ver|time>
+	POST /api/search/:database/:collection?source=<source>&since=<time>&until=<time>
+
+对于已注册的表，会根据 _ver, _next 选出对应时间点的版本，增量存储的版本会被重建成完整记录:
+
+	asOf: 每个实体在该时间点的状态
+	during: 每个实体在该区间内出现过的所有版本
+	都没有指定时，只返回最新版本
+	source, since, until: 按照版本的提交来源和提交时间过滤
+
+增量存储的版本按照查询条件中的标识键和保留键选出，重建之后再按照完整的查询条件过滤，
+过滤时只支持常用的操作符(见models.Match)，其他操作符返回错误
+
+时间使用RFC3339格式，例如 2016-01-02T15:04:05+08:00
+*/
 func SearchInfo(c *gin.Context) {
 	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
 	database, collection := c.Param("database"), c.Param("collection")
 	var query bson.M
 	if err := c.BindJSON(&query); err != nil {
 		jsonError(c, err)
 		return
 	}
-	result, err := searchInfo(database, collection, query, sess)
+
+	var result []bson.M
+	var err error
+	if reg := rm.GetReg(database, collection); reg != nil {
+		temporal, terr := temporalQuery(c, reg)
+		if terr != nil {
+			jsonError(c, terr)
+			return
+		}
+		filter, ferr := metaFilter(c)
+		if ferr != nil {
+			jsonError(c, ferr)
+			return
+		}
+		result, err = reg.Search(query, models.And(temporal, filter.Query()), sess)
+	} else {
+		result, err = searchInfo(database, collection, query, sess)
+	}
 	if err != nil {
 		jsonError(c, err)
 		return
@@ -24,6 +63,28 @@ func SearchInfo(c *gin.Context) {
 	jsonOk(c, bson.M{"result": result})
 }
 
+// temporalQuery 根据asOf, during参数生成时间维度的查询条件
+func temporalQuery(c *gin.Context, reg *models.Registry) (bson.M, error) {
+	asOf, during := c.Query("asOf"), c.Query("during")
+	switch {
+	case asOf != "" && during != "":
+		return nil, errors.New("asOf and during cant be used together")
+	case asOf != "":
+		ver, err := reg.ParseVer(asOf)
+		if err != nil {
+			return nil, err
+		}
+		return models.AsOf(ver), nil
+	case during != "":
+		start, end, err := reg.ParseInterval(during)
+		if err != nil {
+			return nil, err
+		}
+		return models.During(start, end), nil
+	}
+	return models.Latest(), nil
+}
+
 func searchInfo(database, collection string, query bson.M, sess *mgo.Session) ([]bson.M, error) {
 	var result []bson.M
 	if err := sess.DB(database).C(collection).Find(query).All(&result); err != nil {
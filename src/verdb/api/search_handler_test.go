@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"verdb/models"
 
 	"github.com/gin-gonic/gin"
 
@@ -86,3 +87,90 @@ func TestSearchInfo(t *testing.T) {
 	}
 
 }
+
+func TestSearchInfoTemporal(t *testing.T) {
+	const (
+		testdb         = "testdb"
+		testcollection = "testtemporal"
+	)
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	// 初始化数据库
+	sess.DB(MetaDB).C(RegCollection).DropCollection()
+	coll := sess.DB(testdb).C(testcollection)
+	coll.DropCollection()
+
+	// 初始化server并注册
+	server := NewServer(gin.Default(), sess)
+	reg := &models.Registry{
+		DatabaseName:   testdb,
+		CollectionName: testcollection,
+		CompareKey:     "pk",
+		VerInterval:    models.Daily,
+		VerKeys:        []models.VerKey{{Path: "a"}},
+	}
+	if _, err := server.rm.CreateRegistry(reg, sess); err != nil {
+		t.Errorf("注册错误 %s\n", err)
+		return
+	}
+
+	// 实体1: [1, 4] [5, 7]，实体2: [3, 3]
+	coll.Insert(
+		bson.M{"pk": 1, "a": 1, "_ver": 1, "_next": 4, "_is_latest": false},
+		bson.M{"pk": 1, "a": 2, "_ver": 5, "_next": 7, "_is_latest": true},
+		bson.M{"pk": 2, "a": 1, "_ver": 3, "_next": 3, "_is_latest": true},
+	)
+
+	search := func(params string) ([]bson.M, error) {
+		res := httptest.NewRecorder()
+		url := fmt.Sprintf("/api/search/%s/%s%s", testdb, testcollection, params)
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(`{"pk": 1}`))
+		req.Header.Add("Content-Type", "application/json")
+		server.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			return nil, fmt.Errorf("无法查询 %s", res.Body.String())
+		}
+		var result struct {
+			Msg struct {
+				Result []bson.M
+			}
+		}
+		err := json.NewDecoder(res.Body).Decode(&result)
+		return result.Msg.Result, err
+	}
+
+	cases := []struct {
+		params string
+		as     []float64
+	}{
+		{"", []float64{2}},
+		{"?asOf=3", []float64{1}},
+		{"?asOf=6", []float64{2}},
+		{"?asOf=100", []float64{2}},
+		{"?asOf=0", nil},
+		{"?during=4,5", []float64{1, 2}},
+	}
+	for _, cs := range cases {
+		result, err := search(cs.params)
+		if err != nil {
+			t.Errorf("%s\n", err)
+			return
+		}
+		var as []float64
+		for _, doc := range result {
+			as = append(as, doc["a"].(float64))
+		}
+		if !reflect.DeepEqual(as, cs.as) {
+			t.Errorf("%s 返回版本错误 %v != %v\n", cs.params, as, cs.as)
+			return
+		}
+	}
+
+	if _, err := search("?asOf=1&during=1,2"); err == nil {
+		t.Errorf("asOf和during同时使用未报错\n")
+		return
+	}
+}
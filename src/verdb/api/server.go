@@ -1,6 +1,7 @@
 package api
 
 import (
+	"time"
 	"verdb/models"
 
 	"github.com/gin-gonic/gin"
@@ -20,3 +21,24 @@ func NewServer(r *gin.Engine, sess *mgo.Session) *Server {
 	setupAPI(server)
 	return server
 }
+
+// StartMaintenance 在后台定时运行维护任务(历史版本压缩)，返回的函数用于停止维护
+func (server *Server) StartMaintenance(interval time.Duration) (stop func()) {
+	ch := make(chan struct{})
+	go server.rm.Maintain(interval, ch, server.sess)
+	return func() { close(ch) }
+}
+
+// StartRegistrySync 在后台定时和其他实例同步注册缓存，返回的函数用于停止同步
+func (server *Server) StartRegistrySync(interval time.Duration) (stop func()) {
+	ch := make(chan struct{})
+	go server.rm.Watch(interval, ch, server.sess)
+	return func() { close(ch) }
+}
+
+// StartWebhooks 在后台定时投递webhook，返回的函数用于停止投递
+func (server *Server) StartWebhooks(interval time.Duration) (stop func()) {
+	ch := make(chan struct{})
+	go models.NewDispatcher(server.rm).Run(interval, ch, server.sess)
+	return func() { close(ch) }
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"errors"
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+Transitions 查询一段时间内指定VerKeys的每一次变化
+
+	POST /api/transitions/:database/:collection?from=<ver|time>&to=<ver|time>&skip=0&limit=100
+	{
+		"keys": ["osInfo.kernelRelease"], // 需要查询的VerKeys
+		"filter": {"idc": "bj"} // 可选，实体的最新版本需要满足的条件，使用mongodb查询语法
+	}
+
+from, to 限定新版本的_ver，返回每次变化的实体key、新旧版本号、旧值和新值，以及变化总数
+*/
+func Transitions(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+
+	var body struct {
+		Keys   []string `json:"keys"`
+		Filter bson.M   `json:"filter"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		jsonError(c, err)
+		return
+	}
+	q, err := transitionQuery(c, reg)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	q.Keys, q.Filter = body.Keys, body.Filter
+
+	transitions, total, err := reg.Transitions(q, sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, bson.M{"total": total, "transitions": transitions})
+}
+
+func transitionQuery(c *gin.Context, reg *models.Registry) (q models.TransitionQuery, err error) {
+	if q.From, err = queryVer(c, reg, "from"); err != nil {
+		return
+	}
+	if q.To, err = queryVer(c, reg, "to"); err != nil {
+		return
+	}
+	if q.Skip, err = queryInt(c, "skip", 0); err != nil {
+		return
+	}
+	q.Limit, err = queryInt(c, "limit", 0)
+	return
+}
@@ -1,7 +1,11 @@
 package api
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
+	"verdb/models"
 
 	"github.com/gin-gonic/gin"
 
@@ -15,3 +19,71 @@ func jsonError(c *gin.Context, err error) {
 func jsonOk(c *gin.Context, obj interface{}) {
 	c.JSON(http.StatusOK, bson.M{"status": "success", "msg": obj})
 }
+
+// queryVer 解析url参数中的版本号或时间，参数不存在时返回nil
+func queryVer(c *gin.Context, reg *models.Registry, name string) (*int64, error) {
+	s := c.Query(name)
+	if s == "" {
+		return nil, nil
+	}
+	ver, err := reg.ParseVer(s)
+	if err != nil {
+		return nil, err
+	}
+	return &ver, nil
+}
+
+// queryInt 解析url参数中的整数，参数不存在时返回def
+func queryInt(c *gin.Context, name string, def int) (int, error) {
+	s := c.Query(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.New("invalid " + name + ": " + s)
+	}
+	return n, nil
+}
+
+// queryTime 解析url参数中RFC3339格式的时间，参数不存在时返回nil
+func queryTime(c *gin.Context, name string) (*time.Time, error) {
+	s := c.Query(name)
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, errors.New("invalid " + name + ": " + s)
+	}
+	return &t, nil
+}
+
+/*
+requestMeta 从请求中取出提交来源
+
+	X-Verdb-Source: 采集端标识，没有时使用url参数source
+	X-Request-Id: 可选的请求id
+*/
+func requestMeta(c *gin.Context) *models.Meta {
+	source := c.Request.Header.Get("X-Verdb-Source")
+	if source == "" {
+		source = c.Query("source")
+	}
+	return &models.Meta{
+		Source:    source,
+		Submitted: time.Now(),
+		ClientIP:  c.ClientIP(),
+		RequestID: c.Request.Header.Get("X-Request-Id"),
+	}
+}
+
+// metaFilter 根据url参数source, since, until生成提交来源的过滤条件
+func metaFilter(c *gin.Context) (f models.MetaFilter, err error) {
+	f.Source = c.Query("source")
+	if f.Since, err = queryTime(c, "since"); err != nil {
+		return
+	}
+	f.Until, err = queryTime(c, "until")
+	return
+}
@@ -1,13 +1,26 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
 	"verdb/models"
 
 	"github.com/gin-gonic/gin"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
+/*
+Versionize 版本化一条记录
+
+	POST /api/versionize/:database/:collection?source=<source>
+
+提交来源(请求头 X-Verdb-Source 或者参数source, X-Request-Id, 客户端IP, 提交时间)记录在版本的 _meta 中，
+记录中自带的 _meta 会被忽略。返回处理结果(见models.Outcome)，其中的hash可以用于之后的Touch
+*/
 func Versionize(c *gin.Context) {
 	sess := c.MustGet("sess").(*mgo.Session)
 	rm := c.MustGet("rm").(*models.RegManager)
@@ -22,12 +35,226 @@ func Versionize(c *gin.Context) {
 
 	var newDoc map[string]interface{}
 	c.Bind(&newDoc)
+	if newDoc != nil {
+		newDoc[models.MetaKey] = requestMeta(c)
+	}
+
+	outcome, err := reg.Versionize(newDoc, sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, outcome)
+}
+
+/*
+DeleteEntity 删除实体，关闭最新版本并写入删除标记，历史版本会被保留
+
+	DELETE /api/versionize/:database/:collection/:key
+
+key为实体key(多个标识键时为json列表)，实体不存在或者已经被删除时返回错误
+*/
+func DeleteEntity(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+
+	key, err := reg.ResolveKey(c.Param("key"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	outcome, err := reg.Delete(key, requestMeta(c), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, bson.M{"action": outcome.Action, "ver": outcome.Ver})
+}
+
+/*
+Restore 把实体恢复到版本ver时的内容，生成新的最新版本
+
+	POST /api/restore/:database/:collection/:key?ver=<ver|time>
+*/
+func Restore(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
 
-	if err := reg.Versionize(newDoc, sess); err != nil {
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+	ver, err := queryVer(c, reg, "ver")
+	if err == nil && ver == nil {
+		err = errors.New("ver is required")
+	}
+	if err != nil {
 		jsonError(c, err)
 		return
 	}
 
-	jsonOk(c, "Successfully versionized")
-	return
+	key, err := reg.ResolveKey(c.Param("key"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	outcome, err := reg.Restore(key, *ver, requestMeta(c), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, outcome)
+}
+
+/*
+Undo 撤销实体最近一次提交生成的版本ver，之后有新的写入时返回错误
+
+	POST /api/undo/:database/:collection/:key?ver=<ver>
+*/
+func Undo(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+	ver, err := queryVer(c, reg, "ver")
+	if err == nil && ver == nil {
+		err = errors.New("ver is required")
+	}
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+
+	key, err := reg.ResolveKey(c.Param("key"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	outcome, err := reg.Undo(key, *ver, sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, outcome)
+}
+
+/*
+Touch 记录内容没有改变时只提交内容哈希，延长实体的最新版本
+
+	POST /api/touch/:database/:collection/:key?hash=<hash>
+
+hash由models.ContentHash计算，也可以使用上次提交返回的哈希，
+和最新版本的哈希不同时返回错误，需要提交完整记录
+*/
+func Touch(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	reg := rm.GetReg(c.Param("database"), c.Param("collection"))
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+	hash := c.Query("hash")
+	if hash == "" {
+		jsonError(c, errors.New("hash is required"))
+		return
+	}
+
+	key, err := reg.ResolveKey(c.Param("key"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	outcome, err := reg.Touch(key, hash, sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, outcome)
+}
+
+/*
+VersionizeBatch 批量版本化记录
+
+	POST /api/versionize/:database/:collection/batch?workers=8
+
+请求体可以是记录的json列表，也可以是每行一条记录的NDJSON，
+返回每条记录的处理结果(insert, update, extend, version)或者错误，
+同一批记录使用相同的提交来源，workers 不能小于1，超过models.MaxBatchWorkers时按上限处理
+*/
+func VersionizeBatch(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+	database := c.Params.ByName("database")
+	collection := c.Params.ByName("collection")
+
+	reg := rm.GetReg(database, collection)
+	if reg == nil {
+		jsonError(c, errors.New("Cant find registry"))
+		return
+	}
+
+	workers, err := queryInt(c, "workers", models.BatchWorkers)
+	if err == nil && workers < 1 {
+		err = errors.New("workers must be at least 1")
+	}
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	if workers > models.MaxBatchWorkers {
+		workers = models.MaxBatchWorkers
+	}
+
+	docs, err := decodeDocs(c.Request.Body)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+
+	meta := requestMeta(c)
+	for _, doc := range docs {
+		if doc != nil {
+			doc[models.MetaKey] = meta
+		}
+	}
+	jsonOk(c, bson.M{"results": reg.VersionizeBatch(docs, workers, sess)})
+}
+
+// decodeDocs 解析json列表或者NDJSON格式的记录
+func decodeDocs(r io.Reader) ([]map[string]interface{}, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+
+	var docs []map[string]interface{}
+	if len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &docs)
+		return docs, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc map[string]interface{}
+		if err = dec.Decode(&doc); err == io.EOF {
+			return docs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
 }
@@ -215,6 +215,14 @@ func TestVersionizeAPI(t *testing.T) {
 		t.Errorf("插入第一条记录错误 %s\n", err.Error())
 		return
 	}
+	var inserted struct {
+		Msg models.Outcome `json:"msg"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &inserted)
+	if inserted.Msg.Action != models.ActionInsert || inserted.Msg.Hash != findLast(sess, reg)[models.Hash] {
+		t.Errorf("插入第一条记录的返回结果错误 %s\n", res.Body.String())
+		return
+	}
 
 	// 生成num个新版
 	for i := 0; i < num; i++ {
@@ -294,3 +302,108 @@ func TestVersionizeAPI(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeDocs(t *testing.T) {
+	inputs := []string{
+		`[{"pk": 1}, {"pk": 2}]`,
+		"{\"pk\": 1}\n{\"pk\": 2}\n",
+	}
+	for _, input := range inputs {
+		docs, err := decodeDocs(bytes.NewBufferString(input))
+		if err != nil || len(docs) != 2 || docs[1]["pk"] != 2.0 {
+			t.Errorf("解析记录错误 %s %v %v\n", input, docs, err)
+			return
+		}
+	}
+	if _, err := decodeDocs(bytes.NewBufferString(`{"pk": 1}{"pk"`)); err == nil {
+		t.Errorf("非法输入未报错\n")
+		return
+	}
+}
+
+func TestVersionizeBatchAPI(t *testing.T) {
+	regJSON := `
+	{
+	    "databaseName": "testdb",
+	    "compareKey": "pk",
+	    "collectionName": "testbatch",
+	    "verInterval": -1,
+	    "verKeys": ["a"]
+    }`
+	var reg = &models.Registry{}
+	json.Unmarshal([]byte(regJSON), reg)
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+
+	// 清空数据库
+	sess.DB(MetaDB).C(RegCollection).DropCollection()
+	sess.DB(reg.DatabaseName).C(reg.CollectionName).DropCollection()
+
+	// 初始化server并注册
+	server := NewServer(gin.Default(), sess)
+	if _, err := server.rm.CreateRegistry(reg, sess); err != nil {
+		t.Errorf("注册错误 %s\n", err)
+		return
+	}
+
+	// 每个实体的记录按提交顺序处理
+	var body bytes.Buffer
+	for pk := 0; pk < 20; pk++ {
+		for _, a := range []int{1, 1, 2} {
+			fmt.Fprintf(&body, "{\"pk\": %d, \"a\": %d}\n", pk, a)
+		}
+	}
+	body.WriteString(`{"a": 1}`)
+
+	response := httptest.NewRecorder()
+	url := fmt.Sprintf("/api/versionize/%s/%s/batch", reg.DatabaseName, reg.CollectionName)
+	req, _ := http.NewRequest("POST", url, &body)
+	server.ServeHTTP(response, req)
+	if response.Code != http.StatusOK {
+		t.Errorf("批量版本化错误 %s\n", response.Body.String())
+		return
+	}
+
+	var result struct {
+		Msg struct {
+			Results []models.BatchResult
+		}
+	}
+	json.NewDecoder(response.Body).Decode(&result)
+	results := result.Msg.Results
+	if len(results) != 61 {
+		t.Errorf("返回结果数目错误 %d\n", len(results))
+		return
+	}
+	actions := []string{models.ActionInsert, models.ActionExtend, models.ActionVersion}
+	for i, res := range results[:60] {
+		if res.Index != i || res.Error != "" || res.Action != actions[i%3] {
+			t.Errorf("第%d条记录处理结果错误 %+v\n", i, res)
+			return
+		}
+	}
+	if results[60].Error == "" {
+		t.Errorf("缺少CompareKey的记录未报错\n")
+		return
+	}
+
+	count, _ := sess.DB(reg.DatabaseName).C(reg.CollectionName).Count()
+	if count != 40 {
+		t.Errorf("版本数目错误 %d\n", count)
+		return
+	}
+
+	// workers 小于1时报错
+	response = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", url+"?workers=0", bytes.NewBufferString(`{"pk": 1, "a": 3}`))
+	server.ServeHTTP(response, req)
+	if response.Code == http.StatusOK {
+		t.Errorf("workers=0 未报错\n")
+		return
+	}
+}
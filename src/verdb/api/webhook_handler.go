@@ -0,0 +1,85 @@
+package api
+
+import (
+	"verdb/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+)
+
+/*
+新建订阅：POST /api/webhooks
+
+	{
+		"registry": "frradar/serverInfo",
+		"url": "http://example.com/hook",
+		"secret": "xxx", // 用于签名请求，见models.Sign
+		"keys": ["osInfo.kernelRelease"] // 只订阅这些VerKeys的改变，为空时订阅所有新版本
+	}
+*/
+func NewWebhook(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	var hook models.Webhook
+	c.Bind(&hook)
+
+	if _, err := rm.CreateWebhook(&hook, sess); err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, hook)
+}
+
+// 查询订阅：GET /api/webhooks?registry=<name>，不返回secret
+func ListWebhooks(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	hooks, err := rm.Webhooks(c.Query("registry"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	jsonOk(c, hooks)
+}
+
+// 删除订阅：DELETE /api/webhooks/:id
+func DeleteWebhook(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	if err := rm.DeleteWebhook(c.Params.ByName("id"), sess); err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, "Successfully deleted")
+}
+
+// 投递记录：GET /api/webhooks/:id/deliveries?status=failed
+func ListDeliveries(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	deliveries, err := rm.Deliveries(c.Params.ByName("id"), c.Query("status"), sess)
+	if err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, deliveries)
+}
+
+// 重新投递：POST /api/deliveries/:id/redeliver
+func Redeliver(c *gin.Context) {
+	sess := c.MustGet("sess").(*mgo.Session)
+	rm := c.MustGet("rm").(*models.RegManager)
+
+	if err := rm.Redeliver(c.Params.ByName("id"), sess); err != nil {
+		jsonError(c, err)
+		return
+	}
+	jsonOk(c, "Successfully scheduled")
+}
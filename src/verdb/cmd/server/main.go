@@ -11,5 +11,8 @@ func main() {
 	sess, _ := mgo.Dial("localhost")
 	r := gin.Default()
 	server := api.NewServer(r, sess)
+	server.StartMaintenance(api.MaintainInterval)
+	server.StartWebhooks(api.WebhookInterval)
+	server.StartRegistrySync(api.RegSyncInterval)
 	server.Run(":8080")
 }
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ObservedAt 提交记录中的观测时间，RFC3339格式的字符串或者unix秒数，没有时使用提交时间
+const ObservedAt = "_observed_at"
+
+// ActionSplit 回填的记录落在一个版本的中间，拆分该版本
+const ActionSplit = "split"
+
+// observedAt 读取并删除记录中的观测时间
+func observedAt(doc map[string]interface{}) (t time.Time, ok bool, err error) {
+	v, ok := doc[ObservedAt]
+	if !ok {
+		return
+	}
+	delete(doc, ObservedAt)
+
+	switch tv := v.(type) {
+	case time.Time:
+		t = tv
+	case string:
+		t, err = time.Parse(time.RFC3339, tv)
+	case float64:
+		t = time.Unix(int64(tv), 0)
+	case int, int32, int64:
+		t = time.Unix(asInt64(tv), 0)
+	default:
+		err = errors.New("invalid " + ObservedAt)
+	}
+	return
+}
+
+/*
+backfill 把观测时间早于最新版本最后一次观测的记录new回填到历史中，
+各版本的有效区间首尾相接，设覆盖ver的版本为old:
+  - 没有覆盖ver的版本(早于第一个版本):
+    new和第一个版本相同时，把第一个版本的_ver提前到ver，否则插入 new[ver, first._ver-1]
+  - new和old相同: 已经记录，不做修改
+  - old的区间只有ver: 用new替换old的内容
+  - ver是old的第一个区间: new和前一个版本相同时延长前一个版本，否则插入new，old从ver+1开始
+  - ver是old的最后一个区间: new和后一个版本相同时提前后一个版本，否则插入new，old到ver-1结束
+  - 其他情况拆分old: old[_ver, ver-1], new[ver, ver], old[ver+1, _next]
+
+插入new之后，new和它之后的版本的 _changed 按照新的前一个版本重新计算，见churn.go
+*/
+func (reg *Registry) backfill(key interface{}, ver int64, newDoc map[string]interface{}, sess *mgo.Session) (Outcome, error) {
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	keyQuery := reg.keyQuery(key)
+	find := func(query bson.M, sort string) (map[string]interface{}, error) {
+		var doc map[string]interface{}
+		err := collection.Find(And(keyQuery, query)).Sort(sort).One(&doc)
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return reg.decodeOne(doc, sess)
+	}
+
+	newDoc["_id"] = bson.NewObjectId()
+	newDoc["_ver"] = ver
+	newDoc["_next"] = ver
+	newDoc["_is_latest"] = false
+
+	oldDoc, err := find(bson.M{"_ver": bson.M{"$lte": ver}}, "-_ver")
+	if err != nil {
+		return Outcome{}, err
+	}
+
+	// 早于第一个版本
+	if oldDoc == nil {
+		first, err := find(nil, "_ver")
+		if err != nil {
+			return Outcome{}, err
+		}
+		if !reg.differs(first, newDoc) {
+			return reg.commitChange(key, Outcome{Action: ActionExtend, Ver: ver}, sess, setOp(first["_id"], bson.M{"_ver": ver}))
+		}
+		newDoc["_next"] = asInt64(first["_ver"]) - 1
+		return reg.commitChange(key, Outcome{Action: ActionVersion, Ver: ver, Changed: reg.changedKeys(nil, newDoc)}, sess,
+			insertOp(newDoc), reg.changedOp(newDoc, first))
+	}
+
+	oldVer, oldNext := asInt64(oldDoc["_ver"]), asInt64(oldDoc["_next"])
+	if !reg.differs(oldDoc, newDoc) {
+		return reg.commitChange(key, Outcome{Action: ActionExtend, Ver: oldVer}, sess)
+	}
+	changed := reg.changedKeys(oldDoc, newDoc)
+
+	switch {
+	case oldVer == ver && oldNext == ver:
+		prev, err := find(bson.M{"_next": ver - 1}, "-_ver")
+		if err != nil {
+			return Outcome{}, err
+		}
+		next, err := find(bson.M{"_ver": ver + 1}, "_ver")
+		if err != nil {
+			return Outcome{}, err
+		}
+		newDoc["_id"] = oldDoc["_id"]
+		reg.setChanged(prev, newDoc)
+		ops := []journalOp{insertOp(newDoc)}
+		if next != nil {
+			ops = append(ops, reg.changedOp(newDoc, next))
+		}
+		return reg.commitChange(key, Outcome{Action: ActionUpdate, Ver: ver}, sess, ops...)
+
+	case oldVer == ver:
+		prev, err := find(bson.M{"_next": ver - 1}, "-_ver")
+		if err != nil {
+			return Outcome{}, err
+		}
+		shift := setOp(oldDoc["_id"], bson.M{"_ver": ver + 1})
+		if prev != nil && !reg.differs(prev, newDoc) {
+			return reg.commitChange(key, Outcome{Action: ActionExtend, Ver: asInt64(prev["_ver"])}, sess,
+				setOp(prev["_id"], bson.M{"_next": ver}), shift)
+		}
+		reg.setChanged(prev, newDoc)
+		return reg.commitChange(key, Outcome{Action: ActionVersion, Ver: ver, Prev: oldVer, Changed: changed}, sess,
+			shift, insertOp(newDoc), reg.changedOp(newDoc, oldDoc))
+
+	case oldNext == ver:
+		next, err := find(bson.M{"_ver": ver + 1}, "_ver")
+		if err != nil {
+			return Outcome{}, err
+		}
+		shift := setOp(oldDoc["_id"], bson.M{"_next": ver - 1})
+		if next != nil && !reg.differs(next, newDoc) {
+			return reg.commitChange(key, Outcome{Action: ActionExtend, Ver: ver}, sess,
+				shift, setOp(next["_id"], bson.M{"_ver": ver}))
+		}
+		reg.setChanged(oldDoc, newDoc)
+		ops := []journalOp{shift, insertOp(newDoc)}
+		if next != nil {
+			ops = append(ops, reg.changedOp(newDoc, next))
+		}
+		return reg.commitChange(key, Outcome{Action: ActionVersion, Ver: ver, Prev: oldVer, Changed: changed}, sess,
+			ops...)
+	}
+
+	tail := make(map[string]interface{}, len(oldDoc))
+	for k, v := range oldDoc {
+		tail[k] = v
+	}
+	tail["_id"] = bson.NewObjectId()
+	tail["_ver"] = ver + 1
+	reg.setChanged(oldDoc, newDoc)
+	reg.setChanged(newDoc, tail)
+	return reg.commitChange(key, Outcome{Action: ActionSplit, Ver: ver, Prev: oldVer, Changed: changed}, sess,
+		setOp(oldDoc["_id"], bson.M{
+			"_next":      ver - 1,
+			"_is_latest": false,
+		}),
+		insertOp(newDoc),
+		insertOp(tail),
+	)
+}
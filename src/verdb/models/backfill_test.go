@@ -0,0 +1,106 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestObservedAt(t *testing.T) {
+	tm := time.Date(2016, 3, 1, 10, 0, 0, 0, time.UTC)
+	for _, v := range []interface{}{tm, tm.Format(time.RFC3339), float64(tm.Unix()), tm.Unix()} {
+		doc := map[string]interface{}{ObservedAt: v}
+		observed, ok, err := observedAt(doc)
+		if !ok || err != nil || !observed.Equal(tm) {
+			t.Errorf("%#v 观测时间解析错误 %v %v %v\n", v, observed, ok, err)
+			return
+		}
+		if _, ok := doc[ObservedAt]; ok {
+			t.Errorf("观测时间没有从记录中删除\n")
+			return
+		}
+	}
+	if _, ok, _ := observedAt(map[string]interface{}{}); ok {
+		t.Errorf("没有观测时间时解析错误\n")
+		return
+	}
+	if _, _, err := observedAt(map[string]interface{}{ObservedAt: "yesterday"}); err == nil {
+		t.Errorf("非法观测时间未报错\n")
+		return
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testbackfill",
+		Name:           "testdb/testbackfill",
+		CompareKey:     "pk",
+		VerInterval:    Daily,
+		VerKeys:        []VerKey{{Path: "a"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	day := func(n int64) string {
+		return time.Unix(n*Daily+Hourly, 0).UTC().Format(time.RFC3339)
+	}
+
+	steps := []struct {
+		day    int64
+		a      int
+		action string
+	}{
+		{10, 1, ActionInsert},
+		{20, 1, ActionExtend},
+		{15, 2, ActionSplit},   // [10,14] [15,15] [16,20]
+		{15, 3, ActionUpdate},  // [15,15]的内容更新为3
+		{16, 3, ActionExtend},  // [15,16] [17,20]
+		{5, 1, ActionExtend},   // [5,14]
+		{2, 0, ActionVersion},  // [2,4]
+		{14, 3, ActionExtend},  // [5,13] [14,16]
+		{12, 1, ActionExtend},  // 已经记录
+		{21, 2, ActionVersion}, // [17,20] [21,21]
+	}
+	for _, step := range steps {
+		outcome, err := reg.Versionize(map[string]interface{}{"pk": 1, "a": step.a, ObservedAt: day(step.day)}, sess)
+		if err != nil || outcome.Action != step.action {
+			t.Errorf("%+v 处理结果错误 %+v %v\n", step, outcome, err)
+			return
+		}
+	}
+
+	var docs []bson.M
+	collection.Find(bson.M{"pk": 1}).Sort("_ver").All(&docs)
+	var ranges [][]int64
+	for _, doc := range docs {
+		ranges = append(ranges, []int64{asInt64(doc["_ver"]), asInt64(doc["_next"]), int64(doc["a"].(int))})
+		if (doc["_is_latest"] == true) != (asInt64(doc["_ver"]) == 21) {
+			t.Errorf("最新版本错误 %v\n", doc)
+			return
+		}
+		// 回填之后按照新的前一个版本计算_changed
+		if changed, first := doc[ChangedKey], asInt64(doc["_ver"]) == 2; first != (changed == nil) || !first && !reflect.DeepEqual(changed, []interface{}{"a"}) {
+			t.Errorf("_changed错误 %v\n", doc)
+			return
+		}
+	}
+	expected := [][]int64{{2, 4, 0}, {5, 13, 1}, {14, 16, 3}, {17, 20, 1}, {21, 21, 2}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("回填后版本区间错误\n%v\n%v\n", ranges, expected)
+		return
+	}
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+)
+
+// BatchWorkers 批量版本化时并发处理的实体数
+const BatchWorkers = 8
+
+// MaxBatchWorkers 批量版本化时并发处理的实体数上限，每个goroutine占用一个session
+const MaxBatchWorkers = BatchWorkers * 4
+
+// BatchResult 批量版本化中一条记录的处理结果
+type BatchResult struct {
+	Index  int    `json:"index"` // 记录在提交列表中的位置
+	Action string `json:"action,omitempty"`
+	Ver    int64  `json:"ver,omitempty"`
+	Hash   string `json:"hash,omitempty"` // 记录的内容哈希，见hash.go
+	Error  string `json:"error,omitempty"`
+}
+
+/*
+VersionizeBatch 批量版本化记录，按照提交顺序返回每条记录的处理结果
+同一个实体的记录按照提交顺序依次处理，不同实体的记录由workers(不超过MaxBatchWorkers)个goroutine并发处理，
+每个goroutine使用独立的session
+*/
+func (reg *Registry) VersionizeBatch(docs []map[string]interface{}, workers int, sess *mgo.Session) []BatchResult {
+	results := make([]BatchResult, len(docs))
+
+	// 按照实体key对记录分组，保持组内顺序
+	var groups [][]int
+	index := map[string]int{}
+	for i, doc := range docs {
+		results[i].Index = i
+		entity, err := reg.EntityKey(doc)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		key := fmt.Sprintf("%v", entity)
+		g, ok := index[key]
+		if !ok {
+			g = len(groups)
+			index[key] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	if workers <= 0 {
+		workers = BatchWorkers
+	} else if workers > MaxBatchWorkers {
+		workers = MaxBatchWorkers
+	}
+	ch := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(groups); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wsess := sess.Copy()
+			defer wsess.Close()
+			for group := range ch {
+				for _, i := range group {
+					outcome, err := reg.Versionize(docs[i], wsess)
+					if err != nil {
+						results[i].Error = err.Error()
+						continue
+					}
+					results[i].Action, results[i].Ver, results[i].Hash = outcome.Action, outcome.Ver, outcome.Hash
+				}
+			}
+		}()
+	}
+	for _, group := range groups {
+		ch <- group
+	}
+	close(ch)
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,248 @@
+package models
+
+import (
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+变更日志
+
+每次写入(Versionize, Delete, Restore, Undo, Touch)的处理结果按顺序追加到 <collection>.changes 中，
+序号(seq)从1开始单调递增，保存在 <collection>.counters 中。
+变更记录和版本的修改写入同一条日志(journal)，一起完成或者一起被重放，见journal.go。
+序号在锁定实体之后分配，因此同一个实体的序号的顺序和写入的顺序一致。
+分配序号时在计数器的pending中原子的登记写入的实体，写入结束(成功或者失败)之后清除登记。
+不同实体并发写入时，较小的序号可能晚于较大的序号写入，Changes只返回连续的部分。
+缺少的序号超过ChangeGapWait仍未出现时，逐个锁定登记的实体: 等待写入中的实体释放锁，
+重放中断的日志，清除失败的写入留下的登记(settleSeqs)。之后仍然缺少的序号确认不会再写入，被跳过。
+客户端保存最后处理的序号，从该序号之后继续读取。
+*/
+
+// changesSuffix 变更日志表相对记录表的后缀
+const changesSuffix = ".changes"
+
+// ChangeRecord 变更日志中的一条记录
+type ChangeRecord struct {
+	Seq     int64       `json:"seq" bson:"_id"`
+	Key     interface{} `json:"key" bson:"key"`
+	Action  string      `json:"action" bson:"action"`
+	Ver     int64       `json:"ver" bson:"ver"`
+	Prev    int64       `json:"prev,omitempty" bson:"prev,omitempty"`
+	Changed []string    `json:"changed,omitempty" bson:"changed,omitempty"`
+	Time    time.Time   `json:"time" bson:"time"`
+
+	// 生成新版本时，新老版本在变更时的内容哈希，投递webhook时用于确认读到的是变更时的内容
+	Hash     string `json:"hash,omitempty" bson:"hash,omitempty"`
+	PrevHash string `json:"prevHash,omitempty" bson:"prevHash,omitempty"`
+}
+
+func (reg *Registry) changes(sess *mgo.Session) *mgo.Collection {
+	return sess.DB(reg.DatabaseName).C(reg.CollectionName + changesSuffix)
+}
+
+// seqClaim 计数器中登记的已经分配序号、还没有结束的写入
+type seqClaim struct {
+	ID  bson.ObjectId `bson:"_id"`
+	Key interface{}   `bson:"key"`
+}
+
+func (reg *Registry) counters(sess *mgo.Session) *mgo.Collection {
+	return sess.DB(reg.DatabaseName).C(reg.CollectionName + ".counters")
+}
+
+// allocSeq 为实体key的写入分配变更记录的序号，同时登记到计数器的pending中，写入结束后调用返回的release
+func (reg *Registry) allocSeq(key interface{}, sess *mgo.Session) (int64, func(), error) {
+	claim := seqClaim{ID: bson.NewObjectId(), Key: key}
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	_, err := reg.counters(sess).FindId("changes").Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": int64(1)}, "$push": bson.M{"pending": claim}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &counter)
+	if err != nil {
+		return 0, nil, err
+	}
+	release := func() {
+		if err := reg.releaseSeq(claim.ID, sess); err != nil { // 留下的登记由settleSeqs清除
+			log.Println("Changes", reg.Name, key, err)
+		}
+	}
+	return counter.Seq, release, nil
+}
+
+func (reg *Registry) releaseSeq(id bson.ObjectId, sess *mgo.Session) error {
+	return reg.counters(sess).UpdateId("changes", bson.M{"$pull": bson.M{"pending": bson.M{"_id": id}}})
+}
+
+/*
+settleSeqs 等待已经分配序号的写入结束: 逐个锁定计数器中登记的实体(写入中的实体释放锁之后才能锁定)，
+重放中断的日志，清除登记。返回之后，调用之前分配的序号要么已经写入变更记录，要么不会再写入
+*/
+func (reg *Registry) settleSeqs(sess *mgo.Session) error {
+	var counter struct {
+		Pending []seqClaim `bson:"pending"`
+	}
+	err := reg.counters(sess).FindId("changes").One(&counter)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, claim := range counter.Pending {
+		unlock, err := reg.lockEntity(claim.Key, sess)
+		if err != nil {
+			return err
+		}
+		if err = reg.recover(bson.M{"key": claim.Key}, sess); err == nil {
+			err = reg.releaseSeq(claim.ID, sess)
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeOp 插入变更记录的日志操作
+func changeOp(record *ChangeRecord) journalOp {
+	doc := bson.M{
+		"_id":    record.Seq,
+		"key":    record.Key,
+		"action": record.Action,
+		"ver":    record.Ver,
+		"time":   record.Time,
+	}
+	if record.Prev != 0 {
+		doc["prev"] = record.Prev
+	}
+	if len(record.Changed) > 0 {
+		doc["changed"] = record.Changed
+	}
+	if record.Hash != "" {
+		doc["hash"] = record.Hash
+	}
+	if record.PrevHash != "" {
+		doc["prevHash"] = record.PrevHash
+	}
+	return journalOp{ID: record.Seq, Insert: doc, Coll: changesSuffix}
+}
+
+/*
+commitChange 原子的执行实体key的一组操作，同时追加处理结果outcome的变更记录，需要在锁定实体时调用
+ops为空时只追加变更记录
+*/
+func (reg *Registry) commitChange(key interface{}, outcome Outcome, sess *mgo.Session, ops ...journalOp) (Outcome, error) {
+	seq, release, err := reg.allocSeq(key, sess)
+	if err != nil {
+		return outcome, err
+	}
+	defer release()
+	record := &ChangeRecord{
+		Seq:     seq,
+		Key:     key,
+		Action:  outcome.Action,
+		Ver:     outcome.Ver,
+		Prev:    outcome.Prev,
+		Changed: outcome.Changed,
+		Time:    time.Now(),
+	}
+	switch outcome.Action {
+	case ActionInsert, ActionVersion, ActionSplit:
+		if record.Hash, err = reg.versionHash(key, outcome.Ver, ops, sess); err != nil {
+			return outcome, err
+		}
+		if outcome.Prev != 0 {
+			if record.PrevHash, err = reg.versionHash(key, outcome.Prev, ops, sess); err != nil {
+				return outcome, err
+			}
+		}
+	}
+	return outcome, reg.commit(key, sess, append(ops, changeOp(record))...)
+}
+
+// versionHash 返回ops提交之后实体key的版本ver的内容哈希: ops中插入了该版本时使用插入的记录，否则读取数据库
+func (reg *Registry) versionHash(key interface{}, ver int64, ops []journalOp, sess *mgo.Session) (string, error) {
+	for _, op := range ops {
+		if op.Insert != nil && op.Coll == "" && asInt64(op.Insert["_ver"]) == ver && !isDeleted(op.Insert) {
+			hash, _ := op.Insert[Hash].(string)
+			return hash, nil
+		}
+	}
+	var doc map[string]interface{}
+	err := sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(And(reg.keyQuery(key), bson.M{"_ver": ver})).
+		Select(bson.M{Hash: 1}).Sort("-_next").One(&doc)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	hash, _ := doc[Hash].(string)
+	return hash, err
+}
+
+// ChangeGapWait 缺少的序号超过这个时间没有出现时，确认它是否还会被写入
+var ChangeGapWait = 5 * time.Second
+
+// Changes 按顺序返回序号大于after的最多limit条变更日志，limit <= 0 时不限制
+func (reg *Registry) Changes(after int64, limit int, sess *mgo.Session) ([]ChangeRecord, error) {
+	records, err := reg.readChanges(after, limit, sess)
+	if err != nil {
+		return nil, err
+	}
+
+	// 等待超时的序号可能还在写入或者在中断的写入日志中，结束这些写入之后重新读取，仍然缺少的序号被跳过
+	bound := staleGap(records, after, time.Now())
+	if bound > 0 {
+		if err = reg.settleSeqs(sess); err != nil {
+			return nil, err
+		}
+		if records, err = reg.readChanges(after, limit, sess); err != nil {
+			return nil, err
+		}
+	}
+	return contiguous(records, after, bound), nil
+}
+
+func (reg *Registry) readChanges(after int64, limit int, sess *mgo.Session) ([]ChangeRecord, error) {
+	query := reg.changes(sess).Find(bson.M{"_id": bson.M{"$gt": after}}).Sort("_id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	records := []ChangeRecord{}
+	if err := query.All(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// contiguous 返回records中序号从after+1开始连续的部分，已经确认不会再写入的小于bound的序号被跳过
+func contiguous(records []ChangeRecord, after, bound int64) []ChangeRecord {
+	next := after + 1
+	for i, record := range records {
+		if record.Seq != next && record.Seq > bound {
+			return records[:i]
+		}
+		next = record.Seq + 1
+	}
+	return records
+}
+
+// staleGap 返回等待超过ChangeGapWait的最后一个空缺之后的记录的序号，没有时返回0
+func staleGap(records []ChangeRecord, after int64, now time.Time) int64 {
+	next, bound := after+1, int64(0)
+	for _, record := range records {
+		if record.Seq != next {
+			if now.Sub(record.Time) < ChangeGapWait {
+				break
+			}
+			bound = record.Seq
+		}
+		next = record.Seq + 1
+	}
+	return bound
+}
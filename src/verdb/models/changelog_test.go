@@ -0,0 +1,177 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestChangeLog(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testchanges",
+		Name:           "testdb/testchanges",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	db := sess.DB(reg.DatabaseName)
+	for _, name := range []string{"", ".changes", ".counters", ".journal"} {
+		db.C(reg.CollectionName + name).DropCollection()
+	}
+
+	reg.Versionize(map[string]interface{}{"pk": 1, "a": 1}, sess)
+	reg.Versionize(map[string]interface{}{"pk": 2, "a": 1}, sess)
+	reg.Versionize(map[string]interface{}{"pk": 1, "a": 2}, sess)
+	reg.Delete(2, nil, sess)
+	if _, err = reg.Delete(2, nil, sess); err == nil {
+		t.Errorf("重复删除未报错\n")
+		return
+	}
+
+	records, err := reg.Changes(0, 0, sess)
+	if err != nil {
+		t.Errorf("读取变更日志失败 %v\n", err)
+		return
+	}
+	var got []interface{}
+	for i, record := range records {
+		if record.Seq != int64(i+1) {
+			t.Errorf("变更序号错误 %+v\n", record)
+			return
+		}
+		got = append(got, record.Key, record.Action)
+	}
+	expected := []interface{}{1, ActionInsert, 2, ActionInsert, 1, ActionVersion, 2, ActionDelete}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("变更日志错误\n%v\n%v\n", got, expected)
+		return
+	}
+
+	// 从游标之后继续读取
+	if records, err = reg.Changes(2, 1, sess); err != nil || len(records) != 1 || records[0].Seq != 3 {
+		t.Errorf("从游标读取变更日志错误 %+v %v\n", records, err)
+		return
+	}
+
+	// 修改版本之后、写入变更记录之前中断，变更记录保留在日志中
+	commitHook = func(i int) error {
+		if i == 1 {
+			return errors.New("crash")
+		}
+		return nil
+	}
+	_, err = reg.Versionize(map[string]interface{}{"pk": 1, "a": 3}, sess)
+	commitHook = nil
+	if err == nil {
+		t.Errorf("注入的错误没有返回\n")
+		return
+	}
+	reg.Versionize(map[string]interface{}{"pk": 3, "a": 1}, sess)
+	if records, _ = reg.Changes(4, 0, sess); len(records) != 0 {
+		t.Errorf("缺少的序号没有等待 %+v\n", records)
+		return
+	}
+
+	// 等待超时之后重放日志，中断的变更不会被跳过
+	defer func(wait time.Duration) { ChangeGapWait = wait }(ChangeGapWait)
+	ChangeGapWait = 0
+	records, err = reg.Changes(4, 0, sess)
+	if err != nil || len(records) != 2 || records[0].Seq != 5 || records[0].Action != ActionVersion || records[1].Seq != 6 {
+		t.Errorf("重放中断的变更记录错误 %+v %v\n", records, err)
+		return
+	}
+
+	// 分配序号之后迟迟没有写入的实体，等待写入结束，不会被跳过
+	unlock, err := reg.lockEntity(4, sess)
+	if err != nil {
+		t.Errorf("锁定实体失败 %v\n", err)
+		return
+	}
+	seq, release, err := reg.allocSeq(4, sess)
+	if err != nil || seq != 7 {
+		t.Errorf("分配序号错误 %d %v\n", seq, err)
+		return
+	}
+	reg.Versionize(map[string]interface{}{"pk": 5, "a": 1}, sess)
+	done := make(chan []ChangeRecord)
+	go func() {
+		records, _ := reg.Changes(6, 0, sess)
+		done <- records
+	}()
+	select {
+	case records = <-done:
+		t.Errorf("写入中的序号被跳过 %+v\n", records)
+		return
+	case <-time.After(200 * time.Millisecond):
+	}
+	record := &ChangeRecord{Seq: seq, Key: 4, Action: ActionInsert, Ver: 1, Time: time.Now()}
+	err = reg.commit(4, sess, changeOp(record))
+	release()
+	unlock()
+	if records = <-done; err != nil || len(records) != 2 || records[0].Seq != 7 || records[1].Seq != 8 {
+		t.Errorf("等待写入结束之后的变更记录错误 %+v %v\n", records, err)
+		return
+	}
+
+	// 分配序号之后写入失败，登记被清除，确认之后跳过该序号
+	if seq, _, err = reg.allocSeq(6, sess); err != nil || seq != 9 {
+		t.Errorf("分配序号错误 %d %v\n", seq, err)
+		return
+	}
+	reg.Versionize(map[string]interface{}{"pk": 6, "a": 1}, sess)
+	if records, err = reg.Changes(8, 0, sess); err != nil || len(records) != 1 || records[0].Seq != 10 {
+		t.Errorf("失败的写入的序号没有被跳过 %+v %v\n", records, err)
+		return
+	}
+	var counter struct {
+		Pending []seqClaim `bson:"pending"`
+	}
+	if reg.counters(sess).FindId("changes").One(&counter); len(counter.Pending) != 0 {
+		t.Errorf("登记没有被清除 %+v\n", counter.Pending)
+		return
+	}
+}
+
+func TestContiguous(t *testing.T) {
+	now := time.Now()
+	records := []ChangeRecord{
+		{Seq: 3, Time: now},
+		{Seq: 4, Time: now},
+		{Seq: 6, Time: now}, // 5还没有写入
+		{Seq: 7, Time: now},
+		{Seq: 9, Time: now.Add(ChangeGapWait)}, // 8还没有写入
+	}
+	if got := contiguous(records, 2, 0); len(got) != 2 || got[1].Seq != 4 {
+		t.Errorf("只应该返回连续的序号 %+v\n", got)
+	}
+	if got := contiguous(records, 1, 0); len(got) != 0 {
+		t.Errorf("缺少第一个序号时应该等待 %+v\n", got)
+	}
+
+	// 确认不会再写入的空缺被跳过，之后的空缺仍然等待
+	if got := contiguous(records, 2, 6); len(got) != 4 || got[3].Seq != 7 {
+		t.Errorf("确认的空缺没有被跳过 %+v\n", got)
+	}
+
+	// 只确认等待超时的空缺
+	if bound := staleGap(records, 2, now); bound != 0 {
+		t.Errorf("没有超时的空缺 %d\n", bound)
+	}
+	if bound := staleGap(records, 2, now.Add(ChangeGapWait)); bound != 6 {
+		t.Errorf("超时的空缺错误 %d\n", bound)
+	}
+}
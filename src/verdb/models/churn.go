@@ -0,0 +1,208 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+版本变化统计
+
+生成新版本时(Versionize, Restore, 回填)，在新版本的 _changed 中记录相对前一个版本发生改变的VerKeys:
+
+	{serverId: 1, _ver: 20, _next: 25, _changed: ["osInfo.kernelRelease", "disks"]}
+
+实体的第一个版本、删除之后重新开始的版本和删除标记没有 _changed。
+记录 _changed 之前生成的版本不参与统计。
+*/
+
+// ChangedKey 版本中记录发生改变的VerKeys的保留键
+const ChangedKey = "_changed"
+
+// DefaultChurnTop 默认返回改变次数最多的10个VerKeys和实体
+const DefaultChurnTop = 10
+
+// versionChanged 版本doc相对前一个版本prev发生改变的VerKeys，doc是生命周期中的第一个版本时返回nil
+func (reg *Registry) versionChanged(prev, doc map[string]interface{}) []string {
+	if prev == nil || isDeleted(prev) || isDeleted(doc) {
+		return nil
+	}
+	changed := reg.changedKeys(prev, doc)
+	if changed == nil {
+		changed = []string{}
+	}
+	return changed
+}
+
+// setChanged 设置doc的_changed
+func (reg *Registry) setChanged(prev, doc map[string]interface{}) {
+	if changed := reg.versionChanged(prev, doc); changed != nil {
+		doc[ChangedKey] = changed
+	} else {
+		delete(doc, ChangedKey)
+	}
+}
+
+// changedOp 前一个版本变为prev之后，更新数据库中版本doc的_changed
+func (reg *Registry) changedOp(prev, doc map[string]interface{}) journalOp {
+	if changed := reg.versionChanged(prev, doc); changed != nil {
+		return setOp(doc["_id"], bson.M{ChangedKey: changed})
+	}
+	return journalOp{ID: doc["_id"], Unset: []string{ChangedKey}}
+}
+
+// changedSincePrev 最新版本ver在同一个Interval中被newDoc替换时，重新计算相对前一个版本的_changed
+func (reg *Registry) changedSincePrev(key interface{}, ver int64, newDoc map[string]interface{}, sess *mgo.Session) ([]string, error) {
+	prev, err := reg.prevVersion(key, ver, sess)
+	if err != nil {
+		return nil, err
+	}
+	return reg.versionChanged(prev, newDoc), nil
+}
+
+// prevVersion 返回实体key在版本ver之前的版本，没有时返回nil
+func (reg *Registry) prevVersion(key interface{}, ver int64, sess *mgo.Session) (map[string]interface{}, error) {
+	var prev map[string]interface{}
+	err := sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(And(
+		reg.keyQuery(key),
+		bson.M{"_ver": bson.M{"$lt": ver}},
+	)).Sort("-_ver").One(&prev)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return reg.decodeOne(prev, sess)
+}
+
+// ChurnQuery 统计的版本区间和返回的数目
+type ChurnQuery struct {
+	From   int64 // 统计 From <= _ver <= To 的版本
+	To     int64
+	Top    int   // 返回改变次数最多的Top个VerKeys和实体，<= 0 时使用DefaultChurnTop
+	Bucket int64 // 每Bucket个版本号统计一次，<= 0 时每个版本号统计一次
+}
+
+// KeyCount VerKey和它触发的新版本数目
+type KeyCount struct {
+	Key   string `json:"key" bson:"_id"`
+	Count int    `json:"count" bson:"count"`
+}
+
+// EntityCount 实体key(见EntityKey)和它的新版本数目
+type EntityCount struct {
+	Key   interface{} `json:"key"`
+	Count int         `json:"count"`
+}
+
+// BucketCount 从版本号Ver开始的一组版本号中生成的新版本数目
+type BucketCount struct {
+	Ver   int64     `json:"ver" bson:"_id"`
+	Time  time.Time `json:"time" bson:"-"`
+	Count int       `json:"count" bson:"count"`
+}
+
+// ChurnReport 一段时间内新版本的统计
+type ChurnReport struct {
+	From     int64         `json:"from"`
+	To       int64         `json:"to"`
+	Versions int           `json:"versions"` // 因为VerKeys改变生成的新版本数目
+	Keys     []KeyCount    `json:"keys"`
+	Entities []EntityCount `json:"entities"`
+	Buckets  []BucketCount `json:"buckets"`
+}
+
+/*
+Churn 统计版本号在[q.From, q.To]中因为VerKeys改变生成的新版本:
+新版本总数，每个VerKey触发的次数，新版本最多的实体，以及每一组版本号中的新版本数目
+一个新版本可能同时改变多个VerKeys，每个VerKey都计数一次
+*/
+func (reg *Registry) Churn(q ChurnQuery, sess *mgo.Session) (*ChurnReport, error) {
+	if q.From > q.To {
+		return nil, fmt.Errorf("from %d is after to %d", q.From, q.To)
+	}
+	top := q.Top
+	if top <= 0 {
+		top = DefaultChurnTop
+	}
+	bucket := q.Bucket
+	if bucket <= 0 {
+		bucket = 1
+	}
+
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	match := bson.M{"$match": bson.M{
+		"_ver":     bson.M{"$gte": q.From, "$lte": q.To},
+		ChangedKey: bson.M{"$exists": true},
+	}}
+	report := &ChurnReport{From: q.From, To: q.To}
+
+	var err error
+	if report.Versions, err = collection.Find(match["$match"]).Count(); err != nil {
+		return nil, err
+	}
+
+	report.Keys = []KeyCount{}
+	err = collection.Pipe([]bson.M{
+		match,
+		{"$unwind": "$" + ChangedKey},
+		{"$group": bson.M{"_id": "$" + ChangedKey, "count": bson.M{"$sum": 1}}},
+		{"$sort": bson.D{{Name: "count", Value: -1}, {Name: "_id", Value: 1}}},
+		{"$limit": top},
+	}).All(&report.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	// 多个标识键时按照 {k0: <值>, k1: <值>} 分组，返回时转换成列表
+	paths := reg.compareKeys()
+	group := bson.M{}
+	for i, path := range paths {
+		group[fmt.Sprintf("k%d", i)] = "$" + path
+	}
+	var entities []struct {
+		ID    bson.M `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	err = collection.Pipe([]bson.M{
+		match,
+		{"$group": bson.M{"_id": group, "count": bson.M{"$sum": 1}}},
+		{"$sort": bson.D{{Name: "count", Value: -1}, {Name: "_id", Value: 1}}},
+		{"$limit": top},
+	}).All(&entities)
+	if err != nil {
+		return nil, err
+	}
+	report.Entities = []EntityCount{}
+	for _, e := range entities {
+		key := make([]interface{}, len(paths))
+		for i := range paths {
+			key[i] = e.ID[fmt.Sprintf("k%d", i)]
+		}
+		if len(key) == 1 {
+			report.Entities = append(report.Entities, EntityCount{Key: key[0], Count: e.Count})
+		} else {
+			report.Entities = append(report.Entities, EntityCount{Key: key, Count: e.Count})
+		}
+	}
+
+	report.Buckets = []BucketCount{}
+	err = collection.Pipe([]bson.M{
+		match,
+		{"$group": bson.M{
+			"_id":   bson.M{"$subtract": []interface{}{"$_ver", bson.M{"$mod": []interface{}{"$_ver", bucket}}}},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}).All(&report.Buckets)
+	if err != nil {
+		return nil, err
+	}
+	for i := range report.Buckets {
+		report.Buckets[i].Time = reg.VerTime(report.Buckets[i].Ver)
+	}
+	return report, nil
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestChurn(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testchurn",
+		Name:           "testdb/testchurn",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}, {Path: "b"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	from := reg.GenVer()
+	docs := []map[string]interface{}{
+		{"pk": 1, "a": 1, "b": 1},
+		{"pk": 2, "a": 1, "b": 1},
+		{"pk": 1, "a": 2, "b": 1}, // a
+		{"pk": 1, "a": 3, "b": 1}, // a
+		{"pk": 2, "a": 1, "b": 2}, // b
+		{"pk": 1, "a": 4, "b": 2}, // a, b
+		{"pk": 1, "a": 4, "b": 2}, // 没有改变
+	}
+	for i, doc := range docs {
+		if _, err := reg.Versionize(doc, sess); err != nil {
+			t.Errorf("第%d条记录处理失败 %v\n", i, err)
+			return
+		}
+	}
+
+	// 新版本记录发生改变的VerKeys，第一个版本没有_changed
+	var versions []bson.M
+	collection.Find(bson.M{"pk": 1}).Sort("_ver").All(&versions)
+	var changed []interface{}
+	for _, v := range versions {
+		changed = append(changed, v[ChangedKey])
+	}
+	expected := []interface{}{nil, []interface{}{"a"}, []interface{}{"a"}, []interface{}{"a", "b"}}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("_changed错误 %v\n", changed)
+		return
+	}
+
+	report, err := reg.Churn(ChurnQuery{From: from, To: reg.GenVer()}, sess)
+	if err != nil {
+		t.Errorf("统计失败 %v\n", err)
+		return
+	}
+	if report.Versions != 4 {
+		t.Errorf("新版本数目错误 %d\n", report.Versions)
+		return
+	}
+	if keys := []KeyCount{{"a", 3}, {"b", 2}}; !reflect.DeepEqual(report.Keys, keys) {
+		t.Errorf("VerKeys统计错误 %+v\n", report.Keys)
+		return
+	}
+	if len(report.Entities) != 2 || report.Entities[0].Key != 1 || report.Entities[0].Count != 3 || report.Entities[1].Count != 1 {
+		t.Errorf("实体统计错误 %+v\n", report.Entities)
+		return
+	}
+	total := 0
+	for _, b := range report.Buckets {
+		total += b.Count
+	}
+	if total != report.Versions {
+		t.Errorf("分组统计错误 %+v\n", report.Buckets)
+		return
+	}
+
+	// top限制返回数目
+	if report, _ = reg.Churn(ChurnQuery{From: from, To: reg.GenVer(), Top: 1}, sess); len(report.Keys) != 1 || len(report.Entities) != 1 {
+		t.Errorf("top限制错误 %+v\n", report)
+		return
+	}
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Day 按自然日划分版本
+	Day = "day"
+	// Week 按ISO周(周一开始)划分版本
+	Week = "week"
+	// Month 按自然月划分版本
+	Month = "month"
+)
+
+/*
+版本时钟
+
+版本号是时间所在区间的序号:
+	* verUnit 为空时，按照固定的 verInterval 秒划分区间: unix seconds / interval，
+	  verInterval <= 0 时使用纳秒时间戳，每次提交都是一个新的区间(用于测试)
+	* verUnit 为 day, week, month 时，按照 timeZone 时区的日历划分区间，
+	  版本号分别是自1970-01-01起的天数，自1969-12-29(周一)起的周数，自1970-01起的月数
+timeZone 为空时使用UTC
+*/
+
+var (
+	locMux    sync.Mutex
+	locations = map[string]*time.Location{}
+)
+
+// loadLocation 读取时区并缓存
+func loadLocation(name string) (*time.Location, error) {
+	locMux.Lock()
+	defer locMux.Unlock()
+
+	if loc, ok := locations[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations[name] = loc
+	return loc, nil
+}
+
+// location 返回注册信息的时区，非法时区在注册时已经被拒绝，这里回退到UTC
+func (reg *Registry) location() *time.Location {
+	loc, err := loadLocation(reg.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// validateClock 检查版本时钟配置
+func (reg *Registry) validateClock() error {
+	switch reg.VerUnit {
+	case "", Day, Week, Month:
+	default:
+		return fmt.Errorf("unknown ver unit %s", reg.VerUnit)
+	}
+	if _, err := loadLocation(reg.TimeZone); err != nil {
+		return fmt.Errorf("unknown time zone %s", reg.TimeZone)
+	}
+	return nil
+}
+
+// VerAt 返回时间t对应的版本号
+func (reg *Registry) VerAt(t time.Time) int64 {
+	switch reg.VerUnit {
+	case Day:
+		return civilDays(t.In(reg.location()))
+	case Week:
+		return floorDiv(civilDays(t.In(reg.location()))+3, 7)
+	case Month:
+		y, m, _ := t.In(reg.location()).Date()
+		return int64(y-1970)*12 + int64(m) - 1
+	}
+	if reg.VerInterval <= 0 { // 用于测试时生成新版本
+		return t.UnixNano()
+	}
+	return floorDiv(t.Unix(), reg.VerInterval)
+}
+
+// VerTime 返回版本号ver的起始时间，是VerAt的逆运算
+func (reg *Registry) VerTime(ver int64) time.Time {
+	switch reg.VerUnit {
+	case Day:
+		return dayStart(ver, reg.location())
+	case Week:
+		return dayStart(7*ver-3, reg.location())
+	case Month:
+		return time.Date(1970, time.Month(ver+1), 1, 0, 0, 0, 0, reg.location())
+	}
+	if reg.VerInterval <= 0 {
+		return time.Unix(0, ver)
+	}
+	return time.Unix(ver*reg.VerInterval, 0)
+}
+
+// VerRange 返回版本号ver对应的时间区间 [start, end)
+func (reg *Registry) VerRange(ver int64) (start, end time.Time) {
+	return reg.VerTime(ver), reg.VerTime(ver + 1)
+}
+
+// civilDays 返回t所在日期自1970-01-01起的天数，不受时区偏移影响
+func civilDays(t time.Time) int64 {
+	y, m, d := t.Date()
+	return floorDiv(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix(), Daily)
+}
+
+// dayStart 返回自1970-01-01起第days天在loc时区的零点
+func dayStart(days int64, loc *time.Location) time.Time {
+	y, m, d := time.Unix(days*Daily, 0).UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// floorDiv 向下取整的除法，保证1970年之前的时间也落在正确的区间
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerClock(t *testing.T) {
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+
+	cases := []struct {
+		reg        *Registry
+		t          time.Time
+		start, end time.Time
+	}{
+		// 上海时间零点切换版本，而不是UTC零点
+		{
+			&Registry{VerUnit: Day, TimeZone: "Asia/Shanghai"},
+			time.Date(2016, 3, 1, 23, 59, 59, 0, shanghai),
+			time.Date(2016, 3, 1, 0, 0, 0, 0, shanghai),
+			time.Date(2016, 3, 2, 0, 0, 0, 0, shanghai),
+		},
+		{
+			&Registry{VerUnit: Day, TimeZone: "Asia/Shanghai"},
+			time.Date(2016, 3, 1, 16, 30, 0, 0, time.UTC),
+			time.Date(2016, 3, 2, 0, 0, 0, 0, shanghai),
+			time.Date(2016, 3, 3, 0, 0, 0, 0, shanghai),
+		},
+		// ISO周从周一开始
+		{
+			&Registry{VerUnit: Week},
+			time.Date(2016, 3, 6, 12, 0, 0, 0, time.UTC),
+			time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC),
+			time.Date(2016, 3, 7, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			&Registry{VerUnit: Week},
+			time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC),
+			time.Date(1969, 12, 29, 0, 0, 0, 0, time.UTC),
+			time.Date(1970, 1, 5, 0, 0, 0, 0, time.UTC),
+		},
+		// 自然月
+		{
+			&Registry{VerUnit: Month, TimeZone: "Asia/Shanghai"},
+			time.Date(2016, 2, 29, 23, 0, 0, 0, shanghai),
+			time.Date(2016, 2, 1, 0, 0, 0, 0, shanghai),
+			time.Date(2016, 3, 1, 0, 0, 0, 0, shanghai),
+		},
+		// 固定间隔
+		{
+			&Registry{VerInterval: Hourly},
+			time.Date(2016, 3, 1, 10, 30, 0, 0, time.UTC),
+			time.Date(2016, 3, 1, 10, 0, 0, 0, time.UTC),
+			time.Date(2016, 3, 1, 11, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, cs := range cases {
+		ver := cs.reg.VerAt(cs.t)
+		start, end := cs.reg.VerRange(ver)
+		if !start.Equal(cs.start) || !end.Equal(cs.end) {
+			t.Errorf("%+v %v 版本区间错误 %v %v\n", cs.reg, cs.t, start, end)
+			return
+		}
+		if cs.reg.VerAt(start) != ver || cs.reg.VerAt(end.Add(-time.Nanosecond)) != ver || cs.reg.VerAt(end) != ver+1 {
+			t.Errorf("%+v %v 版本边界错误\n", cs.reg, cs.t)
+			return
+		}
+	}
+
+	// 连续的日期对应连续的版本号
+	reg := &Registry{VerUnit: Day, TimeZone: "Asia/Shanghai"}
+	day := time.Date(2016, 1, 1, 12, 0, 0, 0, shanghai)
+	for i := 0; i < 400; i++ {
+		if reg.VerAt(day.AddDate(0, 0, i)) != reg.VerAt(day)+int64(i) {
+			t.Errorf("版本号不连续 %v\n", day.AddDate(0, 0, i))
+			return
+		}
+	}
+
+	for _, reg := range []*Registry{{VerUnit: "year"}, {VerUnit: Day, TimeZone: "Mars/Olympus"}} {
+		if reg.validateClock() == nil {
+			t.Errorf("%+v 非法时钟配置未报错\n", reg)
+			return
+		}
+	}
+	// verInterval <= 0 是测试时钟，每次提交都是新的版本
+	for _, reg := range []*Registry{{}, {VerInterval: -1}, {VerInterval: Hourly}} {
+		if err := reg.validateClock(); err != nil {
+			t.Errorf("%+v 合法时钟配置报错 %v\n", reg, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+实体标识
+
+compareKey 是单个键，compareKeys 是共同标识实体的一组键，两者只能设置一个，
+键可以是点分隔的嵌套路径，例如:
+
+	"compareKeys": ["vendor", "serialNumber"]
+	"compareKey": "meta.hostId"
+
+单个键时实体的key是该键的值，多个键时key是按compareKeys顺序排列的值列表，
+例如 ["dell", "S1"]，url中的key使用json列表的格式
+*/
+
+// compareKeys 返回标识实体的键
+func (reg *Registry) compareKeys() []string {
+	if len(reg.CompareKeys) > 0 {
+		return reg.CompareKeys
+	}
+	return []string{reg.CompareKey}
+}
+
+// validateCompareKeys 检查实体标识的配置
+func (reg *Registry) validateCompareKeys() error {
+	if reg.CompareKey != "" && len(reg.CompareKeys) > 0 {
+		return fmt.Errorf("compare_key and compare_keys cant be both set")
+	}
+	seen := map[string]bool{}
+	for _, path := range reg.compareKeys() {
+		if path == "" {
+			return fmt.Errorf("compare_key cant be empty")
+		}
+		if seen[path] {
+			return fmt.Errorf("duplicate compare key %s", path)
+		}
+		seen[path] = true
+	}
+	return nil
+}
+
+// EntityKey 返回记录的实体key，缺少任何一个标识键时返回错误
+func (reg *Registry) EntityKey(doc map[string]interface{}) (interface{}, error) {
+	paths := reg.compareKeys()
+	vals := make([]interface{}, len(paths))
+	for i, path := range paths {
+		v, ok := lookup(doc, path)
+		if !ok {
+			return nil, fmt.Errorf("missing compare key %s", path)
+		}
+		vals[i] = v
+	}
+	if len(vals) == 1 {
+		return vals[0], nil
+	}
+	return vals, nil
+}
+
+// keyQuery 返回实体key的查询条件
+func (reg *Registry) keyQuery(key interface{}) bson.M {
+	paths := reg.compareKeys()
+	if len(paths) == 1 {
+		return bson.M{paths[0]: key}
+	}
+	// key的格式不对时查询条件不会匹配任何记录
+	vals, _ := key.([]interface{})
+	q := bson.M{}
+	for i, path := range paths {
+		if i < len(vals) {
+			q[path] = vals[i]
+		} else {
+			q[path] = nil
+		}
+	}
+	return q
+}
+
+// keyIn 返回实体keys的查询条件，多个标识键时每个标识键分别使用$in，可能匹配keys之外的实体
+func (reg *Registry) keyIn(keys []interface{}) bson.M {
+	paths := reg.compareKeys()
+	q := bson.M{}
+	for i, path := range paths {
+		var vals []interface{}
+		seen := map[string]bool{}
+		for _, key := range keys {
+			v := key
+			if len(paths) > 1 {
+				v = nil
+				if kv, _ := key.([]interface{}); i < len(kv) {
+					v = kv[i]
+				}
+			}
+			if c := canonical(v); !seen[c] {
+				seen[c] = true
+				vals = append(vals, v)
+			}
+		}
+		q[path] = bson.M{"$in": vals}
+	}
+	return q
+}
+
+// keyDoc 返回只包含实体标识的记录
+func (reg *Registry) keyDoc(key interface{}) map[string]interface{} {
+	doc := map[string]interface{}{}
+	for path, v := range reg.keyQuery(key) {
+		setPath(doc, path, v)
+	}
+	return doc
+}
+
+// keyFields 只选择实体标识
+func (reg *Registry) keyFields() bson.M {
+	fields := bson.M{}
+	for _, path := range reg.compareKeys() {
+		fields[path] = 1
+	}
+	return fields
+}
+
+// ensureIndexes 为注册的表添加index，标识键使用复合index，IndexKeys中的模式见indexKey
+func (reg *Registry) ensureIndexes(sess *mgo.Session) error {
+	regRepo := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	if err := regRepo.EnsureIndexKey(reg.compareKeys()...); err != nil {
+		return err
+	}
+	for _, index := range append(reg.IndexKeys,
+		"_ver",
+		"_next",
+		"_is_latest",
+	) {
+		if err := ensureIndex(regRepo, indexKey(index)); err != nil {
+			return err
+		}
+	}
+	if reg.Delta != nil {
+		return regRepo.EnsureIndex(mgo.Index{Key: []string{"_base"}, Sparse: true})
+	}
+	return nil
+}
+
+// lookup 读取点分隔路径对应的值，路径上不能有列表
+func lookup(doc map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, k := range strings.Split(path, ".") {
+		m, ok := asMap(cur)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[k]; !ok || cur == nil {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// setPath 设置点分隔路径对应的值，中间的文档不存在时创建
+func setPath(doc map[string]interface{}, path string, v interface{}) {
+	parts := strings.Split(path, ".")
+	for _, k := range parts[:len(parts)-1] {
+		next, ok := asMap(doc[k])
+		if !ok {
+			next = map[string]interface{}{}
+			doc[k] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = v
+}
+
+// unsetPath 删除点分隔路径对应的值
+func unsetPath(doc map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	for _, k := range parts[:len(parts)-1] {
+		next, ok := asMap(doc[k])
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, parts[len(parts)-1])
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEntityKey(t *testing.T) {
+	nested := &Registry{CompareKey: "meta.hostId"}
+	key, err := nested.EntityKey(map[string]interface{}{"meta": bson.M{"hostId": "h1"}})
+	if err != nil || key != "h1" {
+		t.Errorf("嵌套标识键读取错误 %v %v\n", key, err)
+		return
+	}
+	if _, err = nested.EntityKey(map[string]interface{}{"meta": "h1"}); err == nil {
+		t.Errorf("缺少嵌套标识键未报错\n")
+		return
+	}
+
+	composite := &Registry{CompareKeys: []string{"vendor", "serialNumber"}}
+	key, err = composite.EntityKey(map[string]interface{}{"vendor": "dell", "serialNumber": "S1"})
+	if err != nil || !reflect.DeepEqual(key, []interface{}{"dell", "S1"}) {
+		t.Errorf("复合标识键读取错误 %v %v\n", key, err)
+		return
+	}
+	if _, err = composite.EntityKey(map[string]interface{}{"vendor": "dell"}); err == nil {
+		t.Errorf("缺少部分标识键未报错\n")
+		return
+	}
+
+	if q := composite.keyQuery(key); !reflect.DeepEqual(q, bson.M{"vendor": "dell", "serialNumber": "S1"}) {
+		t.Errorf("复合标识键查询条件错误 %v\n", q)
+		return
+	}
+	if key = composite.ParseKey(`["dell","S1"]`); !reflect.DeepEqual(key, []interface{}{"dell", "S1"}) {
+		t.Errorf("url中的复合标识键解析错误 %v\n", key)
+		return
+	}
+	doc := nested.keyDoc("h1")
+	if v, ok := lookup(doc, "meta.hostId"); !ok || v != "h1" {
+		t.Errorf("嵌套标识键记录错误 %v\n", doc)
+		return
+	}
+
+	invalid := []*Registry{
+		{CompareKey: "pk", CompareKeys: []string{"a"}},
+		{CompareKeys: []string{"a", ""}},
+		{CompareKeys: []string{"a", "a"}},
+	}
+	for _, reg := range invalid {
+		if err = reg.validateCompareKeys(); err == nil {
+			t.Errorf("非法标识键未报错 %v %v\n", reg.CompareKey, reg.CompareKeys)
+			return
+		}
+	}
+}
+
+func TestCompositeVersionize(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testcomposite",
+		Name:           "testdb/testcomposite",
+		CompareKeys:    []string{"vendor", "meta.serialNumber"},
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+	if err = reg.ensureIndexes(sess); err != nil {
+		t.Errorf("添加index失败 %v\n", err)
+		return
+	}
+
+	part := func(vendor, serial string, a int) map[string]interface{} {
+		return map[string]interface{}{"vendor": vendor, "meta": map[string]interface{}{"serialNumber": serial}, "a": a}
+	}
+	steps := []struct {
+		doc    map[string]interface{}
+		action string
+	}{
+		{part("dell", "S1", 1), ActionInsert},
+		{part("hp", "S1", 1), ActionInsert}, // 序列号相同，厂商不同
+		{part("dell", "S1", 1), ActionExtend},
+		{part("dell", "S1", 2), ActionVersion},
+	}
+	for i, step := range steps {
+		outcome, err := reg.Versionize(step.doc, sess)
+		if err != nil || outcome.Action != step.action {
+			t.Errorf("第%d条记录处理结果错误 %+v %v\n", i, outcome, err)
+			return
+		}
+	}
+	if _, err = reg.Versionize(map[string]interface{}{"vendor": "dell", "a": 1}, sess); err == nil {
+		t.Errorf("缺少部分标识键的记录未报错\n")
+		return
+	}
+
+	versions, total, err := reg.History([]interface{}{"dell", "S1"}, HistoryQuery{}, sess)
+	if err != nil || total != 2 || versions[1].Doc["a"] != 2 {
+		t.Errorf("复合标识键历史版本错误 %d %v %v\n", total, versions, err)
+		return
+	}
+
+	// 类型混合的复合标识键: 厂商编号是数字，序列号是全部是数字的字符串
+	if _, err = reg.Versionize(map[string]interface{}{"vendor": 7, "meta": map[string]interface{}{"serialNumber": "12345"}, "a": 1}, sess); err != nil {
+		t.Errorf("写入类型混合的复合标识键失败 %v\n", err)
+		return
+	}
+	key, err := reg.ResolveKey(`[7,12345]`, sess)
+	if err != nil || canonical(key) != `[7,"12345"]` {
+		t.Errorf("解析类型混合的复合标识键错误 %#v %v\n", key, err)
+		return
+	}
+	if _, total, err = reg.History(key, HistoryQuery{}, sess); err != nil || total != 1 {
+		t.Errorf("类型混合的复合标识键历史版本错误 %d %v\n", total, err)
+		return
+	}
+	if key, err = reg.ResolveKey(`[8,12345]`, sess); err != nil || !reflect.DeepEqual(key, []interface{}{float64(8), float64(12345)}) {
+		t.Errorf("不存在的实体返回的key错误 %#v %v\n", key, err)
+		return
+	}
+
+	indexes, _ := collection.Indexes()
+	var found bool
+	for _, index := range indexes {
+		if reflect.DeepEqual(index.Key, reg.CompareKeys) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("没有添加复合index %v\n", indexes)
+		return
+	}
+}
@@ -0,0 +1,375 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+Delta 增量存储
+
+	"delta": {"snapshotEvery": 10}
+
+设置后较早的历史版本只保存相对后一个版本的反向增量:
+
+	{serverId: 1, _ver: 3, _next: 5, _is_latest: false, _hash: ...,
+	 _base: <后一个版本的_id>, _delta: [{p: "osInfo.kernelRelease", v: "4.4.0"}, {p: "extra", u: true}]}
+
+	* _base 对应的版本的内容，依次写入 _delta 中的值(v)或者删除路径(u)，得到该版本的内容
+	* 增量文档只保留版本信息(以"_"开头的键)和标识键
+	* 最新版本和最近关闭的版本保存完整内容，最新版本在同一个版本中会被更新，不能作为增量的基准
+	* 每连续 snapshotEvery-1 个增量版本之后保留一个完整版本，重建一个版本最多读取 snapshotEvery 条记录
+	* 被作为基准的版本被删除或者替换之前，依赖它的增量版本会先恢复成完整记录
+	* 回填写入完整记录，不会被重新编码；迁移重写历史之后按照同样的规则重新编码(encodeHistory)
+
+读取历史版本(History, Diff, Search, Restore等)时透明的重建完整记录，
+scope为all的更新键总是使用完整版本中的值。
+按内容查询(Search)时先按照标识键和保留键选出增量记录，重建之后再按照完整的条件过滤，见match.go
+取消增量存储会触发迁移，迁移时实体的所有版本被重写成完整记录，见migration.go
+*/
+type Delta struct {
+	SnapshotEvery int `json:"snapshotEvery" bson:"snapshotEvery"`
+}
+
+// DefaultSnapshotEvery 默认每10个版本保留一个完整版本
+const DefaultSnapshotEvery = 10
+
+// maxDeltaChain 重建时最多读取的增量记录数，防止数据损坏时死循环
+const maxDeltaChain = 10000
+
+func (d *Delta) validate() error {
+	if d.SnapshotEvery < 0 {
+		return errors.New("delta snapshotEvery cant be negative")
+	}
+	return nil
+}
+
+func (d *Delta) snapshotEvery() int {
+	if d.SnapshotEvery == 0 {
+		return DefaultSnapshotEvery
+	}
+	return d.SnapshotEvery
+}
+
+// isDelta 记录是否是增量记录
+func isDelta(doc map[string]interface{}) bool {
+	return doc["_base"] != nil
+}
+
+// deltaEntry 增量中的一项，Unset为true时删除路径
+type deltaEntry struct {
+	Path  string      `bson:"p"`
+	Val   interface{} `bson:"v"`
+	Unset bool        `bson:"u,omitempty"`
+}
+
+// reverseDelta 计算从内容base得到内容doc的增量，文档递归比对，列表和其他值整体比对
+func reverseDelta(doc, base map[string]interface{}, prefix string, entries []deltaEntry) []deltaEntry {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		path := join(prefix, k)
+		bv, ok := base[k]
+		if !ok {
+			entries = append(entries, deltaEntry{Path: path, Val: doc[k]})
+			continue
+		}
+		dm, dok := asMap(doc[k])
+		bm, bok := asMap(bv)
+		if dok && bok {
+			entries = reverseDelta(dm, bm, path, entries)
+		} else if !reflect.DeepEqual(doc[k], bv) {
+			entries = append(entries, deltaEntry{Path: path, Val: doc[k]})
+		}
+	}
+
+	keys = keys[:0]
+	for k := range base {
+		if _, ok := doc[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entries = append(entries, deltaEntry{Path: join(prefix, k), Unset: true})
+	}
+	return entries
+}
+
+// applyDelta 把记录中保存的增量写入内容content
+func applyDelta(content map[string]interface{}, delta interface{}) error {
+	entries, ok := delta.([]interface{})
+	if !ok && delta != nil {
+		return fmt.Errorf("invalid delta %v", delta)
+	}
+	for _, e := range entries {
+		m, ok := asMap(e)
+		if !ok {
+			return fmt.Errorf("invalid delta entry %v", e)
+		}
+		path, _ := m["p"].(string)
+		if path == "" {
+			return fmt.Errorf("invalid delta entry %v", e)
+		}
+		if m["u"] == true {
+			unsetPath(content, path)
+		} else {
+			setPath(content, path, m["v"])
+		}
+	}
+	return nil
+}
+
+// deepCopy 复制文档和列表，避免修改缓存中的记录
+func deepCopy(v interface{}) interface{} {
+	if l, ok := v.([]interface{}); ok {
+		nl := make([]interface{}, len(l))
+		for i, elem := range l {
+			nl[i] = deepCopy(elem)
+		}
+		return nl
+	}
+	if m, ok := asMap(v); ok {
+		nm := make(map[string]interface{}, len(m))
+		for k, elem := range m {
+			nm[k] = deepCopy(elem)
+		}
+		return nm
+	}
+	return v
+}
+
+/*
+decode 把docs中的增量记录就地替换成完整记录，去掉 _base, _delta
+按照_ver从新到旧重建，重建过的记录被缓存，同一实体的多个版本只读取一次基准记录
+*/
+func (reg *Registry) decode(docs []map[string]interface{}, sess *mgo.Session) error {
+	order := make([]int, 0, len(docs))
+	for i, doc := range docs {
+		if isDelta(doc) {
+			order = append(order, i)
+		}
+	}
+	if len(order) == 0 {
+		return nil
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return asInt64(docs[order[i]]["_ver"]) > asInt64(docs[order[j]]["_ver"])
+	})
+
+	cache := map[interface{}]map[string]interface{}{}
+	for _, doc := range docs {
+		if !isDelta(doc) {
+			cache[doc["_id"]] = doc
+		}
+	}
+	for _, i := range order {
+		full, err := reg.rebuild(docs[i], cache, sess)
+		if err != nil {
+			return err
+		}
+		docs[i] = full
+	}
+	return nil
+}
+
+// decodeOne 重建单条记录，doc为nil时返回nil
+func (reg *Registry) decodeOne(doc map[string]interface{}, sess *mgo.Session) (map[string]interface{}, error) {
+	if doc == nil || !isDelta(doc) {
+		return doc, nil
+	}
+	docs := []map[string]interface{}{doc}
+	err := reg.decode(docs, sess)
+	return docs[0], err
+}
+
+// rebuild 沿着_base找到完整记录，依次写入增量得到doc的完整记录
+func (reg *Registry) rebuild(doc map[string]interface{}, cache map[interface{}]map[string]interface{}, sess *mgo.Session) (map[string]interface{}, error) {
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+
+	chain := []map[string]interface{}{doc}
+	var top map[string]interface{}
+	for top == nil {
+		if len(chain) > maxDeltaChain {
+			return nil, fmt.Errorf("delta chain of %v is too long", doc["_id"])
+		}
+		baseID := chain[len(chain)-1]["_base"]
+		if cached, ok := cache[baseID]; ok {
+			top = cached
+			break
+		}
+		var base map[string]interface{}
+		if err := collection.FindId(baseID).One(&base); err != nil {
+			return nil, fmt.Errorf("delta base %v of %v: %v", baseID, doc["_id"], err)
+		}
+		if isDelta(base) {
+			chain = append(chain, base)
+		} else {
+			cache[baseID] = base
+			top = base
+		}
+	}
+
+	// 从最接近完整记录的增量开始写入，中间版本也放入缓存
+	content := deepCopy(strip(top)).(map[string]interface{})
+	var full map[string]interface{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if err := applyDelta(content, chain[i]["_delta"]); err != nil {
+			return nil, err
+		}
+		for _, uk := range reg.UpdateKeys {
+			if uk.Scope != ScopeAll {
+				continue
+			}
+			if v, ok := lookup(top, uk.Path); ok {
+				setPath(content, uk.Path, v)
+			}
+		}
+		full = deepCopy(content).(map[string]interface{})
+		for k, v := range chain[i] {
+			if len(k) > 0 && k[0] == '_' && k != "_base" && k != "_delta" {
+				full[k] = v
+			}
+		}
+		cache[chain[i]["_id"]] = full
+	}
+	return full, nil
+}
+
+/*
+encodeBefore 最新版本base被关闭之后，把它之前的版本编码成相对base的增量
+base需要是完整记录，之前的版本已经是增量、删除标记，或者需要保留为完整版本时不编码
+实体的租约续约失败时不编码，返回ErrLeaseLost
+*/
+func (reg *Registry) encodeBefore(key interface{}, base map[string]interface{}, sess *mgo.Session) error {
+	if reg.Delta == nil || isDeleted(base) || isDelta(base) {
+		return nil
+	}
+	if err := reg.checkLease(key); err != nil {
+		return err
+	}
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	var prev map[string]interface{}
+	err := collection.Find(And(reg.keyQuery(key), bson.M{"_ver": bson.M{"$lt": base["_ver"]}})).Sort("-_ver").One(&prev)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if isDelta(prev) || isDeleted(prev) {
+		return nil
+	}
+
+	// 之前已经有连续 snapshotEvery-1 个增量版本时，prev保留为完整版本
+	n := reg.Delta.snapshotEvery() - 1
+	if n <= 0 {
+		return nil
+	}
+	var older []map[string]interface{}
+	err = collection.Find(And(reg.keyQuery(key), bson.M{"_ver": bson.M{"$lt": prev["_ver"]}})).
+		Sort("-_ver").Limit(n).Select(bson.M{"_base": 1}).All(&older)
+	if err != nil {
+		return err
+	}
+	run := 0
+	for _, doc := range older {
+		if !isDelta(doc) {
+			break
+		}
+		run++
+	}
+	if run >= n {
+		return nil
+	}
+	return collection.UpdateId(prev["_id"], reg.deltaDoc(key, prev, base))
+}
+
+// deltaDoc 返回完整版本prev相对后一个完整版本base的增量记录
+func (reg *Registry) deltaDoc(key interface{}, prev, base map[string]interface{}) map[string]interface{} {
+	doc := reg.keyDoc(key)
+	for k, v := range prev {
+		if len(k) > 0 && k[0] == '_' {
+			doc[k] = v
+		}
+	}
+	doc["_base"] = base["_id"]
+	doc["_delta"] = reverseDelta(strip(prev), strip(base), "", []deltaEntry{})
+	return doc
+}
+
+/*
+encodeHistory 把实体key按_ver排序的完整版本docs就地编码成增量存储的格式，结果和依次写入时相同:
+最后两个版本保留完整内容，删除标记和它之前的版本保留完整内容，
+其余版本从旧到新每连续 snapshotEvery-1 个增量版本之后保留一个完整版本
+*/
+func (reg *Registry) encodeHistory(key interface{}, docs []map[string]interface{}) {
+	if reg.Delta == nil {
+		return
+	}
+	n := reg.Delta.snapshotEvery() - 1
+	if n <= 0 {
+		return
+	}
+	run := 0
+	for i := 0; i < len(docs)-2; i++ {
+		prev, base := docs[i], docs[i+1]
+		if isDeleted(prev) || isDeleted(base) || run >= n {
+			run = 0
+			continue
+		}
+		docs[i] = reg.deltaDoc(key, prev, base)
+		run++
+	}
+}
+
+// materialize 把实体key以id为基准的增量记录恢复成完整记录，需要在锁定实体时调用，租约续约失败时返回ErrLeaseLost
+func (reg *Registry) materialize(key, id interface{}, sess *mgo.Session) error {
+	if err := reg.checkLease(key); err != nil {
+		return err
+	}
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	var deps []map[string]interface{}
+	if err := collection.Find(bson.M{"_base": id}).All(&deps); err != nil {
+		return err
+	}
+	if err := reg.decode(deps, sess); err != nil {
+		return err
+	}
+	for _, doc := range deps {
+		if err := collection.UpdateId(doc["_id"], doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// materializeOps 执行实体key的ops之前，恢复以被删除或者替换的记录为基准的增量记录
+func (reg *Registry) materializeOps(key interface{}, ops []journalOp, sess *mgo.Session) error {
+	if reg.Delta == nil {
+		return nil
+	}
+	for _, op := range ops {
+		if op.Coll == "" && (op.Remove || op.Insert != nil) {
+			if err := reg.materialize(key, op.ID, sess); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logEncode 编码失败时旧版本仍然是完整记录，只记录日志
+func (reg *Registry) logEncode(key interface{}, base map[string]interface{}, sess *mgo.Session) {
+	if err := reg.encodeBefore(key, base, sess); err != nil {
+		log.Println("Delta", reg.Name, key, err)
+	}
+}
@@ -0,0 +1,267 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReverseDelta(t *testing.T) {
+	docJSON := `{"a": 1, "os": {"kernel": "4.4", "name": "ubuntu"}, "tags": ["x"], "old": true}`
+	baseJSON := `{"a": 1, "os": {"kernel": "4.8", "name": "ubuntu", "arch": "x64"}, "tags": ["x", "y"], "new": 0}`
+	var doc, base map[string]interface{}
+	json.Unmarshal([]byte(docJSON), &doc)
+	json.Unmarshal([]byte(baseJSON), &base)
+
+	entries := reverseDelta(doc, base, "", []deltaEntry{})
+	expected := []deltaEntry{
+		{Path: "old", Val: true},
+		{Path: "os.kernel", Val: "4.4"},
+		{Path: "os.arch", Unset: true},
+		{Path: "tags", Val: []interface{}{"x"}},
+		{Path: "new", Unset: true},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("增量错误 %+v\n", entries)
+		return
+	}
+
+	// 增量和数据库中读出的格式一致
+	raw, _ := bson.Marshal(bson.M{"_delta": entries})
+	var stored map[string]interface{}
+	bson.Unmarshal(raw, &stored)
+	content := deepCopy(base).(map[string]interface{})
+	if err := applyDelta(content, stored["_delta"]); err != nil || canonical(content) != canonical(doc) {
+		t.Errorf("重建错误 %v %v\n", content, err)
+		return
+	}
+}
+
+func TestEncodeHistory(t *testing.T) {
+	reg := &Registry{CompareKey: "pk", Delta: &Delta{SnapshotEvery: 3}}
+	var docs []map[string]interface{}
+	for i := 0; i < 9; i++ {
+		doc := map[string]interface{}{"_id": i, "pk": 1, "a": i, "_ver": int64(i), "_next": int64(i)}
+		if i == 5 {
+			doc = map[string]interface{}{"_id": i, "pk": 1, Deleted: true, "_ver": int64(i), "_next": int64(i)}
+		}
+		docs = append(docs, doc)
+	}
+	full := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		full[i] = deepCopy(doc).(map[string]interface{})
+	}
+
+	// 每2个增量之后一个完整版本，删除标记和它之前的版本、最后两个版本保留完整内容
+	reg.encodeHistory(1, docs)
+	var deltas []int
+	for i, doc := range docs {
+		if isDelta(doc) {
+			deltas = append(deltas, i)
+		}
+	}
+	if !reflect.DeepEqual(deltas, []int{0, 1, 3, 6}) {
+		t.Errorf("增量版本错误 %v\n", deltas)
+		return
+	}
+
+	// 沿着_base能重建出原来的内容
+	for _, i := range deltas {
+		raw, _ := bson.Marshal(bson.M{"_delta": docs[i]["_delta"]})
+		var stored map[string]interface{}
+		bson.Unmarshal(raw, &stored)
+		content := deepCopy(strip(full[i+1])).(map[string]interface{})
+		if err := applyDelta(content, stored["_delta"]); err != nil || canonical(content) != canonical(strip(full[i])) {
+			t.Errorf("第%d个版本重建错误 %v %v\n", i, content, err)
+			return
+		}
+		if docs[i]["_base"] != i+1 || docs[i]["_ver"] != int64(i) {
+			t.Errorf("第%d个版本的版本信息错误 %v\n", i, docs[i])
+			return
+		}
+	}
+}
+
+func TestDeltaQuery(t *testing.T) {
+	reg := &Registry{CompareKeys: []string{"pk", "site.id"}}
+	cases := []struct {
+		query, part string
+	}{
+		{`{}`, `{}`},
+		{`{"pk": 1, "site.id": {"$in": [1, 2]}}`, `{"pk": 1, "site.id": {"$in": [1, 2]}}`},
+		{`{"_meta.source": "collector", "os.kernel": "4.8"}`, `{"_meta.source": "collector"}`},
+		{`{"$or": [{"pk": 2}, {"_is_latest": true}]}`, `{"$or": [{"pk": 2}, {"_is_latest": true}]}`},
+		{`{"$or": [{"pk": 2}, {"tags": "c"}]}`, `{}`},
+		{`{"site": {"id": 1}}`, `{}`},
+		{`{"$and": [{"pk": 1, "tags": "c"}, {"tags": "d"}]}`, `{"$and": [{"pk": 1}]}`},
+		{`{"$where": "this.pk == 1"}`, `{}`},
+	}
+	for _, cs := range cases {
+		var query, part map[string]interface{}
+		json.Unmarshal([]byte(cs.query), &query)
+		json.Unmarshal([]byte(cs.part), &part)
+		if got := reg.deltaQuery(query); canonical(got) != canonical(part) {
+			t.Errorf("查询 %s 在增量记录上的部分错误 %v\n", cs.query, got)
+		}
+	}
+	if !reg.storedOnDelta(bson.M{"$or": []bson.M{{"pk": 1}, {"site.id": 2}}}) {
+		t.Errorf("bson.M列表判断错误\n")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	docJSON := `{"pk": 1, "os": {"kernel": "4.4"}, "disks": [{"serial": "S1", "size": 10}, {"serial": "S2", "size": 20}], "tags": ["a", "b"]}`
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(docJSON), &doc)
+
+	cases := []struct {
+		query string
+		match bool
+	}{
+		{`{}`, true},
+		{`{"pk": 1}`, true},
+		{`{"os.kernel": "4.8"}`, false},
+		{`{"disks.serial": "S2"}`, true},
+		{`{"tags": "b"}`, true},
+		{`{"tags": ["a", "b"]}`, true},
+		{`{"disks.size": {"$gt": 15, "$lt": 30}}`, true},
+		{`{"disks.size": {"$gt": 20}}`, false},
+		{`{"os.kernel": {"$in": ["4.4", "4.8"]}}`, true},
+		{`{"os.kernel": {"$nin": ["4.4"]}}`, false},
+		{`{"owner": {"$exists": false}}`, true},
+		{`{"owner": null}`, true},
+		{`{"owner": {"$ne": "bob"}}`, true},
+		{`{"os.kernel": {"$regex": "^4\\."}}`, true},
+		{`{"os.kernel": {"$not": {"$regex": "^4\\."}}}`, false},
+		{`{"os.kernel": {"$regex": "^K", "$options": "i"}}`, false},
+		{`{"tags": {"$size": 2, "$all": ["b", "a"]}}`, true},
+		{`{"disks": {"$elemMatch": {"serial": "S1", "size": {"$gt": 15}}}}`, false},
+		{`{"disks": {"$elemMatch": {"serial": "S2", "size": {"$gt": 15}}}}`, true},
+		{`{"$or": [{"pk": 2}, {"tags": "a"}]}`, true},
+		{`{"$and": [{"pk": 1}, {"tags": "c"}]}`, false},
+		{`{"$nor": [{"pk": 2}]}`, true},
+	}
+	for _, cs := range cases {
+		var query map[string]interface{}
+		if err := json.Unmarshal([]byte(cs.query), &query); err != nil {
+			t.Errorf("查询 %s 格式错误 %v\n", cs.query, err)
+			continue
+		}
+		if ok, err := Match(doc, query); err != nil || ok != cs.match {
+			t.Errorf("查询 %s 结果错误 %v %v\n", cs.query, ok, err)
+		}
+	}
+	for _, query := range []string{`{"$where": "this.pk == 1"}`, `{"os.kernel": {"$type": "string"}}`, `{"os.kernel": {"$regex": "4", "$options": "x"}}`} {
+		var q map[string]interface{}
+		json.Unmarshal([]byte(query), &q)
+		if _, err := Match(doc, q); err == nil {
+			t.Errorf("不支持的查询 %s 没有报错\n", query)
+		}
+	}
+}
+
+func TestDeltaStorage(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testdelta",
+		Name:           "testdb/testdelta",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "os.kernel"}},
+		Delta:          &Delta{SnapshotEvery: 3},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+	reg.changes(sess).DropCollection()
+
+	kernels := []string{"k0", "k1", "k2", "k3", "k4", "k5", "k6"}
+	var vers []int64
+	for i, kernel := range kernels {
+		doc := map[string]interface{}{"pk": 1, "os": map[string]interface{}{"kernel": kernel, "name": "ubuntu"}, "step": i}
+		outcome, err := reg.Versionize(doc, sess)
+		if err != nil || outcome.Action == ActionExtend {
+			t.Errorf("第%d条记录处理结果错误 %+v %v\n", i, outcome, err)
+			return
+		}
+		vers = append(vers, outcome.Ver)
+	}
+
+	// 最新版本和最近关闭的版本是完整记录，每连续两个增量版本之后有一个完整版本
+	var stored []map[string]interface{}
+	collection.Find(bson.M{"pk": 1}).Sort("-_ver").All(&stored)
+	var layout []bool
+	for _, doc := range stored {
+		layout = append(layout, isDelta(doc))
+	}
+	if expected := []bool{false, false, true, true, false, true, true}; !reflect.DeepEqual(layout, expected) {
+		t.Errorf("增量存储布局错误 %v\n", layout)
+		return
+	}
+
+	// 历史版本被透明的重建
+	versions, _, err := reg.History(1, HistoryQuery{}, sess)
+	if err != nil || len(versions) != len(kernels) {
+		t.Errorf("历史版本错误 %v %v\n", versions, err)
+		return
+	}
+	for i, v := range versions {
+		if k, _ := lookup(v.Doc, "os.kernel"); k != kernels[i] || v.Doc["step"] != i || v.Doc["_base"] != nil {
+			t.Errorf("第%d个版本重建错误 %v\n", i, v.Doc)
+			return
+		}
+	}
+
+	// 按照标识键查询历史版本，增量版本被重建
+	result, err := reg.Search(bson.M{"pk": 1}, AsOf(vers[1]), sess)
+	if err != nil || len(result) != 1 || result[0]["step"] != 1 {
+		t.Errorf("查询增量版本错误 %v %v\n", result, err)
+		return
+	}
+	// 按内容查询时，增量版本重建之后按照完整的条件过滤
+	if result, err = reg.Search(bson.M{"os.kernel": "k1"}, AsOf(vers[1]), sess); err != nil || len(result) != 1 || result[0]["step"] != 1 {
+		t.Errorf("按内容查询增量版本错误 %v %v\n", result, err)
+		return
+	}
+	if result, err = reg.Search(bson.M{"pk": 1, "os.kernel": "k2"}, AsOf(vers[1]), sess); err != nil || len(result) != 0 {
+		t.Errorf("增量版本没有按照内容过滤 %v %v\n", result, err)
+		return
+	}
+	if result, err = reg.Search(bson.M{"os.kernel": "k6"}, Latest(), sess); err != nil || len(result) != 1 {
+		t.Errorf("按内容查询最新版本错误 %v %v\n", result, err)
+		return
+	}
+
+	// 撤销之后最近关闭的版本成为最新版本，依赖它的增量版本恢复成完整记录
+	if _, err = reg.Undo(1, vers[6], sess); err != nil {
+		t.Errorf("撤销错误 %v\n", err)
+		return
+	}
+	if n, _ := collection.Find(bson.M{"pk": 1, "_base": bson.M{"$exists": true}}).Count(); n != 3 {
+		t.Errorf("撤销之后增量版本数目错误 %d\n", n)
+		return
+	}
+	versions, _, err = reg.History(1, HistoryQuery{}, sess)
+	if err != nil || len(versions) != len(kernels)-1 {
+		t.Errorf("撤销之后历史版本错误 %v %v\n", versions, err)
+		return
+	}
+	for i, v := range versions {
+		if k, _ := lookup(v.Doc, "os.kernel"); k != kernels[i] {
+			t.Errorf("撤销之后第%d个版本重建错误 %v\n", i, v.Doc)
+			return
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Added 新增的键
+	Added = "added"
+	// Removed 删除的键
+	Removed = "removed"
+	// Changed 值发生改变的键
+	Changed = "changed"
+)
+
+// Change 两个版本之间一个键的变化
+type Change struct {
+	Key  string      `json:"key"`  // 和VerKeys相同格式的键，例如 disks.size
+	Path string      `json:"path"` // 变化的具体位置，例如 disks[serial=S1].size
+	Type string      `json:"type"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// DiffOptions 比对选项
+type DiffOptions struct {
+	// IDKeys 列表路径 -> 列表元素的标识键，例如 {"disks": "serial"}
+	// 标识键相同的元素被认为是同一个元素，列表顺序变化不会被认为是改变
+	// 缺少标识键或者标识键在列表中重复的元素按照下标比对
+	// 没有指定标识键的文档列表按照下标比对，其他列表作为整体比对
+	IDKeys map[string]string
+}
+
+/*
+Diff 比对同一个实体的两个版本，返回按路径排序的键变化列表
+路径的遍历方式和collectVals一致，列表不会出现在Key中，
+以 "_" 开头的顶层键(_ver, _next, _id...)不参与比对
+*/
+func Diff(oldDoc, newDoc map[string]interface{}, opts DiffOptions) []Change {
+	d := &differ{opts: opts}
+	d.diffMap("", "", strip(oldDoc), strip(newDoc))
+	sort.Stable(byPath(d.changes))
+	return d.changes
+}
+
+// DiffVersions 比对实体key在版本from和版本to时的状态，
+// 没有在opts中指定标识键的列表使用VerKeys中keyed方式的标识键
+func (reg *Registry) DiffVersions(key interface{}, from, to int64, opts DiffOptions, sess *mgo.Session) ([]Change, error) {
+	idKeys := map[string]string{}
+	for _, vk := range reg.VerKeys {
+		if vk.Strategy == Keyed {
+			idKeys[vk.Path] = vk.By
+		}
+	}
+	for path, id := range opts.IDKeys {
+		idKeys[path] = id
+	}
+	opts.IDKeys = idKeys
+
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	find := func(ver int64) (map[string]interface{}, error) {
+		var doc map[string]interface{}
+		err := collection.Find(And(reg.keyQuery(key), AsOf(ver))).One(&doc)
+		if err == mgo.ErrNotFound {
+			return nil, fmt.Errorf("cant find version %d of %v", ver, key)
+		} else if err != nil {
+			return nil, err
+		}
+		return reg.decodeOne(doc, sess)
+	}
+
+	oldDoc, err := find(from)
+	if err != nil {
+		return nil, err
+	}
+	newDoc, err := find(to)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(oldDoc, newDoc, opts), nil
+}
+
+type differ struct {
+	opts    DiffOptions
+	changes []Change
+}
+
+func (d *differ) add(key, path, typ string, oldVal, newVal interface{}) {
+	d.changes = append(d.changes, Change{Key: key, Path: path, Type: typ, Old: oldVal, New: newVal})
+}
+
+func (d *differ) diff(key, path string, a, b interface{}) {
+	if ma, ok := asMap(a); ok {
+		if mb, ok := asMap(b); ok {
+			d.diffMap(key, path, ma, mb)
+			return
+		}
+	}
+	if la, ok := a.([]interface{}); ok {
+		if lb, ok := b.([]interface{}); ok && isDocList(la) && isDocList(lb) {
+			d.diffList(key, path, la, lb)
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		d.add(key, path, Changed, a, b)
+	}
+}
+
+func (d *differ) diffMap(key, path string, a, b map[string]interface{}) {
+	for k, va := range a {
+		nkey, npath := join(key, k), join(path, k)
+		if vb, ok := b[k]; ok {
+			d.diff(nkey, npath, va, vb)
+		} else {
+			d.add(nkey, npath, Removed, va, nil)
+		}
+	}
+	for k, vb := range b {
+		if _, ok := a[k]; !ok {
+			d.add(join(key, k), join(path, k), Added, nil, vb)
+		}
+	}
+}
+
+func (d *differ) diffList(key, path string, a, b []interface{}) {
+	id := d.opts.IDKeys[key]
+	if id == "" {
+		for i := 0; i < len(a) || i < len(b); i++ {
+			npath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(b):
+				d.add(key, npath, Removed, a[i], nil)
+			case i >= len(a):
+				d.add(key, npath, Added, nil, b[i])
+			default:
+				d.diff(key, npath, a[i], b[i])
+			}
+		}
+		return
+	}
+
+	elemPath := func(m map[string]interface{}) string {
+		return fmt.Sprintf("%s[%s=%v]", path, id, m[id])
+	}
+	// 标识键缺失或者在列表中重复的元素无法按照标识键匹配，按照下标比对
+	index := func(l []interface{}) (map[string]map[string]interface{}, map[int]bool) {
+		count := map[string]int{}
+		for _, v := range l {
+			if m, _ := asMap(v); m[id] != nil {
+				count[elemPath(m)]++
+			}
+		}
+		byID, loose := map[string]map[string]interface{}{}, map[int]bool{}
+		for i, v := range l {
+			m, _ := asMap(v)
+			if m[id] != nil && count[elemPath(m)] == 1 {
+				byID[elemPath(m)] = m
+			} else {
+				loose[i] = true
+			}
+		}
+		return byID, loose
+	}
+	ia, la := index(a)
+	ib, lb := index(b)
+
+	for npath, ma := range ia {
+		if mb, ok := ib[npath]; ok {
+			d.diffMap(key, npath, ma, mb)
+		} else {
+			d.add(key, npath, Removed, ma, nil)
+		}
+	}
+	for npath, mb := range ib {
+		if _, ok := ia[npath]; !ok {
+			d.add(key, npath, Added, nil, mb)
+		}
+	}
+	for i := 0; i < len(a) || i < len(b); i++ {
+		npath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case la[i] && lb[i]:
+			d.diff(key, npath, a[i], b[i])
+		case la[i]:
+			d.add(key, npath, Removed, a[i], nil)
+		case lb[i]:
+			d.add(key, npath, Added, nil, b[i])
+		}
+	}
+}
+
+// strip 去掉以 "_" 开头的顶层键
+func strip(doc map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		if len(k) > 0 && k[0] == '_' {
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// asMap 兼容从数据库读出的bson.M和json解析出的map
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case bson.M:
+		return m, true
+	}
+	return nil, false
+}
+
+// isDocList 列表中的元素是否都是文档
+func isDocList(l []interface{}) bool {
+	for _, v := range l {
+		if _, ok := asMap(v); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func join(prefix, k string) string {
+	if prefix == "" {
+		return k
+	}
+	return prefix + "." + k
+}
+
+type byPath []Change
+
+func (cs byPath) Len() int           { return len(cs) }
+func (cs byPath) Less(i, j int) bool { return cs[i].Path < cs[j].Path }
+func (cs byPath) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	oldJSON := `
+	{
+		"_ver": 3,
+		"pk": 1,
+		"a": 1,
+		"b": {"c": 1, "d": 2},
+		"disks": [
+			{"serial": "S1", "size": 100},
+			{"serial": "S2", "size": 200}
+		],
+		"nics": [{"mac": "m1"}],
+		"tags": ["x", "y"]
+	}`
+	newJSON := `
+	{
+		"_ver": 5,
+		"pk": 1,
+		"a": 2,
+		"b": {"c": 1, "e": 3},
+		"disks": [
+			{"serial": "S3", "size": 300},
+			{"serial": "S2", "size": 200},
+			{"serial": "S1", "size": 150}
+		],
+		"nics": [{"mac": "m1"}, {"mac": "m2"}],
+		"tags": ["y", "x"]
+	}`
+	var oldDoc, newDoc map[string]interface{}
+	json.Unmarshal([]byte(oldJSON), &oldDoc)
+	json.Unmarshal([]byte(newJSON), &newDoc)
+
+	changes := Diff(oldDoc, newDoc, DiffOptions{IDKeys: map[string]string{"disks": "serial"}})
+	expected := []Change{
+		{Key: "a", Path: "a", Type: Changed, Old: 1.0, New: 2.0},
+		{Key: "b.d", Path: "b.d", Type: Removed, Old: 2.0},
+		{Key: "b.e", Path: "b.e", Type: Added, New: 3.0},
+		{Key: "disks.size", Path: "disks[serial=S1].size", Type: Changed, Old: 100.0, New: 150.0},
+		{Key: "disks", Path: "disks[serial=S3]", Type: Added, New: newDoc["disks"].([]interface{})[0]},
+		{Key: "nics", Path: "nics[1]", Type: Added, New: newDoc["nics"].([]interface{})[1]},
+		{Key: "tags", Path: "tags", Type: Changed, Old: oldDoc["tags"], New: newDoc["tags"]},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("版本比对结果错误\n%+v\n%+v\n", changes, expected)
+		return
+	}
+
+	// 没有指定标识键时，列表按照下标比对
+	changes = Diff(oldDoc, newDoc, DiffOptions{})
+	for _, change := range changes {
+		if change.Path == "disks[1]" {
+			t.Errorf("相同元素被认为改变 %+v\n", change)
+			return
+		}
+	}
+	if len(Diff(oldDoc, oldDoc, DiffOptions{})) != 0 {
+		t.Errorf("相同版本比对出改变\n")
+		return
+	}
+}
+
+func TestDiffLooseIDs(t *testing.T) {
+	oldJSON := `{"disks": [{"serial": "S1", "size": 1}, {"size": 2}, {"serial": "S2", "size": 3}, {"serial": "S2", "size": 4}]}`
+	newJSON := `{"disks": [{"serial": "S1", "size": 1}, {"size": 5}, {"serial": "S2", "size": 3}]}`
+	var oldDoc, newDoc map[string]interface{}
+	json.Unmarshal([]byte(oldJSON), &oldDoc)
+	json.Unmarshal([]byte(newJSON), &newDoc)
+	opts := DiffOptions{IDKeys: map[string]string{"disks": "serial"}}
+
+	// 缺少标识键的元素按照下标比对，不会互相覆盖
+	// 重复的标识键在旧版本中按照下标比对，新版本中唯一的S2没有对应的元素
+	changes := Diff(oldDoc, newDoc, opts)
+	oldDisks, newDisks := oldDoc["disks"].([]interface{}), newDoc["disks"].([]interface{})
+	expected := []Change{
+		{Key: "disks.size", Path: "disks[1].size", Type: Changed, Old: 2.0, New: 5.0},
+		{Key: "disks", Path: "disks[2]", Type: Removed, Old: oldDisks[2]},
+		{Key: "disks", Path: "disks[3]", Type: Removed, Old: oldDisks[3]},
+		{Key: "disks", Path: "disks[serial=S2]", Type: Added, New: newDisks[2]},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("标识键缺失或者重复时比对结果错误\n%+v\n%+v\n", changes, expected)
+		return
+	}
+
+	// 多个缺少标识键的元素
+	oldDoc = map[string]interface{}{"disks": []interface{}{map[string]interface{}{"size": 1.0}, map[string]interface{}{"size": 2.0}}}
+	newDoc = map[string]interface{}{"disks": []interface{}{map[string]interface{}{"size": 1.0}}}
+	changes = Diff(oldDoc, newDoc, opts)
+	if len(changes) != 1 || changes[0].Path != "disks[1]" || changes[0].Type != Removed {
+		t.Errorf("缺少标识键的元素互相覆盖 %+v\n", changes)
+		return
+	}
+	if len(Diff(oldDoc, oldDoc, opts)) != 0 {
+		t.Errorf("相同版本比对出改变\n")
+		return
+	}
+}
@@ -0,0 +1,265 @@
+package models
+
+import (
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+路径模式
+
+VerKeys, IndexKeys, ExcludeKeys 中的路径可以包含通配符:
+	* "*" 匹配一级任意键，或者列表中的任意元素，例如 cpuInfo.*, disks.*.serial
+	* "**" 匹配任意多级，只展开到叶子节点(不是文档、也不是文档列表的值)，例如 **, osInfo.**
+和collectVals一样，列表对路径是透明的，disks.*.serial 展开为 disks.serial。
+通配符不匹配以 "_" 开头的顶层键(_ver, _next, _id...)。
+
+比对时模式按照新老两个版本展开成具体路径，ExcludeKeys 和 UpdateKeys
+以及它们下级的路径不参与比对；被排除的路径在某个路径的下级时，该路径会继续展开到叶子节点。
+*/
+
+// isPattern 路径中是否有通配符
+func isPattern(path string) bool {
+	for _, part := range strings.Split(path, ".") {
+		if part == "*" || part == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch 具体路径path是否匹配模式pattern
+func globMatch(pattern, path string) bool {
+	return matchParts(strings.Split(pattern, "."), strings.Split(path, "."))
+}
+
+func matchParts(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchParts(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 || (pattern[0] != "*" && pattern[0] != path[0]) {
+		return false
+	}
+	return matchParts(pattern[1:], path[1:])
+}
+
+// matchBelow 是否存在path下级的路径匹配模式pattern
+func matchBelow(pattern, path string) bool {
+	pp, parts := strings.Split(pattern, "."), strings.Split(path, ".")
+	for i, part := range parts {
+		if i >= len(pp) {
+			return false
+		}
+		if pp[i] == "**" {
+			return true
+		}
+		if pp[i] != "*" && pp[i] != part {
+			return false
+		}
+	}
+	return len(pp) > len(parts)
+}
+
+// excluded 路径path或者它的上级是否被排除
+func excluded(path string, exclude []string) bool {
+	parts := strings.Split(path, ".")
+	for _, e := range exclude {
+		for i := 1; i <= len(parts); i++ {
+			if matchParts(strings.Split(e, "."), parts[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// excludedBelow 路径path的下级是否有被排除的路径
+func excludedBelow(path string, exclude []string) bool {
+	for _, e := range exclude {
+		if matchBelow(e, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandPaths 返回doc中匹配pattern且没有被排除的具体路径
+func expandPaths(doc map[string]interface{}, pattern string, exclude []string) []string {
+	parts := strings.Split(pattern, ".")
+	e := &expander{
+		exclude:  exclude,
+		leafOnly: parts[len(parts)-1] == "**",
+		paths:    map[string]bool{},
+	}
+	e.walk(doc, parts, "")
+
+	paths := make([]string, 0, len(e.paths))
+	for path := range e.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+type expander struct {
+	exclude  []string
+	leafOnly bool
+	paths    map[string]bool
+}
+
+// isLeaf 值不是文档也不是文档列表
+func isLeaf(v interface{}) bool {
+	if _, ok := asMap(v); ok {
+		return false
+	}
+	if l, ok := v.([]interface{}); ok && len(l) > 0 && isDocList(l) {
+		return false
+	}
+	return true
+}
+
+func (e *expander) emit(node interface{}, path string) {
+	if path == "" || excluded(path, e.exclude) {
+		return
+	}
+	if !isLeaf(node) && excludedBelow(path, e.exclude) {
+		// 展开到叶子节点，跳过被排除的下级路径
+		leaves := &expander{exclude: e.exclude, leafOnly: true, paths: e.paths}
+		leaves.walk(node, []string{"**"}, path)
+		return
+	}
+	e.paths[path] = true
+}
+
+func (e *expander) walk(node interface{}, parts []string, prefix string) {
+	if len(parts) == 0 {
+		if !e.leafOnly || isLeaf(node) {
+			e.emit(node, prefix)
+		}
+		return
+	}
+	part := parts[0]
+
+	if l, ok := node.([]interface{}); ok {
+		switch part {
+		case "*":
+			for _, elem := range l {
+				e.walk(elem, parts[1:], prefix)
+			}
+		case "**":
+			e.walk(node, parts[1:], prefix)
+			for _, elem := range l {
+				if _, ok := asMap(elem); ok {
+					e.walk(elem, parts, prefix)
+				}
+			}
+		default:
+			for _, elem := range l {
+				if _, ok := asMap(elem); ok {
+					e.walk(elem, parts, prefix)
+				}
+			}
+		}
+		return
+	}
+
+	m, ok := asMap(node)
+	if !ok {
+		if part == "**" {
+			e.walk(node, parts[1:], prefix)
+		}
+		return
+	}
+	switch part {
+	case "*", "**":
+		if part == "**" {
+			e.walk(node, parts[1:], prefix)
+		}
+		next := parts[1:]
+		if part == "**" {
+			next = parts
+		}
+		for k, v := range m {
+			if prefix == "" && strings.HasPrefix(k, "_") {
+				continue
+			}
+			if v != nil {
+				e.walk(v, next, join(prefix, k))
+			}
+		}
+	default:
+		if v := m[part]; v != nil {
+			e.walk(v, parts[1:], join(prefix, part))
+		}
+	}
+}
+
+// expand 按照ldoc和rdoc展开VerKey，没有通配符和排除路径时直接返回路径
+func (key VerKey) expand(ldoc, rdoc map[string]interface{}, exclude []string) []string {
+	if !isPattern(key.Path) && len(exclude) == 0 {
+		return []string{key.Path}
+	}
+	seen := map[string]bool{}
+	var paths []string
+	for _, doc := range []map[string]interface{}{ldoc, rdoc} {
+		for _, path := range expandPaths(doc, key.Path, exclude) {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// excludeKeys 不参与比对的路径: ExcludeKeys 和 UpdateKeys
+func (reg *Registry) excludeKeys() []string {
+	exclude := append([]string{}, reg.ExcludeKeys...)
+	for _, key := range reg.UpdateKeys {
+		exclude = append(exclude, key.Path)
+	}
+	return exclude
+}
+
+/*
+indexKey 把IndexKeys中的模式转换成mongodb的索引键
+  - 最后一级的 "*" 和 "**" 转换成通配符索引 $**，例如 cpuInfo.* -> cpuInfo.$**
+  - 中间的 "**" 无法表示，转换成上级路径的通配符索引，例如 a.**.b -> a.$**
+  - 中间的 "*" 被认为是列表下标，mongodb对列表建立多键索引，例如 disks.*.serial -> disks.serial
+*/
+func indexKey(path string) string {
+	var parts []string
+	for i, part := range strings.Split(path, ".") {
+		last := i == strings.Count(path, ".")
+		if part == "**" || (part == "*" && last) {
+			return join(strings.Join(parts, "."), "$**")
+		}
+		if part != "*" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// ensureIndex 添加索引，顶层通配符索引mgo无法解析，直接使用createIndexes命令
+func ensureIndex(collection *mgo.Collection, key string) error {
+	if key != "$**" {
+		return collection.EnsureIndexKey(key)
+	}
+	return collection.Database.Run(bson.D{
+		{Name: "createIndexes", Value: collection.Name},
+		{Name: "indexes", Value: []bson.M{{"key": bson.M{"$**": 1}, "name": "$**_1"}}},
+	}, nil)
+}
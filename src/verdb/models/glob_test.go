@@ -0,0 +1,107 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		match         bool
+	}{
+		{"cpuInfo.*", "cpuInfo.cores", true},
+		{"cpuInfo.*", "cpuInfo.cache.l1", false},
+		{"cpuInfo.**", "cpuInfo.cache.l1", true},
+		{"**", "a.b.c", true},
+		{"disks.*.serial", "disks.x.serial", true},
+		{"a.**.c", "a.c", true},
+		{"a.**.c", "a.b.d", false},
+		{"uptime", "uptime", true},
+	}
+	for _, cs := range cases {
+		if globMatch(cs.pattern, cs.path) != cs.match {
+			t.Errorf("模式匹配错误 %s %s 期望 %v\n", cs.pattern, cs.path, cs.match)
+		}
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	docJSON := `
+	{
+		"_ver": 1,
+		"cpuInfo": {"cores": 4, "model": "x", "cache": {"l1": 32}},
+		"disks": [{"serial": "S1", "size": 1}, {"serial": "S2", "size": 2}],
+		"tags": ["a", "b"],
+		"uptime": 100,
+		"loadAvg": {"1m": 0.1, "5m": 0.2}
+	}`
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(docJSON), &doc)
+
+	cases := []struct {
+		pattern  string
+		exclude  []string
+		expected []string
+	}{
+		{"cpuInfo.*", nil, []string{"cpuInfo.cache", "cpuInfo.cores", "cpuInfo.model"}},
+		{"disks.*.serial", nil, []string{"disks.serial"}},
+		{"cpuInfo", []string{"cpuInfo.cache.l1"}, []string{"cpuInfo.cores", "cpuInfo.model"}},
+		{
+			"**",
+			[]string{"uptime", "loadAvg"},
+			[]string{"cpuInfo.cache.l1", "cpuInfo.cores", "cpuInfo.model", "disks.serial", "disks.size", "tags"},
+		},
+		{"missing.*", nil, []string{}},
+	}
+	for _, cs := range cases {
+		paths := expandPaths(doc, cs.pattern, cs.exclude)
+		if !reflect.DeepEqual(paths, cs.expected) {
+			t.Errorf("模式展开错误 %s %v: %v 期望 %v\n", cs.pattern, cs.exclude, paths, cs.expected)
+		}
+	}
+}
+
+func TestChangedWithPatterns(t *testing.T) {
+	oldJSON := `{"cpuInfo": {"cores": 4}, "disks": [{"serial": "S1"}], "uptime": 100, "loadAvg": {"1m": 0.1}}`
+	newJSON := `{"cpuInfo": {"cores": 4}, "disks": [{"serial": "S1"}], "uptime": 200, "loadAvg": {"1m": 0.5}}`
+	addedJSON := `{"cpuInfo": {"cores": 4, "model": "x"}, "disks": [{"serial": "S1"}], "uptime": 200}`
+	var oldDoc, newDoc, added map[string]interface{}
+	json.Unmarshal([]byte(oldJSON), &oldDoc)
+	json.Unmarshal([]byte(newJSON), &newDoc)
+	json.Unmarshal([]byte(addedJSON), &added)
+
+	keys := []VerKey{{Path: "**"}}
+	exclude := []string{"uptime", "loadAvg"}
+	if changed(oldDoc, newDoc, keys, exclude) {
+		t.Errorf("被排除的路径不应该参与比对\n")
+	}
+	if !changed(oldDoc, newDoc, keys, nil) {
+		t.Errorf("没有排除路径时应该发生改变\n")
+	}
+	if !changed(oldDoc, added, keys, exclude) {
+		t.Errorf("新增的路径应该被比对\n")
+	}
+
+	reg := &Registry{VerKeys: []VerKey{{Path: "cpuInfo.*"}}, ExcludeKeys: exclude}
+	if keys := reg.changedKeys(oldDoc, added); !reflect.DeepEqual(keys, []string{"cpuInfo.model"}) {
+		t.Errorf("改变的路径错误 %v\n", keys)
+	}
+}
+
+func TestIndexKey(t *testing.T) {
+	cases := map[string]string{
+		"a.b":            "a.b",
+		"cpuInfo.*":      "cpuInfo.$**",
+		"cpuInfo.**":     "cpuInfo.$**",
+		"**":             "$**",
+		"disks.*.serial": "disks.serial",
+		"a.**.b":         "a.$**",
+	}
+	for path, expected := range cases {
+		if key := indexKey(path); key != expected {
+			t.Errorf("索引键转换错误 %s: %s 期望 %s\n", path, key, expected)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+内容哈希
+
+每个版本的 _hash 字段保存版本化投影的哈希:
+	* 投影由每个VerKey(模式展开后)的路径和collectVals收集到的值组成，排除ExcludeKeys和UpdateKeys
+	* 哈希是 sha256(VerKeys定义, 排除路径, 投影) 的十六进制编码，值使用canonical编码
+VerKeys的定义参与哈希，修改注册信息之后旧版本的哈希不会再被匹配。
+Versionize 先只读取最新版本的版本信息和哈希，哈希相同时直接延长最新版本，
+不同时才读取完整的最新版本逐个比对VerKeys(容差内的变化哈希不同但是不产生新版本)。
+
+采集端可以用ContentHash计算待提交记录的哈希，和上次提交返回的哈希相同时
+调用Touch只延长最新版本，不需要发送完整记录。
+*/
+
+// Hash 版本内容哈希字段
+const Hash = "_hash"
+
+// ErrHashMismatch Touch时最新版本的哈希和提交的哈希不同，需要提交完整记录
+var ErrHashMismatch = errors.New("content hash mismatch")
+
+// ContentHash 返回记录doc的版本化投影的哈希
+func (reg *Registry) ContentHash(doc map[string]interface{}) string {
+	exclude := reg.excludeKeys()
+	var projection []interface{}
+	for _, key := range reg.VerKeys {
+		for _, path := range key.expand(doc, doc, exclude) {
+			k := key
+			k.Path = path
+			if vals := collectVals(doc, k); len(vals) > 0 {
+				projection = append(projection, []interface{}{path, vals})
+			}
+		}
+	}
+
+	h := sha256.New()
+	for _, part := range []interface{}{reg.VerKeys, exclude, projection} {
+		h.Write([]byte(canonical(part)))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// latestFields 比对哈希时读取的最新版本字段: 版本信息、哈希和沿用的更新键
+func (reg *Registry) latestFields() bson.M {
+	fields := bson.M{"_id": 1, "_ver": 1, "_next": 1, "_is_latest": 1, Hash: 1, Deleted: 1, ChangedKey: 1}
+	for _, key := range reg.UpdateKeys {
+		fields[key.Path] = 1
+	}
+	// 同时选择上级和下级路径时mongodb会报错，只保留上级路径
+	for path := range fields {
+		for other := range fields {
+			if strings.HasPrefix(path, other+".") {
+				delete(fields, path)
+				break
+			}
+		}
+	}
+	return fields
+}
+
+/*
+Touch 提交的哈希和实体最新版本的哈希相同时，延长最新版本到当前版本号
+实体不存在或者已经被删除时返回ErrEntityNotFound，哈希不同时返回ErrHashMismatch
+*/
+func (reg *Registry) Touch(key interface{}, hash string, sess *mgo.Session) (Outcome, error) {
+	unlock, err := reg.lockEntity(key, sess)
+	if err != nil {
+		return Outcome{}, err
+	}
+	defer unlock()
+
+	if err = reg.prepare(key, sess); err != nil {
+		return Outcome{}, err
+	}
+
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	var latest map[string]interface{}
+	err = collection.Find(And(reg.keyQuery(key), bson.M{"_is_latest": true})).Select(reg.latestFields()).One(&latest)
+	if err == mgo.ErrNotFound || (err == nil && isDeleted(latest)) {
+		return Outcome{}, ErrEntityNotFound
+	} else if err != nil {
+		return Outcome{}, err
+	}
+	if latest[Hash] != hash {
+		return Outcome{}, ErrHashMismatch
+	}
+
+	outcome := Outcome{Action: ActionExtend, Ver: asInt64(latest["_ver"]), Hash: hash}
+	var ops []journalOp
+	if ver := reg.GenVer(); ver > asInt64(latest["_next"]) {
+		ops = append(ops, setOp(latest["_id"], bson.M{"_next": ver}))
+	}
+	return reg.commitChange(key, outcome, sess, ops...)
+}
@@ -0,0 +1,174 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestContentHash(t *testing.T) {
+	reg := &Registry{
+		VerKeys:     []VerKey{{Path: "a"}, {Path: "tags", Strategy: Unordered}, {Path: "cpu.*"}},
+		UpdateKeys:  []UpdateKey{{Path: "owner"}},
+		ExcludeKeys: []string{"cpu.load"},
+	}
+	base := map[string]interface{}{
+		"pk": 1, "a": 1, "tags": []interface{}{"x", "y"}, "owner": "alice",
+		"cpu": map[string]interface{}{"cores": 4, "load": 0.1},
+	}
+	same := map[string]interface{}{
+		"pk": 1, "a": 1.0, "tags": []interface{}{"y", "x"}, "owner": "bob", "other": true, "_ver": int64(9),
+		"cpu": map[string]interface{}{"cores": 4, "load": 0.9},
+	}
+	modified := map[string]interface{}{
+		"pk": 1, "a": 1, "tags": []interface{}{"x", "y"}, "owner": "alice",
+		"cpu": map[string]interface{}{"cores": 8, "load": 0.1},
+	}
+
+	hash := reg.ContentHash(base)
+	if len(hash) != 64 {
+		t.Errorf("哈希格式错误 %s\n", hash)
+		return
+	}
+	if reg.ContentHash(same) != hash {
+		t.Errorf("VerKeys相同的记录哈希不同\n")
+		return
+	}
+	if reg.ContentHash(modified) == hash {
+		t.Errorf("VerKeys改变的记录哈希相同\n")
+		return
+	}
+	other := &Registry{VerKeys: []VerKey{{Path: "a"}, {Path: "tags"}, {Path: "cpu.*"}}, UpdateKeys: reg.UpdateKeys, ExcludeKeys: reg.ExcludeKeys}
+	if other.ContentHash(base) == hash {
+		t.Errorf("VerKeys定义不同时哈希相同\n")
+		return
+	}
+
+	fields := (&Registry{UpdateKeys: []UpdateKey{{Path: "meta"}, {Path: "meta.location"}}}).latestFields()
+	if _, ok := fields["meta.location"]; ok || fields["meta"] != 1 {
+		t.Errorf("读取字段错误 %v\n", fields)
+		return
+	}
+}
+
+func TestTouch(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testtouch",
+		Name:           "testdb/testtouch",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+	reg.changes(sess).DropCollection()
+
+	if _, err = reg.Touch(1, "x", sess); err != ErrEntityNotFound {
+		t.Errorf("实体不存在时Touch没有报错 %v\n", err)
+		return
+	}
+
+	outcome, err := reg.Versionize(map[string]interface{}{"pk": 1, "a": 1, "b": 1}, sess)
+	if err != nil || outcome.Hash == "" {
+		t.Errorf("版本化错误 %+v %v\n", outcome, err)
+		return
+	}
+	hash := outcome.Hash
+
+	// 哈希相同时延长最新版本，同时保存最后一次提交的内容
+	outcome, err = reg.Versionize(map[string]interface{}{"pk": 1, "a": 1, "b": 2}, sess)
+	if err != nil || outcome.Action != ActionExtend || outcome.Hash != hash {
+		t.Errorf("哈希相同的记录处理结果错误 %+v %v\n", outcome, err)
+		return
+	}
+	var latest bson.M
+	collection.Find(bson.M{"pk": 1, "_is_latest": true}).One(&latest)
+	if latest["b"] != 2 || latest[Hash] != hash {
+		t.Errorf("最新版本没有更新 %v\n", latest)
+		return
+	}
+
+	outcome, err = reg.Touch(1, hash, sess)
+	if err != nil || outcome.Action != ActionExtend || outcome.Ver != asInt64(latest["_ver"]) {
+		t.Errorf("Touch处理结果错误 %+v %v\n", outcome, err)
+		return
+	}
+	collection.Find(bson.M{"pk": 1, "_is_latest": true}).One(&latest)
+	if asInt64(latest["_next"]) <= asInt64(latest["_ver"]) {
+		t.Errorf("Touch没有延长最新版本 %v\n", latest)
+		return
+	}
+
+	if _, err = reg.Touch(1, "x", sess); err != ErrHashMismatch {
+		t.Errorf("哈希不同时Touch没有报错 %v\n", err)
+		return
+	}
+	outcome, err = reg.Versionize(map[string]interface{}{"pk": 1, "a": 2}, sess)
+	if err != nil || outcome.Action != ActionVersion || outcome.Hash == hash {
+		t.Errorf("内容改变的记录处理结果错误 %+v %v\n", outcome, err)
+		return
+	}
+}
+
+// benchDoc 生成一条带有嵌套文档和列表的记录
+func benchDoc(n int) map[string]interface{} {
+	disks := make([]interface{}, n)
+	for i := range disks {
+		disks[i] = map[string]interface{}{"serial": fmt.Sprintf("S%d", i), "size": i * 1024, "model": "ssd"}
+	}
+	procs := map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		procs[fmt.Sprintf("p%d", i)] = map[string]interface{}{"pid": i, "cmd": "/usr/bin/worker"}
+	}
+	return map[string]interface{}{
+		"pk":      1,
+		"osInfo":  map[string]interface{}{"kernelRelease": "4.4.0", "hostname": "host-1"},
+		"cpuInfo": map[string]interface{}{"cores": 32, "model": "xeon", "mhz": 2400},
+		"disks":   disks,
+		"procs":   procs,
+	}
+}
+
+var benchKeys = []VerKey{
+	{Path: "osInfo.kernelRelease"},
+	{Path: "cpuInfo.*"},
+	{Path: "disks", Strategy: Keyed, By: "serial"},
+	{Path: "procs"},
+}
+
+// BenchmarkChanged 逐个VerKey比对两条记录
+func BenchmarkChanged(b *testing.B) {
+	ldoc, rdoc := benchDoc(64), benchDoc(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if changed(ldoc, rdoc, benchKeys, nil) {
+			b.Fatal("记录不应该改变")
+		}
+	}
+}
+
+// BenchmarkContentHash 计算提交记录的哈希并和保存的哈希比对
+func BenchmarkContentHash(b *testing.B) {
+	reg := &Registry{VerKeys: benchKeys}
+	stored := reg.ContentHash(benchDoc(64))
+	doc := benchDoc(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if reg.ContentHash(doc) != stored {
+			b.Fatal("记录不应该改变")
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Version 实体的一个历史版本
+type Version struct {
+	Ver       int64                  `json:"ver"`
+	Next      int64                  `json:"next"`
+	IsLatest  bool                   `json:"isLatest"`
+	Deleted   bool                   `json:"deleted"`        // 删除标记，实体在该版本的有效区间内不存在
+	Hash      string                 `json:"hash,omitempty"` // 版本内容哈希，见hash.go
+	ValidFrom time.Time              `json:"validFrom"`      // 版本开始生效的时间
+	ValidTo   *time.Time             `json:"validTo"`        // 版本失效的时间，最新版本为空
+	Doc       map[string]interface{} `json:"doc"`
+}
+
+// HistoryQuery 历史版本查询条件
+type HistoryQuery struct {
+	From  *int64 // 只返回有效区间和 [From, To] 相交的版本
+	To    *int64
+	Skip  int
+	Limit int
+	Meta  MetaFilter // 按照提交来源过滤，见provenance.go
+}
+
+// ParseKey 解析url中的实体key，数字和带引号的字符串按照json解析，其他作为字符串，
+// 多个标识键时key是json列表，例如 ["dell","S1"]
+// 全部是数字的字符串key(例如序列号12345)会被解析为数字，查询实体时使用ResolveKey
+func (reg *Registry) ParseKey(s string) interface{} {
+	key, _ := reg.parseKey(s)
+	return key
+}
+
+// parseKey 解析url中的实体key，key中有数字时alt为数字按照原文作为字符串的key，否则alt为nil
+func (reg *Registry) parseKey(s string) (key, alt interface{}) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.Decode(&struct{}{}) != io.EOF {
+		return s, nil
+	}
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return s, nil
+		}
+		return f, v.String()
+	case string:
+		return v, nil
+	case []interface{}:
+		if len(reg.compareKeys()) <= 1 {
+			break
+		}
+		keys := make([]interface{}, len(v))
+		alts := make([]interface{}, len(v))
+		numbers := false
+		for i, item := range v {
+			keys[i], alts[i] = item, item
+			if n, ok := item.(json.Number); ok {
+				f, err := n.Float64()
+				if err != nil {
+					return s, nil
+				}
+				keys[i], alts[i], numbers = f, n.String(), true
+			}
+		}
+		if numbers {
+			return keys, alts
+		}
+		return keys, nil
+	}
+	return s, nil
+}
+
+/*
+ResolveKey 解析url中的实体key，并按照数据库中实体标识的类型确定key
+key中有数字时先按数字查询，实体不存在时每个数字分别按数字或者原文的字符串查询(altQuery)，
+找到的实体按照EntityKey从记录中取出key，多个标识键的类型可以不同；都不存在时返回数字的key
+*/
+func (reg *Registry) ResolveKey(s string, sess *mgo.Session) (interface{}, error) {
+	key, alt := reg.parseKey(s)
+	if alt == nil {
+		return key, nil
+	}
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	n, err := collection.Find(reg.keyQuery(key)).Limit(1).Count()
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return key, nil
+	}
+	var doc map[string]interface{}
+	err = collection.Find(reg.altQuery(key, alt)).Select(reg.keySelector()).One(&doc)
+	if err == mgo.ErrNotFound {
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return reg.EntityKey(doc)
+}
+
+// altQuery 返回parseKey解析出的key, alt的查询条件，数字的标识键匹配数字或者原文的字符串
+func (reg *Registry) altQuery(key, alt interface{}) bson.M {
+	paths := reg.compareKeys()
+	if len(paths) == 1 {
+		return bson.M{paths[0]: bson.M{"$in": []interface{}{key, alt}}}
+	}
+	keys, _ := key.([]interface{})
+	alts, _ := alt.([]interface{})
+	q := reg.keyQuery(key)
+	for i, path := range paths {
+		if i < len(keys) && i < len(alts) && keys[i] != alts[i] {
+			q[path] = bson.M{"$in": []interface{}{keys[i], alts[i]}}
+		}
+	}
+	return q
+}
+
+// keySelector 只查询标识键
+func (reg *Registry) keySelector() bson.M {
+	sel := bson.M{}
+	for _, path := range reg.compareKeys() {
+		sel[path] = 1
+	}
+	return sel
+}
+
+// History 按版本顺序返回实体key的历史版本，以及符合条件的版本总数
+func (reg *Registry) History(key interface{}, q HistoryQuery, sess *mgo.Session) ([]Version, int, error) {
+	cond := reg.keyQuery(key)
+	if q.From != nil || q.To != nil {
+		var start, end int64 = 0, 1<<63 - 1
+		if q.From != nil {
+			start = *q.From
+		}
+		if q.To != nil {
+			end = *q.To
+		}
+		cond = And(cond, during(start, end))
+	}
+	cond = And(cond, q.Meta.Query())
+
+	query := sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(cond)
+	total, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query = query.Sort("_ver", "_next") // 同一个Interval中被删除的版本区间为空，排在删除标记之前
+	if q.Skip > 0 {
+		query = query.Skip(q.Skip)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+	var docs []map[string]interface{}
+	if err = query.All(&docs); err != nil {
+		return nil, 0, err
+	}
+	if err = reg.decode(docs, sess); err != nil {
+		return nil, 0, err
+	}
+
+	versions := make([]Version, 0, len(docs))
+	for _, doc := range docs {
+		versions = append(versions, reg.version(doc))
+	}
+	return versions, total, nil
+}
+
+// version 根据记录的 _ver, _next 生成版本信息
+func (reg *Registry) version(doc map[string]interface{}) Version {
+	v := Version{
+		Ver:      asInt64(doc["_ver"]),
+		Next:     asInt64(doc["_next"]),
+		IsLatest: doc["_is_latest"] == true,
+		Deleted:  isDeleted(doc),
+		Doc:      doc,
+	}
+	v.Hash, _ = doc[Hash].(string)
+	v.ValidFrom = reg.VerTime(v.Ver)
+	if !v.IsLatest {
+		to := reg.VerTime(v.Next + 1)
+		v.ValidTo = &to
+	}
+	return v
+}
+
+// asInt64 把数据库中读出的数字转换为int64
+func asInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseKey(t *testing.T) {
+	reg := &Registry{CompareKey: "pk"}
+	cases := []struct {
+		s        string
+		key, alt interface{}
+	}{
+		{"1", float64(1), "1"},
+		{"12345", float64(12345), "12345"},
+		{`"1"`, "1", nil},
+		{"server-01", "server-01", nil},
+		{"[1,2]", "[1,2]", nil},
+		{"1 2", "1 2", nil},
+	}
+	for _, cs := range cases {
+		if key, alt := reg.parseKey(cs.s); key != cs.key || alt != cs.alt {
+			t.Errorf("解析 %s 错误 %#v, %#v != %#v, %#v\n", cs.s, key, alt, cs.key, cs.alt)
+			return
+		}
+	}
+
+	reg = &Registry{CompareKeys: []string{"vendor", "sn"}}
+	key, alt := reg.parseKey(`["dell",12345]`)
+	if !reflect.DeepEqual(key, []interface{}{"dell", float64(12345)}) || !reflect.DeepEqual(alt, []interface{}{"dell", "12345"}) {
+		t.Errorf("解析多个标识键错误 %#v %#v\n", key, alt)
+		return
+	}
+	if key, alt = reg.parseKey(`["dell","S1"]`); !reflect.DeepEqual(key, []interface{}{"dell", "S1"}) || alt != nil {
+		t.Errorf("解析多个标识键错误 %#v %#v\n", key, alt)
+		return
+	}
+
+	// 类型混合的多个标识键，每个数字分别匹配数字或者原文的字符串
+	key, alt = reg.parseKey(`[7,12345]`)
+	q := reg.altQuery(key, alt)
+	if !reflect.DeepEqual(q["vendor"], bson.M{"$in": []interface{}{float64(7), "7"}}) ||
+		!reflect.DeepEqual(q["sn"], bson.M{"$in": []interface{}{float64(12345), "12345"}}) {
+		t.Errorf("多个标识键的查询条件错误 %v\n", q)
+	}
+}
+
+func TestVersionRange(t *testing.T) {
+	reg := &Registry{VerInterval: Daily}
+	day := time.Date(2016, 3, 2, 0, 0, 0, 0, time.UTC)
+	ver := reg.VerAt(day.Add(5 * time.Hour))
+
+	v := reg.version(map[string]interface{}{"_ver": ver, "_next": ver + 1, "_is_latest": false})
+	if !v.ValidFrom.Equal(day) || v.ValidTo == nil || !v.ValidTo.Equal(day.Add(48*time.Hour)) {
+		t.Errorf("版本有效区间错误 %v %v\n", v.ValidFrom, v.ValidTo)
+		return
+	}
+
+	v = reg.version(map[string]interface{}{"_ver": int(ver), "_next": float64(ver), "_is_latest": true})
+	if v.Ver != ver || v.Next != ver || v.ValidTo != nil {
+		t.Errorf("最新版本有效区间错误 %+v\n", v)
+		return
+	}
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"log"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+版本变更日志
+
+一次版本变更需要修改多条记录(例如关闭老版本，插入新版本)，mongodb不支持多文档事务，
+写入前先把所有操作保存到日志表 <collection>.journal 中，全部操作完成后删除日志。
+如果中途出错或者进程崩溃，未完成的日志会在启动时(RegManager.Recover)、
+同一实体下一次写入时或者读取变更日志遇到缺少的序号时被重放。所有操作都是幂等的，重放多次结果一致。
+写入的变更记录(见changelog.go)作为同一条日志中的一个操作，和版本的修改一起完成。
+*/
+
+// journalOp 日志中的一个操作，Insert, Set/Unset, Remove 只能设置一种
+type journalOp struct {
+	ID     interface{}  `bson:"id"`
+	Insert bson.M       `bson:"insert,omitempty"` // 插入或者替换整条记录
+	Set    []journalSet `bson:"set,omitempty"`    // 修改记录的键
+	Unset  []string     `bson:"unset,omitempty"`  // 删除记录的键
+	Remove bool         `bson:"remove,omitempty"` // 删除记录
+	Coll   string       `bson:"coll,omitempty"`   // 操作的表相对记录表的后缀，为空时是记录表
+}
+
+// journalSet 需要修改的键值，键可能包含"."，不能直接作为文档的键保存
+type journalSet struct {
+	Key string      `bson:"k"`
+	Val interface{} `bson:"v"`
+}
+
+// journalEntry 一组需要原子完成的操作
+type journalEntry struct {
+	ID  bson.ObjectId `bson:"_id"`
+	Key interface{}   `bson:"key"`           // 实体key，见EntityKey
+	Seq int64         `bson:"seq,omitempty"` // 包含的变更记录的序号
+	Ops []journalOp   `bson:"ops"`
+}
+
+// commitHook 测试时用于在操作之间注入错误
+var commitHook func(i int) error
+
+func insertOp(doc map[string]interface{}) journalOp {
+	return journalOp{ID: doc["_id"], Insert: doc}
+}
+
+func setOp(id interface{}, set bson.M) journalOp {
+	op := journalOp{ID: id}
+	for k, v := range set {
+		op.Set = append(op.Set, journalSet{k, v})
+	}
+	return op
+}
+
+func removeOp(id interface{}) journalOp {
+	return journalOp{ID: id, Remove: true}
+}
+
+// apply 执行一个操作
+func (op journalOp) apply(collection *mgo.Collection) error {
+	var err error
+	switch {
+	case op.Insert != nil:
+		_, err = collection.UpsertId(op.ID, op.Insert)
+	case op.Remove:
+		err = collection.RemoveId(op.ID)
+	default:
+		update := bson.M{}
+		if len(op.Set) > 0 {
+			set := bson.M{}
+			for _, s := range op.Set {
+				set[s.Key] = s.Val
+			}
+			update["$set"] = set
+		}
+		if len(op.Unset) > 0 {
+			unset := bson.M{}
+			for _, k := range op.Unset {
+				unset[k] = ""
+			}
+			update["$unset"] = unset
+		}
+		err = collection.UpdateId(op.ID, update)
+	}
+	if err == mgo.ErrNotFound { // 重放时记录可能已经被删除
+		return nil
+	}
+	return err
+}
+
+func (reg *Registry) journal(sess *mgo.Session) *mgo.Collection {
+	return sess.DB(reg.DatabaseName).C(reg.CollectionName + ".journal")
+}
+
+// commit 原子的执行实体key的一组操作，插入的记录需要预先设置_id
+// 增量存储时先恢复依赖被删除或者替换的记录的增量记录，见delta.go
+// 实体的租约续约失败时不写入，返回ErrLeaseLost，见lease.go
+func (reg *Registry) commit(key interface{}, sess *mgo.Session, ops ...journalOp) error {
+	if err := reg.checkLease(key); err != nil {
+		return err
+	}
+	db := sess.DB(reg.DatabaseName)
+	if err := reg.materializeOps(key, ops, sess); err != nil {
+		return err
+	}
+	if len(ops) == 1 {
+		return ops[0].apply(db.C(reg.CollectionName + ops[0].Coll))
+	}
+
+	entry := journalEntry{ID: bson.NewObjectId(), Key: key, Ops: ops}
+	for _, op := range ops {
+		if op.Coll == changesSuffix {
+			entry.Seq = asInt64(op.ID)
+		}
+	}
+	journal := reg.journal(sess)
+	if err := journal.Insert(entry); err != nil {
+		return err
+	}
+	if err := entry.replay(db, reg.CollectionName); err != nil {
+		return err
+	}
+	return journal.RemoveId(entry.ID)
+}
+
+// replay 依次执行日志中的操作，name为记录表
+func (entry *journalEntry) replay(db *mgo.Database, name string) error {
+	for i, op := range entry.Ops {
+		if err := op.apply(db.C(name + op.Coll)); err != nil {
+			return err
+		}
+		if commitHook != nil {
+			if err := commitHook(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recover 重放未完成的日志，需要锁定query对应的实体
+func (reg *Registry) recover(query bson.M, sess *mgo.Session) error {
+	db := sess.DB(reg.DatabaseName)
+	journal := reg.journal(sess)
+
+	var entries []journalEntry
+	if err := journal.Find(query).Sort("_id").All(&entries); err != nil {
+		return err
+	}
+	for i := range entries {
+		if err := entries[i].replay(db, reg.CollectionName); err != nil {
+			return err
+		}
+		if err := journal.RemoveId(entries[i].ID); err != nil {
+			return err
+		}
+		log.Printf("%s: replayed journal %s\n", reg.Name, entries[i].ID.Hex())
+	}
+	return nil
+}
+
+// Recover 重放注册表中所有未完成的日志，逐个锁定有未完成日志的实体
+func (reg *Registry) Recover(sess *mgo.Session) error {
+	_, err := reg.recoverWhere(nil, sess)
+	return err
+}
+
+// recoverWhere 重放满足条件query的日志，逐个锁定有未完成日志的实体，返回重放的实体数
+func (reg *Registry) recoverWhere(query bson.M, sess *mgo.Session) (int, error) {
+	var entries []journalEntry
+	if err := reg.journal(sess).Find(query).Select(bson.M{"key": 1}).Sort("_id").All(&entries); err != nil {
+		return 0, err
+	}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if seen[canonical(entry.Key)] {
+			continue
+		}
+		seen[canonical(entry.Key)] = true
+
+		unlock, err := reg.lockEntity(entry.Key, sess)
+		if err != nil {
+			return 0, err
+		}
+		err = reg.recover(bson.M{"key": entry.Key}, sess)
+		unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(seen), nil
+}
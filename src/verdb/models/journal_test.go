@@ -0,0 +1,90 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestVersionizeCrash(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testjournal",
+		Name:           "testdb/testjournal",
+		CompareKey:     "pk",
+		VerKeys:        []VerKey{{Path: "a"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+	reg.journal(sess).DropCollection()
+
+	countLatest := func() int {
+		n, _ := collection.Find(bson.M{"pk": 1, "_is_latest": true}).Count()
+		return n
+	}
+	countJournal := func() int {
+		n, _ := reg.journal(sess).Count()
+		return n
+	}
+
+	if _, err := reg.Versionize(map[string]interface{}{"pk": 1, "a": 1}, sess); err != nil {
+		t.Errorf("插入第一条记录错误 %s\n", err)
+		return
+	}
+
+	// 关闭老版本之后，插入新版本之前出错
+	commitHook = func(i int) error {
+		if i == 0 {
+			return errors.New("crash")
+		}
+		return nil
+	}
+	_, err = reg.Versionize(map[string]interface{}{"pk": 1, "a": 2}, sess)
+	commitHook = nil
+	if err == nil {
+		t.Errorf("注入的错误没有返回\n")
+		return
+	}
+	if countLatest() != 0 || countJournal() != 1 {
+		t.Errorf("出错后状态不对 %d %d\n", countLatest(), countJournal())
+		return
+	}
+
+	// 启动时重放日志
+	if err := reg.Recover(sess); err != nil {
+		t.Errorf("重放日志错误 %s\n", err)
+		return
+	}
+	var last map[string]interface{}
+	collection.Find(bson.M{"pk": 1, "_is_latest": true}).One(&last)
+	if countLatest() != 1 || countJournal() != 0 || last["a"] != 2 {
+		t.Errorf("重放日志后状态不对 %d %d %v\n", countLatest(), countJournal(), last)
+		return
+	}
+
+	// 再次出错，由下一次写入重放日志
+	commitHook = func(i int) error { return errors.New("crash") }
+	reg.Versionize(map[string]interface{}{"pk": 1, "a": 3}, sess)
+	commitHook = nil
+	if _, err := reg.Versionize(map[string]interface{}{"pk": 1, "a": 4}, sess); err != nil {
+		t.Errorf("写入错误 %s\n", err)
+		return
+	}
+	n, _ := collection.Find(bson.M{"pk": 1}).Count()
+	if countLatest() != 1 || countJournal() != 0 || n != 4 {
+		t.Errorf("写入时重放日志后状态不对 %d %d %d\n", countLatest(), countJournal(), n)
+		return
+	}
+}
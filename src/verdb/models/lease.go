@@ -0,0 +1,206 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+实体锁
+
+写入(Versionize, Delete, Restore, Undo, Touch, 日志重放, 迁移, 压缩)只锁定被写入的实体，
+不同实体的写入可以并发进行。实体锁分为两层:
+
+	* 进程内: 同一个实体的写入在进程内排队，不需要轮询数据库
+	* 进程间: 表 <collection>.leases 中的租约 {_id: <实体key的json>, owner: <持有者>, expires: <过期时间>}
+
+插入租约成功，或者已有的租约已经过期时获得锁，写入完成后删除租约。
+持有锁期间每隔LeaseRenew续约一次，续约失败(租约已经过期被其他进程接管，或者数据库错误)之后
+该实体的提交(commit)返回ErrLeaseLost，不会和接管的进程同时写入。
+持有锁的进程崩溃时，租约在LeaseTTL之后过期，其他进程可以继续写入该实体。
+租约的过期时间由各个进程的本地时间决定，多个实例之间的时钟偏差需要远小于LeaseTTL。
+等待超过LeaseWait时返回ErrEntityBusy。
+
+注册表锁(Registry.Mutex)只保护注册表本身的状态(进行中的迁移任务)，不再在写入期间持有。
+*/
+
+// ErrEntityBusy 等待实体锁超时
+var ErrEntityBusy = errors.New("entity is being written by another request")
+
+// ErrLeaseLost 写入期间续约失败，租约可能已经被其他进程接管
+var ErrLeaseLost = errors.New("entity lease lost before the write completed")
+
+var (
+	// LeaseTTL 租约的有效时间，一次写入需要在这个时间内完成
+	LeaseTTL = 30 * time.Second
+	// LeaseWait 等待其他进程释放租约的最长时间
+	LeaseWait = 10 * time.Second
+	// LeaseRenew 持有租约期间续约的间隔，需要小于LeaseTTL
+	LeaseRenew = 10 * time.Second
+)
+
+// 等待租约时的重试间隔，每次翻倍
+const (
+	leaseRetryMin = 2 * time.Millisecond
+	leaseRetryMax = 100 * time.Millisecond
+)
+
+// entityMutex 进程内的实体锁，refs为持有和等待该锁的数目，为0时从entityMutexes中删除
+// lost为1时持有者的租约续约失败
+type entityMutex struct {
+	sync.Mutex
+	refs int
+	lost int32
+}
+
+// entityMutexes 进程内所有被锁定的实体，注册信息被更新替换之后仍然有效
+var entityMutexes = struct {
+	sync.Mutex
+	m map[string]*entityMutex
+}{m: map[string]*entityMutex{}}
+
+func lockLocal(name string) *entityMutex {
+	entityMutexes.Lock()
+	mux, ok := entityMutexes.m[name]
+	if !ok {
+		mux = &entityMutex{}
+		entityMutexes.m[name] = mux
+	}
+	mux.refs++
+	entityMutexes.Unlock()
+
+	mux.Lock()
+	return mux
+}
+
+func unlockLocal(name string) {
+	entityMutexes.Lock()
+	mux := entityMutexes.m[name]
+	mux.refs--
+	if mux.refs == 0 {
+		delete(entityMutexes.m, name)
+	}
+	entityMutexes.Unlock()
+
+	mux.Unlock()
+}
+
+func (reg *Registry) leases(sess *mgo.Session) *mgo.Collection {
+	return sess.DB(reg.DatabaseName).C(reg.CollectionName + ".leases")
+}
+
+// acquireLease 获取实体id的租约，返回持有者标识
+func (reg *Registry) acquireLease(id string, sess *mgo.Session) (bson.ObjectId, error) {
+	leases := reg.leases(sess)
+	owner := bson.NewObjectId()
+	deadline := time.Now().Add(LeaseWait)
+	wait := leaseRetryMin
+	for {
+		// 没有租约时插入，租约过期时替换，租约有效时插入相同的_id报错
+		now := time.Now()
+		_, err := leases.Upsert(
+			bson.M{"_id": id, "expires": bson.M{"$lt": now}},
+			bson.M{"_id": id, "owner": owner, "expires": now.Add(LeaseTTL)},
+		)
+		if err == nil {
+			return owner, nil
+		} else if !mgo.IsDup(err) {
+			return "", err
+		}
+		if now.After(deadline) {
+			return "", ErrEntityBusy
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > leaseRetryMax {
+			wait = leaseRetryMax
+		}
+	}
+}
+
+// renewLease 每隔LeaseRenew续约一次，直到stop被关闭，续约失败时标记mux并退出
+func (reg *Registry) renewLease(id string, owner bson.ObjectId, mux *entityMutex, stop <-chan struct{}, done chan<- struct{}, sess *mgo.Session) {
+	defer close(done)
+	ticker := time.NewTicker(LeaseRenew)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := reg.leases(sess).Update(
+			bson.M{"_id": id, "owner": owner},
+			bson.M{"$set": bson.M{"expires": time.Now().Add(LeaseTTL)}},
+		)
+		if err != nil {
+			log.Println("Lease", reg.Name, id, err)
+			atomic.StoreInt32(&mux.lost, 1)
+			return
+		}
+	}
+}
+
+/*
+lockEntity 锁定实体key，返回释放锁的函数
+释放租约失败时只记录日志，租约会在LeaseTTL之后过期
+*/
+func (reg *Registry) lockEntity(key interface{}, sess *mgo.Session) (func(), error) {
+	id := canonical(key)
+	name := reg.lockName(id)
+	mux := lockLocal(name)
+
+	owner, err := reg.acquireLease(id, sess)
+	if err != nil {
+		unlockLocal(name)
+		return nil, err
+	}
+	atomic.StoreInt32(&mux.lost, 0)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go reg.renewLease(id, owner, mux, stop, done, sess)
+	return func() {
+		close(stop)
+		<-done
+		if err := reg.leases(sess).Remove(bson.M{"_id": id, "owner": owner}); err != nil && err != mgo.ErrNotFound {
+			log.Println("Lease", reg.Name, id, err)
+		}
+		unlockLocal(name)
+	}, nil
+}
+
+// lockName 进程内实体锁的名称，id为实体key的canonical编码
+func (reg *Registry) lockName(id string) string {
+	return reg.DatabaseName + "/" + reg.CollectionName + "/" + id
+}
+
+// checkLease 实体key的租约续约失败时返回ErrLeaseLost，没有锁定时返回nil
+func (reg *Registry) checkLease(key interface{}) error {
+	entityMutexes.Lock()
+	mux := entityMutexes.m[reg.lockName(canonical(key))]
+	entityMutexes.Unlock()
+	if mux != nil && atomic.LoadInt32(&mux.lost) == 1 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// migrationJob 返回进行中的迁移任务，没有时返回nil
+func (reg *Registry) migrationJob() *Migration {
+	reg.Lock()
+	defer reg.Unlock()
+
+	return reg.job
+}
+
+// setJob 设置进行中的迁移任务
+func (reg *Registry) setJob(job *Migration) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	reg.job = job
+}
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEntityLease(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testlease",
+		Name:           "testdb/testlease",
+		CompareKey:     "pk",
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	leases := reg.leases(sess)
+	leases.DropCollection()
+
+	defer func(wait time.Duration) { LeaseWait = wait }(LeaseWait)
+	LeaseWait = 50 * time.Millisecond
+
+	// 锁定一个实体时其他实体可以同时写入
+	unlock, err := reg.lockEntity(1, sess)
+	if err != nil {
+		t.Errorf("锁定实体失败 %v\n", err)
+		return
+	}
+	done := make(chan error)
+	go func() {
+		unlock2, err := reg.lockEntity(2, sess)
+		if err == nil {
+			unlock2()
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("锁定其他实体失败 %v\n", err)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Errorf("锁定其他实体被阻塞\n")
+		return
+	}
+	unlock()
+	if n, _ := leases.Count(); n != 0 {
+		t.Errorf("释放之后租约没有被删除 %d\n", n)
+		return
+	}
+
+	// 其他进程持有未过期的租约时等待超时
+	leases.Insert(bson.M{"_id": canonical(3), "owner": bson.NewObjectId(), "expires": time.Now().Add(time.Minute)})
+	if _, err = reg.lockEntity(3, sess); err != ErrEntityBusy {
+		t.Errorf("租约被占用时没有超时 %v\n", err)
+		return
+	}
+
+	// 租约过期之后可以被接管
+	leases.UpdateId(canonical(3), bson.M{"$set": bson.M{"expires": time.Now().Add(-time.Second)}})
+	if unlock, err = reg.lockEntity(3, sess); err != nil {
+		t.Errorf("接管过期的租约失败 %v\n", err)
+		return
+	}
+	unlock()
+
+	// 持有租约期间续约，超过LeaseTTL之后租约仍然有效
+	defer func(ttl, renew time.Duration) { LeaseTTL, LeaseRenew = ttl, renew }(LeaseTTL, LeaseRenew)
+	LeaseTTL, LeaseRenew = 100*time.Millisecond, 20*time.Millisecond
+	if unlock, err = reg.lockEntity(4, sess); err != nil {
+		t.Errorf("锁定实体失败 %v\n", err)
+		return
+	}
+	time.Sleep(3 * LeaseTTL)
+	var lease struct {
+		Expires time.Time `bson:"expires"`
+	}
+	if err = leases.FindId(canonical(4)).One(&lease); err != nil || lease.Expires.Before(time.Now()) {
+		t.Errorf("租约没有续约 %v %v\n", lease, err)
+		unlock()
+		return
+	}
+
+	// 租约被其他进程接管之后续约失败，提交被拒绝
+	leases.UpdateId(canonical(4), bson.M{"$set": bson.M{"owner": bson.NewObjectId()}})
+	time.Sleep(3 * LeaseRenew)
+	if err = reg.commit(4, sess, insertOp(map[string]interface{}{"_id": bson.NewObjectId(), "pk": 4})); err != ErrLeaseLost {
+		t.Errorf("续约失败之后仍然可以提交 %v\n", err)
+	}
+	reg.Delta = &Delta{SnapshotEvery: 3}
+	if err = reg.encodeBefore(4, map[string]interface{}{"_id": bson.NewObjectId(), "_ver": 2, "pk": 4}, sess); err != ErrLeaseLost {
+		t.Errorf("续约失败之后仍然可以编码增量 %v\n", err)
+	}
+	if err = reg.materialize(4, bson.NewObjectId(), sess); err != ErrLeaseLost {
+		t.Errorf("续约失败之后仍然可以恢复增量记录 %v\n", err)
+	}
+	reg.Delta = nil
+	unlock()
+	if n, _ := sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(bson.M{"pk": 4}).Count(); n != 0 {
+		t.Errorf("续约失败之后写入了记录 %d\n", n)
+	}
+}
+
+// benchmarkVersionize 并发写入entities个实体
+func benchmarkVersionize(b *testing.B, entities int64) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "benchlease",
+		Name:           "testdb/benchlease",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		b.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	db := sess.DB(reg.DatabaseName)
+	for _, name := range []string{"", ".changes", ".counters", ".leases"} {
+		db.C(reg.CollectionName + name).DropCollection()
+	}
+	reg.ensureIndexes(sess)
+
+	var n int64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		wsess := sess.Copy()
+		defer wsess.Close()
+		for pb.Next() {
+			i := atomic.AddInt64(&n, 1)
+			if _, err := reg.Versionize(map[string]interface{}{"pk": i % entities, "a": i}, wsess); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkVersionizeOneEntity 所有写入都在同一个实体上，依次执行，相当于原来的注册表锁
+func BenchmarkVersionizeOneEntity(b *testing.B) {
+	benchmarkVersionize(b, 1)
+}
+
+// BenchmarkVersionizeEntities 写入分散在不同实体上，并发执行
+func BenchmarkVersionizeEntities(b *testing.B) {
+	benchmarkVersionize(b, 1000)
+}
@@ -0,0 +1,436 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// clauseList 逻辑操作符($and, $or, $nor)的子条件，兼容json解析出的列表和程序生成的bson.M列表
+func clauseList(cond interface{}) ([]map[string]interface{}, bool) {
+	var clauses []map[string]interface{}
+	switch tc := cond.(type) {
+	case []interface{}:
+		for _, clause := range tc {
+			q, ok := asMap(clause)
+			if !ok {
+				return nil, false
+			}
+			clauses = append(clauses, q)
+		}
+	case []bson.M:
+		for _, clause := range tc {
+			clauses = append(clauses, clause)
+		}
+	case []map[string]interface{}:
+		clauses = tc
+	default:
+		return nil, false
+	}
+	return clauses, true
+}
+
+// storedOnDelta 查询query中的路径是否都在增量记录中完整保存: 标识键和以 "_" 开头的保留键(见delta.go)
+func (reg *Registry) storedOnDelta(query map[string]interface{}) bool {
+	for k, cond := range query {
+		switch k {
+		case "$and", "$or", "$nor":
+			clauses, ok := clauseList(cond)
+			if !ok {
+				return false
+			}
+			for _, clause := range clauses {
+				if !reg.storedOnDelta(clause) {
+					return false
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(k, "$") {
+			return false
+		}
+		if strings.HasPrefix(k, "_") {
+			continue
+		}
+		found := false
+		for _, path := range reg.compareKeys() {
+			found = found || k == path || strings.HasPrefix(k, path+".")
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+deltaQuery 返回查询query中可以直接用于增量记录的部分: 只使用标识键和保留键的条件，
+满足query的记录一定满足返回的条件，用于在mongodb中缩小需要重建的增量记录的范围
+*/
+func (reg *Registry) deltaQuery(query map[string]interface{}) bson.M {
+	part := bson.M{}
+	for k, cond := range query {
+		if k == "$and" {
+			clauses, ok := clauseList(cond)
+			if !ok {
+				continue
+			}
+			var kept []bson.M
+			for _, clause := range clauses {
+				if q := reg.deltaQuery(clause); len(q) > 0 {
+					kept = append(kept, q)
+				}
+			}
+			if len(kept) > 0 {
+				part["$and"] = kept
+			}
+			continue
+		}
+		if reg.storedOnDelta(map[string]interface{}{k: cond}) {
+			part[k] = cond
+		}
+	}
+	return part
+}
+
+/*
+Match 判断记录doc是否满足mongodb查询条件query，用于过滤重建的增量记录
+支持的操作符: $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $regex, $size, $all, $elemMatch, $not, $and, $or, $nor
+路径的遍历方式和collectVals一致，列表中任意一个元素满足条件即可，
+其他操作符返回错误
+*/
+func Match(doc map[string]interface{}, query map[string]interface{}) (bool, error) {
+	for k, cond := range query {
+		var ok bool
+		var err error
+		switch k {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, k, cond)
+		default:
+			if strings.HasPrefix(k, "$") {
+				return false, fmt.Errorf("unsupported operator %s on delta versions", k)
+			}
+			ok, err = matchVals(walkVals(doc, strings.Split(k, ".")), cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc map[string]interface{}, op string, cond interface{}) (bool, error) {
+	clauses, ok := clauseList(cond)
+	if !ok {
+		return false, fmt.Errorf("%s requires an array of documents", op)
+	}
+	found := false
+	for _, clause := range clauses {
+		matched, err := Match(doc, clause)
+		if err != nil {
+			return false, err
+		}
+		if op == "$and" && !matched {
+			return false, nil
+		}
+		found = found || matched
+	}
+	switch op {
+	case "$or":
+		return found, nil
+	case "$nor":
+		return !found, nil
+	}
+	return true, nil
+}
+
+// operators cond是否是操作符文档
+func operators(cond interface{}) (map[string]interface{}, bool) {
+	ops, ok := asMap(cond)
+	if !ok || len(ops) == 0 {
+		return nil, false
+	}
+	for k := range ops {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+// matchVals 路径的值vals是否满足条件cond，cond是操作符文档或者需要相等的值
+func matchVals(vals []interface{}, cond interface{}) (bool, error) {
+	ops, isOps := operators(cond)
+	if !isOps {
+		if cond == nil { // null匹配不存在的键
+			return len(vals) == 0, nil
+		}
+		return anyVal(vals, func(v interface{}) bool { return equalVal(v, cond) }), nil
+	}
+
+	for op, arg := range ops {
+		var ok bool
+		var err error
+		switch op {
+		case "$eq":
+			ok, err = matchVals(vals, bson.M{"$in": []interface{}{arg}})
+		case "$ne":
+			ok, err = matchVals(vals, bson.M{"$nin": []interface{}{arg}})
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = anyVal(vals, func(v interface{}) bool {
+				c, comparable := compareVal(v, arg)
+				if !comparable {
+					return false
+				}
+				switch op {
+				case "$gt":
+					return c > 0
+				case "$gte":
+					return c >= 0
+				case "$lt":
+					return c < 0
+				}
+				return c <= 0
+			})
+		case "$in", "$nin":
+			list, isList := arg.([]interface{})
+			if !isList {
+				return false, fmt.Errorf("%s requires an array", op)
+			}
+			for _, elem := range list {
+				if elem == nil && len(vals) == 0 {
+					ok = true
+				}
+			}
+			ok = ok || anyVal(vals, func(v interface{}) bool {
+				for _, elem := range list {
+					if equalVal(v, elem) {
+						return true
+					}
+				}
+				return false
+			})
+			if op == "$nin" {
+				ok = !ok
+			}
+		case "$exists":
+			ok = (len(vals) > 0) == truthy(arg)
+		case "$regex":
+			var re *regexp.Regexp
+			if re, err = compileRegex(arg, ops["$options"]); err == nil {
+				ok = anyVal(vals, func(v interface{}) bool {
+					s, isString := v.(string)
+					return isString && re.MatchString(s)
+				})
+			}
+		case "$options":
+			ok = true
+		case "$size":
+			n, isNumber := asFloat(arg)
+			if !isNumber {
+				return false, fmt.Errorf("$size requires a number")
+			}
+			for _, v := range vals {
+				if l, isList := v.([]interface{}); isList && float64(len(l)) == n {
+					ok = true
+				}
+			}
+		case "$all":
+			list, isList := arg.([]interface{})
+			if !isList {
+				return false, fmt.Errorf("$all requires an array")
+			}
+			ok = len(list) > 0
+			for _, elem := range list {
+				elem := elem
+				ok = ok && anyVal(vals, func(v interface{}) bool { return equalVal(v, elem) })
+			}
+		case "$elemMatch":
+			q, isMap := asMap(arg)
+			if !isMap {
+				return false, fmt.Errorf("$elemMatch requires a document")
+			}
+			ok, err = matchElem(vals, q)
+		case "$not":
+			if _, isOps := operators(arg); !isOps {
+				if _, isRegex := arg.(bson.RegEx); !isRegex {
+					return false, fmt.Errorf("$not requires a document of operators or a regex")
+				}
+				arg = bson.M{"$regex": arg}
+			}
+			ok, err = matchVals(vals, arg)
+			ok = !ok
+		default:
+			return false, fmt.Errorf("unsupported operator %s on delta versions", op)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchElem 列表中是否有元素满足条件q，q是操作符文档时作用在元素本身，否则作用在元素的键上
+func matchElem(vals []interface{}, q map[string]interface{}) (bool, error) {
+	_, isOps := operators(q)
+	for _, v := range vals {
+		l, isList := v.([]interface{})
+		if !isList {
+			continue
+		}
+		for _, elem := range l {
+			var ok bool
+			var err error
+			if m, isMap := asMap(elem); isMap && !isOps {
+				ok, err = Match(m, q)
+			} else if isOps {
+				ok, err = matchVals([]interface{}{elem}, q)
+			}
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// compileRegex 把mongodb的正则表达式转换成go的正则表达式，支持i, m, s选项
+func compileRegex(arg, options interface{}) (*regexp.Regexp, error) {
+	var pattern, flags string
+	switch r := arg.(type) {
+	case string:
+		pattern = r
+	case bson.RegEx:
+		pattern, flags = r.Pattern, r.Options
+	default:
+		return nil, fmt.Errorf("$regex requires a string")
+	}
+	if s, ok := options.(string); ok {
+		flags += s
+	}
+	for _, f := range flags {
+		if !strings.ContainsRune("ims", f) {
+			return nil, fmt.Errorf("unsupported regex option %c on delta versions", f)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// anyVal 值或者列表中的任意元素满足f
+func anyVal(vals []interface{}, f func(interface{}) bool) bool {
+	for _, v := range vals {
+		if f(v) {
+			return true
+		}
+		if l, ok := v.([]interface{}); ok {
+			for _, elem := range l {
+				if f(elem) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// equalVal 数字按照数值比较，其他按照规范编码比较
+func equalVal(a, b interface{}) bool {
+	if x, ok := asFloat(a); ok {
+		y, ok := asFloat(b)
+		return ok && x == y
+	}
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	return canonical(a) == canonical(b)
+}
+
+// compareVal 比较同类型的数字、字符串、时间，类型不同时不可比较
+func compareVal(a, b interface{}) (int, bool) {
+	if x, ok := asFloat(a); ok {
+		y, ok := asFloat(b)
+		switch {
+		case !ok:
+			return 0, false
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return strings.Compare(x, y), ok
+	case time.Time:
+		y, ok := b.(time.Time)
+		switch {
+		case !ok:
+			return 0, false
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func truthy(v interface{}) bool {
+	if f, ok := asFloat(v); ok {
+		return f != 0
+	}
+	b, ok := v.(bool)
+	return !ok || b
+}
+
+/*
+Search 查询满足query和时间维度条件temporal的记录
+完整记录直接由mongodb按照query查询；增量记录只完整保存了标识键和保留键，
+mongodb先按照query中这部分条件(deltaQuery)选出候选的增量记录，重建之后再用Match按照完整的query过滤
+*/
+func (reg *Registry) Search(query, temporal bson.M, sess *mgo.Session) ([]bson.M, error) {
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	cond := And(query, temporal)
+	if reg.Delta != nil && len(query) > 0 {
+		deltas := And(reg.deltaQuery(query), bson.M{"_base": bson.M{"$exists": true}})
+		cond = And(temporal, bson.M{"$or": []bson.M{query, deltas}})
+	}
+
+	var docs []map[string]interface{}
+	if err := collection.Find(cond).All(&docs); err != nil {
+		return nil, err
+	}
+	encoded := make([]bool, len(docs))
+	for i, doc := range docs {
+		encoded[i] = isDelta(doc)
+	}
+	if err := reg.decode(docs, sess); err != nil {
+		return nil, err
+	}
+
+	var result []bson.M
+	for i, doc := range docs {
+		if encoded[i] {
+			ok, err := Match(doc, query)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		result = append(result, bson.M(doc))
+	}
+	return result, nil
+}
@@ -0,0 +1,490 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"reflect"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+版本迁移
+
+UpdateRegistry 修改了VerKeys, ExcludeKeys或者版本时钟(verInterval, verUnit, timeZone)时，
+已有的历史是按照旧定义生成的，需要按照新定义重写(取消增量存储时把增量记录重写为完整记录):
+	* 版本区间按照新时钟重新划分，落在同一个新区间的多个版本只保留最后的状态
+	* 按照新VerKeys不再有区别的相邻版本合并为一个版本
+	* 保留的版本按照新定义重新计算 _hash 和 _changed，增量存储的注册表重新编码为增量记录
+迁移任务保存在 <注册表>.migrations 中，后台逐个实体迁移并记录进度。
+已经迁移的实体的记录带有 _mig: <任务id> 标记，迁移写入通过日志分段完成(见prepare)，
+任务中断后(例如进程重启)从头遍历实体，跳过已经迁移的实体，继续迁移到一半的实体。
+迁移完成之前，实体在被写入(Versionize, Delete, Compact)前会先被迁移。
+
+同一时间只有一个实例执行迁移任务: 任务的 owner 为执行任务的实例，执行期间每隔MigrationHeartbeat
+更新 heartbeat。实例启动或者同步注册信息时，heartbeat 超过MigrationTimeout没有更新的任务
+通过findAndModify被接管。失去任务的实例停止迁移。
+失败的任务可以通过RestartMigration重新开始。
+*/
+
+const (
+	// MigrationRunning 迁移进行中
+	MigrationRunning = "running"
+	// MigrationDone 迁移完成
+	MigrationDone = "done"
+	// MigrationFailed 迁移失败，错误见Error
+	MigrationFailed = "failed"
+)
+
+// migrationProgressStep 每迁移多少个实体保存一次进度
+const migrationProgressStep = 100
+
+// migrationChunk 迁移一个实体时每条日志最多包含的版本数，历史很长的实体分多条日志写入
+var migrationChunk = 100
+
+var (
+	// MigrationHeartbeat 执行迁移任务的实例更新心跳的间隔
+	MigrationHeartbeat = 5 * time.Second
+	// MigrationTimeout 心跳超过这个时间没有更新时，其他实例可以接管迁移任务
+	MigrationTimeout = 30 * time.Second
+)
+
+// Migration 一次版本迁移任务
+type Migration struct {
+	ID       bson.ObjectId `json:"id" bson:"_id"`
+	Registry string        `json:"registry" bson:"registry"`
+	From     *Registry     `json:"from" bson:"from"` // 迁移前的注册信息
+	Status   string        `json:"status" bson:"status"`
+	Total    int           `json:"total" bson:"total"` // 开始时的实体数
+	Done     int           `json:"done" bson:"done"`
+	Error    string        `json:"error,omitempty" bson:"error,omitempty"`
+	Created  time.Time     `json:"created" bson:"created"`
+	Updated  time.Time     `json:"updated" bson:"updated"`
+
+	Owner     bson.ObjectId `json:"owner,omitempty" bson:"owner,omitempty"` // 执行任务的实例，见RegManager
+	Heartbeat time.Time     `json:"heartbeat" bson:"heartbeat"`
+}
+
+// needMigration 注册信息的修改是否需要迁移历史版本
+func needMigration(oldReg, newReg *Registry) bool {
+	return oldReg.VerInterval != newReg.VerInterval ||
+		oldReg.VerUnit != newReg.VerUnit ||
+		oldReg.TimeZone != newReg.TimeZone ||
+		!reflect.DeepEqual(oldReg.VerKeys, newReg.VerKeys) ||
+		!reflect.DeepEqual(oldReg.ExcludeKeys, newReg.ExcludeKeys) ||
+		(oldReg.Delta != nil && newReg.Delta == nil)
+}
+
+func (rm *RegManager) migrations(sess *mgo.Session) *mgo.Collection {
+	return sess.DB(rm.database).C(rm.collection + ".migrations")
+}
+
+// GetMigration 返回迁移任务
+func (rm *RegManager) GetMigration(id string, sess *mgo.Session) (*Migration, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("invalid migration id " + id)
+	}
+	var job Migration
+	if err := rm.migrations(sess).FindId(bson.ObjectIdHex(id)).One(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// startMigration 保存迁移任务，由本实例执行，需要在rm加锁时调用
+func (rm *RegManager) startMigration(from, reg *Registry, sess *mgo.Session) (*Migration, error) {
+	now := time.Now()
+	job := &Migration{
+		ID:        bson.NewObjectId(),
+		Registry:  reg.Name,
+		From:      from,
+		Status:    MigrationRunning,
+		Created:   now,
+		Updated:   now,
+		Owner:     rm.owner,
+		Heartbeat: now,
+	}
+	if err := rm.migrations(sess).Insert(job); err != nil {
+		return nil, err
+	}
+	reg.Migration = job.ID.Hex()
+	reg.job = job
+	return job, nil
+}
+
+// claimMigration 接管没有实例执行或者心跳超时的迁移任务，任务被其他实例执行时返回mgo.ErrNotFound
+func (rm *RegManager) claimMigration(id bson.ObjectId, sess *mgo.Session) (*Migration, error) {
+	now := time.Now()
+	var job Migration
+	_, err := rm.migrations(sess).Find(bson.M{
+		"_id":    id,
+		"status": MigrationRunning,
+		"owner":  bson.M{"$ne": rm.owner},
+		"$or": []bson.M{
+			{"heartbeat": bson.M{"$exists": false}},
+			{"heartbeat": bson.M{"$lt": now.Add(-MigrationTimeout)}},
+		},
+	}).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"owner": rm.owner, "heartbeat": now, "updated": now}},
+		ReturnNew: true,
+	}, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// resumeMigration 加载注册信息reg的迁移任务，任务没有实例执行时接管并继续执行
+func (rm *RegManager) resumeMigration(reg *Registry, sess *mgo.Session) {
+	job, err := rm.GetMigration(reg.Migration, sess)
+	if err != nil {
+		log.Println("Migration", reg.Name, err)
+		return
+	}
+	switch job.Status {
+	case MigrationDone: // 完成之后清除迁移标记之前中断
+		rm.finishMigration(reg, job, sess)
+		return
+	case MigrationFailed: // 等待重新开始，期间写入的实体仍然先被迁移
+		reg.setJob(job)
+		return
+	}
+
+	reg.setJob(job)
+	if job, err = rm.claimMigration(job.ID, sess); err == mgo.ErrNotFound {
+		return
+	} else if err != nil {
+		log.Println("Migration", reg.Name, err)
+		return
+	}
+	reg.setJob(job)
+	go rm.runMigration(reg, job, sess.Copy())
+}
+
+// resumeMigrations 接管所有注册表中没有实例执行的迁移任务
+func (rm *RegManager) resumeMigrations(sess *mgo.Session) {
+	rm.RLock()
+	var regs []*Registry
+	for _, reg := range rm.registries {
+		if reg.Migration != "" {
+			regs = append(regs, reg)
+		}
+	}
+	rm.RUnlock()
+
+	for _, reg := range regs {
+		if job := reg.migrationJob(); job != nil && job.Owner == rm.owner && job.Status == MigrationRunning {
+			continue
+		}
+		rm.resumeMigration(reg, sess)
+	}
+}
+
+// RestartMigration 重新开始失败的迁移任务，已经迁移的实体会被跳过
+func (rm *RegManager) RestartMigration(id string, sess *mgo.Session) (*Migration, error) {
+	job, err := rm.GetMigration(id, sess)
+	if err != nil {
+		return nil, err
+	}
+	reg := rm.getRegByName(job.Registry)
+	if reg == nil || reg.Migration != job.ID.Hex() {
+		return nil, errors.New("migration " + id + " is not the current migration of " + job.Registry)
+	}
+
+	now := time.Now()
+	_, err = rm.migrations(sess).Find(bson.M{"_id": job.ID, "status": MigrationFailed}).Apply(mgo.Change{
+		Update: bson.M{
+			"$set":   bson.M{"status": MigrationRunning, "owner": rm.owner, "heartbeat": now, "updated": now},
+			"$unset": bson.M{"error": ""},
+		},
+		ReturnNew: true,
+	}, job)
+	if err == mgo.ErrNotFound {
+		return nil, errors.New("migration " + id + " has not failed")
+	} else if err != nil {
+		return nil, err
+	}
+	reg.setJob(job)
+	go rm.runMigration(reg, job, sess.Copy())
+	return job, nil
+}
+
+// heartbeat 定时更新迁移任务的心跳，任务被其他实例接管时关闭lost，阻塞直到stop被关闭
+func (rm *RegManager) heartbeat(job *Migration, stop <-chan struct{}, lost chan<- struct{}, sess *mgo.Session) {
+	defer sess.Close()
+	ticker := time.NewTicker(MigrationHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := rm.migrations(sess).Update(
+			bson.M{"_id": job.ID, "owner": rm.owner, "status": MigrationRunning},
+			bson.M{"$set": bson.M{"heartbeat": time.Now()}},
+		)
+		if err == mgo.ErrNotFound {
+			close(lost)
+			return
+		} else if err != nil {
+			log.Println("Migration", job.ID.Hex(), err)
+		}
+	}
+}
+
+// runMigration 逐个迁移实体，完成后清除迁移标记，任务被其他实例接管时停止
+func (rm *RegManager) runMigration(reg *Registry, job *Migration, sess *mgo.Session) {
+	defer sess.Close()
+
+	stop, lost := make(chan struct{}), make(chan struct{})
+	defer close(stop)
+	go rm.heartbeat(job, stop, lost, sess.Copy())
+
+	// 只有持有任务时才能保存进度
+	owned := bson.M{"_id": job.ID, "owner": rm.owner, "status": MigrationRunning}
+	save := func(update bson.M) bool {
+		update["updated"] = time.Now()
+		err := rm.migrations(sess).Update(owned, bson.M{"$set": update})
+		if err == mgo.ErrNotFound {
+			log.Println("Migration", job.ID.Hex(), "was taken over by another instance")
+			return false
+		} else if err != nil {
+			log.Println("Migration", job.ID.Hex(), err)
+		}
+		return true
+	}
+
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	total, err := collection.Find(bson.M{"_is_latest": true}).Count()
+	if err != nil {
+		save(bson.M{"status": MigrationFailed, "error": err.Error()})
+		return
+	}
+	if !save(bson.M{"total": total, "done": 0}) {
+		return
+	}
+
+	done := 0
+	iter := collection.Find(bson.M{"_is_latest": true}).Select(reg.keyFields()).Iter()
+	var doc map[string]interface{}
+	for iter.Next(&doc) {
+		select {
+		case <-lost:
+			iter.Close()
+			log.Println("Migration", job.ID.Hex(), "was taken over by another instance")
+			return
+		default:
+		}
+		if key, err := reg.EntityKey(doc); err == nil {
+			var unlock func()
+			if unlock, err = reg.lockEntity(key, sess); err == nil {
+				err = reg.prepare(key, sess)
+				unlock()
+			}
+			if err != nil {
+				iter.Close()
+				save(bson.M{"status": MigrationFailed, "error": err.Error(), "done": done})
+				return
+			}
+		}
+		done++
+		if done%migrationProgressStep == 0 && !save(bson.M{"done": done}) {
+			iter.Close()
+			return
+		}
+		doc = nil
+	}
+	if err = iter.Close(); err != nil {
+		save(bson.M{"status": MigrationFailed, "error": err.Error(), "done": done})
+		return
+	}
+
+	// 先标记完成，之后任务不会再被接管
+	if save(bson.M{"status": MigrationDone, "done": done}) {
+		rm.finishMigration(reg, job, sess)
+	}
+}
+
+/*
+finishMigration 清除注册信息和记录中已经完成的迁移任务的标记
+注册信息的修订号加1，其他实例同步注册信息时清除迁移任务，见registry_sync.go
+只有迁移标记仍然是job时才修改注册信息，多个实例同时清除时只修改一次
+*/
+func (rm *RegManager) finishMigration(reg *Registry, job *Migration, sess *mgo.Session) {
+	reg.Lock()
+	if reg.Migration == job.ID.Hex() {
+		reg.Migration = ""
+		reg.job = nil
+	}
+	reg.Unlock()
+
+	update := bson.M{"$unset": bson.M{"migration": ""}, "$inc": bson.M{"revision": int64(1)}}
+	err := sess.DB(rm.database).C(rm.collection).Update(bson.M{"_id": reg.ID, "migration": job.ID.Hex()}, update)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println("Migration", job.ID.Hex(), err)
+	}
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	marked := bson.M{"$or": []bson.M{{"_mig": job.ID}, {"_migp": job.ID}}}
+	if _, err = collection.UpdateAll(marked, bson.M{"$unset": bson.M{"_mig": "", "_migp": ""}}); err != nil {
+		log.Println("Migration", job.ID.Hex(), err)
+	}
+}
+
+/*
+prepare 写入实体key之前调用: 重放未完成的日志，迁移未迁移的实体，需要在锁定实体时调用
+
+实体的历史按照版本顺序分段迁移，每段最多migrationChunk个旧版本，通过一条日志写入，避免日志超过16MB。
+已经重写的版本带有 _migp: <任务id> 标记，中断后从这些版本和剩余的旧版本继续，结果和一次迁移相同。
+增量存储的注册表在全部版本重写之后从新到旧分段编码(从新到旧时，被替换的基准还没有依赖它的增量记录)，
+最后在最新版本上写入 _mig 标记表示实体迁移完成
+*/
+func (reg *Registry) prepare(key interface{}, sess *mgo.Session) error {
+	if err := reg.recover(bson.M{"key": key}, sess); err != nil {
+		return err
+	}
+	job := reg.migrationJob()
+	if job == nil {
+		return nil
+	}
+
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	n, err := collection.Find(And(reg.keyQuery(key), bson.M{"_mig": job.ID})).Count()
+	if err != nil || n > 0 {
+		return err
+	}
+	// 已经重写的版本按照新定义排序，剩余的旧版本按照旧定义排序
+	var kept, pending []map[string]interface{}
+	if err = collection.Find(And(reg.keyQuery(key), bson.M{"_migp": job.ID})).Sort("_ver").All(&kept); err != nil {
+		return err
+	}
+	if err = collection.Find(And(reg.keyQuery(key), bson.M{"_migp": bson.M{"$ne": job.ID}})).Sort("_ver").All(&pending); err != nil {
+		return err
+	}
+	if len(kept)+len(pending) == 0 {
+		return nil
+	}
+	stored := map[interface{}]interface{}{} // 已经重写的版本保存的_base
+	for _, doc := range kept {
+		stored[doc["_id"]] = doc["_base"]
+	}
+	if err = reg.decode(kept, sess); err != nil {
+		return err
+	}
+	if err = reg.decode(pending, sess); err != nil {
+		return err
+	}
+
+	low := len(kept) // kept[low:]是这一段新增或者修改的版本
+	var removed []interface{}
+	for i, doc := range pending {
+		var r []interface{}
+		kept, r = reg.reversionStep(job.From, kept, doc)
+		removed = append(removed, r...)
+		if len(kept) < low+2 {
+			if low = len(kept) - 2; low < 0 {
+				low = 0
+			}
+		}
+		if (i+1)%migrationChunk != 0 && i != len(pending)-1 {
+			continue
+		}
+
+		reg.rehash(kept, low)
+		ops := make([]journalOp, 0, len(removed)+len(kept)-low)
+		for _, id := range removed {
+			ops = append(ops, removeOp(id))
+		}
+		for _, doc := range kept[low:] {
+			doc["_migp"] = job.ID
+			stored[doc["_id"]] = nil
+			ops = append(ops, insertOp(doc))
+		}
+		if err = reg.commit(key, sess, ops...); err != nil {
+			return err
+		}
+		low, removed = len(kept), nil
+	}
+
+	encoded := append([]map[string]interface{}(nil), kept...)
+	reg.encodeHistory(key, encoded)
+	var ops []journalOp
+	for i := len(encoded) - 1; i >= 0; i-- {
+		if doc := encoded[i]; doc["_base"] != stored[doc["_id"]] {
+			ops = append(ops, insertOp(doc))
+		}
+		if len(ops) == migrationChunk || (i == 0 && len(ops) > 0) {
+			if err = reg.commit(key, sess, ops...); err != nil {
+				return err
+			}
+			ops = nil
+		}
+	}
+	return reg.commit(key, sess, setOp(kept[len(kept)-1]["_id"], bson.M{"_mig": job.ID}))
+}
+
+/*
+reversion 把按照from的定义生成、按_ver排序的完整历史版本docs转换成当前定义的版本，
+返回保留的版本(已修改_ver, _next，按照当前定义重新计算_hash, _changed)和被合并的版本的_id
+*/
+func (reg *Registry) reversion(from *Registry, docs []map[string]interface{}) (kept []map[string]interface{}, removed []interface{}) {
+	for _, doc := range docs {
+		var r []interface{}
+		kept, r = reg.reversionStep(from, kept, doc)
+		removed = append(removed, r...)
+	}
+	reg.rehash(kept, 0)
+	return kept, removed
+}
+
+// reversionStep 把下一个旧版本doc转换后追加到已经转换的版本kept，只会修改kept的最后一个版本，返回被合并的版本的_id
+func (reg *Registry) reversionStep(from *Registry, kept []map[string]interface{}, doc map[string]interface{}) ([]map[string]interface{}, []interface{}) {
+	var removed []interface{}
+	start := from.VerTime(asInt64(doc["_ver"]))
+	end := from.VerTime(asInt64(doc["_next"]) + 1).Add(-time.Nanosecond)
+	doc["_ver"], doc["_next"] = reg.VerAt(start), reg.VerAt(end)
+
+	// 和前面的版本落在同一个区间时，后面的状态覆盖前面的状态
+	for len(kept) > 0 {
+		last := kept[len(kept)-1]
+		if asInt64(last["_next"]) < asInt64(doc["_ver"]) {
+			break
+		}
+		last["_next"] = asInt64(doc["_ver"]) - 1
+		if asInt64(last["_next"]) >= asInt64(last["_ver"]) {
+			break
+		}
+		kept = kept[:len(kept)-1]
+		removed = append(removed, last["_id"])
+	}
+
+	// 相邻且按照新VerKeys没有区别的版本合并到后一个版本
+	if len(kept) > 0 {
+		last := kept[len(kept)-1]
+		if asInt64(last["_next"])+1 == asInt64(doc["_ver"]) && !reg.differs(last, doc) {
+			doc["_ver"] = last["_ver"]
+			kept = kept[:len(kept)-1]
+			removed = append(removed, last["_id"])
+		}
+	}
+	return append(kept, doc), removed
+}
+
+// rehash 哈希和变化的VerKeys是按照旧定义计算的，按照当前定义重新计算kept[from:]
+func (reg *Registry) rehash(kept []map[string]interface{}, from int) {
+	for i := from; i < len(kept); i++ {
+		doc := kept[i]
+		if isDeleted(doc) {
+			delete(doc, Hash)
+		} else {
+			doc[Hash] = reg.ContentHash(doc)
+		}
+		var prev map[string]interface{}
+		if i > 0 {
+			prev = kept[i-1]
+		}
+		reg.setChanged(prev, doc)
+	}
+}
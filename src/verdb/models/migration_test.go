@@ -0,0 +1,295 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReversion(t *testing.T) {
+	from := &Registry{VerInterval: Hourly, VerKeys: []VerKey{{Path: "a"}, {Path: "b"}}}
+	reg := &Registry{VerUnit: Day, VerKeys: []VerKey{{Path: "a"}}}
+
+	h := func(day, hour int64) int64 { return day*24 + hour }
+	ranges := []struct {
+		ver, next int64
+		a, b      int
+	}{
+		{h(0, 0), h(0, 9), 1, 1},  // 第0天: 被同一天后面的状态覆盖
+		{h(0, 10), h(1, 3), 2, 1}, // 第0天最后的状态，到第1天结束
+		{h(1, 4), h(1, 23), 2, 2}, // 只有b改变，和前一个版本合并
+		{h(2, 0), h(2, 5), 3, 1},  // 第2天被覆盖
+		{h(2, 6), h(3, 23), 3, 2}, // 第2-3天
+		{h(4, 0), h(4, 12), 4, 1}, // 最新版本
+	}
+	var docs []map[string]interface{}
+	for i, r := range ranges {
+		docs = append(docs, map[string]interface{}{"_id": i, "_ver": r.ver, "_next": r.next, "a": r.a, "b": r.b})
+	}
+
+	kept, removed := reg.reversion(from, docs)
+	if !reflect.DeepEqual(removed, []interface{}{0, 1, 3}) {
+		t.Errorf("合并的版本错误 %v\n", removed)
+		return
+	}
+	var got [][]interface{}
+	for _, doc := range kept {
+		got = append(got, []interface{}{doc["_id"], doc["_ver"], doc["_next"]})
+	}
+	expected := [][]interface{}{{2, int64(0), int64(1)}, {4, int64(2), int64(3)}, {5, int64(4), int64(4)}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("迁移后的版本错误\n%v\n%v\n", got, expected)
+		return
+	}
+
+	// 哈希和变化的VerKeys按照新定义重新计算
+	for i, doc := range kept {
+		if doc[Hash] != reg.ContentHash(doc) {
+			t.Errorf("第%d个版本的哈希没有重新计算\n", i)
+			return
+		}
+	}
+	if _, ok := kept[0][ChangedKey]; ok || !reflect.DeepEqual(kept[1][ChangedKey], []string{"a"}) || !reflect.DeepEqual(kept[2][ChangedKey], []string{"a"}) {
+		t.Errorf("变化的VerKeys错误 %v %v %v\n", kept[0][ChangedKey], kept[1][ChangedKey], kept[2][ChangedKey])
+		return
+	}
+}
+
+func TestMigrationClaim(t *testing.T) {
+	const (
+		database   = "metaInfo"
+		collection = "migrationclaim"
+	)
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+	sess.DB(database).C(collection).DropCollection()
+	sess.DB(database).C(collection + ".migrations").DropCollection()
+
+	rm1 := NewRegManger(database, collection, sess)
+	rm2 := NewRegManger(database, collection, sess)
+	now := time.Now()
+	job := &Migration{ID: bson.NewObjectId(), Status: MigrationRunning, Owner: rm1.owner, Heartbeat: now}
+	if err = rm1.migrations(sess).Insert(job); err != nil {
+		t.Errorf("保存迁移任务失败 %v\n", err)
+		return
+	}
+
+	// 心跳没有超时时不能接管，持有者自己也不能重复接管
+	if _, err = rm2.claimMigration(job.ID, sess); err != mgo.ErrNotFound {
+		t.Errorf("接管了正在执行的迁移任务 %v\n", err)
+		return
+	}
+	if _, err = rm1.claimMigration(job.ID, sess); err != mgo.ErrNotFound {
+		t.Errorf("重复接管了自己的迁移任务 %v\n", err)
+		return
+	}
+
+	// 心跳超时之后只有一个实例能接管
+	rm1.migrations(sess).UpdateId(job.ID, bson.M{"$set": bson.M{"heartbeat": now.Add(-2 * MigrationTimeout)}})
+	claimed, err := rm2.claimMigration(job.ID, sess)
+	if err != nil || claimed.Owner != rm2.owner {
+		t.Errorf("接管心跳超时的迁移任务失败 %+v %v\n", claimed, err)
+		return
+	}
+	if _, err = rm1.claimMigration(job.ID, sess); err != mgo.ErrNotFound {
+		t.Errorf("迁移任务被接管了两次 %v\n", err)
+		return
+	}
+
+	// 失败的任务不会被接管
+	rm1.migrations(sess).UpdateId(job.ID, bson.M{"$set": bson.M{"status": MigrationFailed, "heartbeat": now.Add(-2 * MigrationTimeout)}})
+	if _, err = rm1.claimMigration(job.ID, sess); err != mgo.ErrNotFound {
+		t.Errorf("接管了失败的迁移任务 %v\n", err)
+		return
+	}
+}
+
+func TestMigration(t *testing.T) {
+	const (
+		database   = "metaInfo"
+		collection = "migrations"
+	)
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+	sess.DB(database).C(collection).DropCollection()
+	sess.DB(database).C(collection + ".migrations").DropCollection()
+
+	rm := NewRegManger(database, collection, sess)
+	reg, err := rm.CreateRegistry(&Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testmigration",
+		CompareKey:     "pk",
+		VerInterval:    Hourly,
+		VerKeys:        []VerKey{{Path: "a"}, {Path: "b"}},
+	}, sess)
+	if err != nil {
+		t.Errorf("注册失败 %v\n", err)
+		return
+	}
+	data := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	data.DropCollection()
+
+	// 每个实体在同一天内产生24个版本
+	start := time.Now().UTC().Truncate(Daily*time.Second).AddDate(0, 0, -3)
+	for pk := 0; pk < 10; pk++ {
+		for i := 0; i < 24; i++ {
+			observed := start.Add(time.Duration(i) * time.Hour).Format(time.RFC3339)
+			doc := map[string]interface{}{"pk": pk, "a": i / 12, "b": i, ObservedAt: observed}
+			if _, err = reg.Versionize(doc, sess); err != nil {
+				t.Errorf("版本化失败 %v\n", err)
+				return
+			}
+		}
+	}
+
+	nreg, err := rm.UpdateRegistry(reg.ID.Hex(), &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testmigration",
+		CompareKey:     "pk",
+		VerUnit:        Day,
+		VerKeys:        []VerKey{{Path: "a"}},
+	}, sess)
+	if err != nil || nreg.Migration == "" {
+		t.Errorf("修改注册信息没有开始迁移 %v\n", err)
+		return
+	}
+
+	var job *Migration
+	for i := 0; i < 100; i++ {
+		if job, err = rm.GetMigration(nreg.Migration, sess); err == nil && job.Status != MigrationRunning {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if job == nil || job.Status != MigrationDone || job.Done != 10 || job.Total != 10 {
+		t.Errorf("迁移任务状态错误 %+v %v\n", job, err)
+		return
+	}
+
+	var docs []bson.M
+	data.Find(bson.M{"pk": 0}).Sort("_ver").All(&docs)
+	if len(docs) != 1 || asInt64(docs[0]["_ver"]) != reg.VerAt(start)/24 || docs[0]["_mig"] != nil {
+		t.Errorf("迁移后的版本错误 %v\n", docs)
+		return
+	}
+	if rm.GetReg("testdb", "testmigration").Migration != "" {
+		t.Errorf("迁移完成后没有清除迁移标记\n")
+		return
+	}
+}
+
+func TestMigrationChunks(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testmigrationchunks",
+		Name:           "testdb/testmigrationchunks",
+		CompareKey:     "pk",
+		VerInterval:    Hourly,
+		VerKeys:        []VerKey{{Path: "a"}, {Path: "b"}},
+		Delta:          &Delta{SnapshotEvery: 3},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+	data := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	data.DropCollection()
+	reg.journal(sess).DropCollection()
+
+	// 两个实体有相同的历史: 3天内每小时一个版本
+	start := time.Now().UTC().Truncate(Daily*time.Second).AddDate(0, 0, -4)
+	for pk := 0; pk < 2; pk++ {
+		for i := 0; i < 72; i++ {
+			observed := start.Add(time.Duration(i) * time.Hour).Format(time.RFC3339)
+			doc := map[string]interface{}{"pk": pk, "a": i / 5, "b": i, ObservedAt: observed}
+			if _, err = reg.Versionize(doc, sess); err != nil {
+				t.Errorf("版本化失败 %v\n", err)
+				return
+			}
+		}
+	}
+
+	from := &Registry{VerInterval: Hourly, VerKeys: reg.VerKeys}
+	reg.VerInterval, reg.VerUnit, reg.VerKeys = 0, Day, []VerKey{{Path: "a"}}
+	job := &Migration{ID: bson.NewObjectId(), From: from}
+	reg.setJob(job)
+	defer func() {
+		migrationChunk, commitHook = 100, nil
+	}()
+
+	// 实体0一次迁移，实体1每段3个版本，中途出错后继续
+	if err = reg.prepare(0, sess); err != nil {
+		t.Errorf("迁移失败 %v\n", err)
+		return
+	}
+	migrationChunk = 3
+	commits, most := 0, 0
+	commitHook = func(i int) error {
+		if i > most {
+			most = i
+		}
+		if i == 0 {
+			if commits++; commits == 4 {
+				return errors.New("crash")
+			}
+		}
+		return nil
+	}
+	if err = reg.prepare(1, sess); err == nil {
+		t.Errorf("注入的错误没有返回\n")
+		return
+	}
+	if err = reg.prepare(1, sess); err != nil {
+		t.Errorf("继续迁移失败 %v\n", err)
+		return
+	}
+	commitHook = nil
+	if most >= 2*migrationChunk+2 {
+		t.Errorf("一条日志包含%d个操作\n", most+1)
+		return
+	}
+
+	history := func(pk int) []interface{} {
+		var docs []map[string]interface{}
+		data.Find(bson.M{"pk": pk}).Sort("_ver").All(&docs)
+		var got []interface{}
+		for _, doc := range docs {
+			got = append(got, []interface{}{doc["_ver"], doc["_next"], doc["_delta"] != nil, doc[Hash], doc[ChangedKey]})
+		}
+		if err := reg.decode(docs, sess); err != nil {
+			t.Errorf("重建失败 %v\n", err)
+		}
+		for _, doc := range docs {
+			got = append(got, []interface{}{doc["a"], doc["b"]})
+		}
+		return got
+	}
+	if expected, got := history(0), history(1); len(expected) == 0 || !reflect.DeepEqual(got, expected) {
+		t.Errorf("分段迁移的结果和一次迁移不同\n%v\n%v\n", got, expected)
+		return
+	}
+	if n, _ := data.Find(bson.M{"pk": 1, "_mig": job.ID}).Count(); n != 1 {
+		t.Errorf("迁移完成标记错误 %d\n", n)
+		return
+	}
+}
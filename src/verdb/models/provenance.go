@@ -0,0 +1,87 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+提交来源
+
+每个版本在保留键 _meta 中记录生成它的提交:
+
+	"_meta": {
+		"source": "collector-bj-03",     // 采集端或者脚本的标识
+		"submitted": ISODate(...),       // 提交时间
+		"clientIp": "10.0.0.3",
+		"requestId": "5c1f..."           // 可选，来自请求头
+	}
+
+_meta 以"_"开头，不参与比对，VerKeys, UpdateKeys, ExcludeKeys 中不能使用。
+版本被延长(extend)时保留生成版本的提交的来源，同一个Interval中被更新(update)时记录最后一次提交的来源。
+*/
+
+// MetaKey 提交来源保留键
+const MetaKey = "_meta"
+
+// Meta 一次提交的来源
+type Meta struct {
+	Source    string    `json:"source,omitempty" bson:"source,omitempty"`
+	Submitted time.Time `json:"submitted" bson:"submitted"`
+	ClientIP  string    `json:"clientIp,omitempty" bson:"clientIp,omitempty"`
+	RequestID string    `json:"requestId,omitempty" bson:"requestId,omitempty"`
+}
+
+// withMeta 返回写入记录的来源拷贝，meta为空时只记录提交时间
+func withMeta(meta *Meta) *Meta {
+	m := Meta{}
+	if meta != nil {
+		m = *meta
+	}
+	if m.Submitted.IsZero() {
+		m.Submitted = time.Now()
+	}
+	return &m
+}
+
+// isMetaPath 路径是否在_meta中
+func isMetaPath(path string) bool {
+	return path == MetaKey || strings.HasPrefix(path, MetaKey+".")
+}
+
+// validateMetaPath 保留键不能作为VerKeys, UpdateKeys, ExcludeKeys
+func validateMetaPath(path string) error {
+	if isMetaPath(path) {
+		return errors.New(MetaKey + " is reserved for provenance")
+	}
+	return nil
+}
+
+// MetaFilter 按照提交来源过滤版本，空条件会被忽略
+type MetaFilter struct {
+	Source string
+	Since  *time.Time // 提交时间 >= Since
+	Until  *time.Time // 提交时间 < Until
+}
+
+// Query 返回过滤条件对应的mongodb查询条件
+func (f MetaFilter) Query() bson.M {
+	query := bson.M{}
+	if f.Source != "" {
+		query[MetaKey+".source"] = f.Source
+	}
+	submitted := bson.M{}
+	if f.Since != nil {
+		submitted["$gte"] = *f.Since
+	}
+	if f.Until != nil {
+		submitted["$lt"] = *f.Until
+	}
+	if len(submitted) > 0 {
+		query[MetaKey+".submitted"] = submitted
+	}
+	return query
+}
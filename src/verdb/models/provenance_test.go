@@ -0,0 +1,101 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMetaFilter(t *testing.T) {
+	since := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	until := since.Add(24 * time.Hour)
+
+	if q := (MetaFilter{}).Query(); len(q) != 0 {
+		t.Errorf("空条件生成了查询 %v\n", q)
+	}
+	q := MetaFilter{Source: "collector-bj-03", Since: &since, Until: &until}.Query()
+	expected := bson.M{
+		"_meta.source":    "collector-bj-03",
+		"_meta.submitted": bson.M{"$gte": since, "$lt": until},
+	}
+	if !reflect.DeepEqual(q, expected) {
+		t.Errorf("过滤条件错误 %v\n", q)
+	}
+
+	// _meta 是保留键，增量版本中完整保存，可以直接查询
+	reg := &Registry{DatabaseName: "testdb", CollectionName: "testmeta", CompareKey: "pk", VerKeys: []VerKey{{Path: "_meta.source"}}}
+	if !reg.storedOnDelta(q) {
+		t.Errorf("增量版本不能按来源过滤\n")
+	}
+	if err := reg.validate(); err == nil {
+		t.Errorf("VerKeys使用_meta没有报错\n")
+	}
+}
+
+func TestVersionizeMeta(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testmeta",
+		Name:           "testdb/testmeta",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	start := time.Now().Add(-time.Second)
+	sources := []string{"collector-bj-03", "collector-sh-01", "collector-bj-03"}
+	for i, source := range sources {
+		doc := map[string]interface{}{"pk": 1, "a": i, MetaKey: &Meta{Source: source, ClientIP: "10.0.0.3", RequestID: "req"}}
+		if _, err := reg.Versionize(doc, sess); err != nil {
+			t.Errorf("第%d条记录处理失败 %v\n", i, err)
+			return
+		}
+	}
+
+	// 每个版本记录生成它的提交的来源
+	var latest bson.M
+	collection.Find(And(bson.M{"pk": 1}, Latest())).One(&latest)
+	meta, _ := latest[MetaKey].(bson.M)
+	if meta["source"] != "collector-bj-03" || meta["clientIp"] != "10.0.0.3" || meta["requestId"] != "req" {
+		t.Errorf("最新版本的提交来源错误 %v\n", latest)
+		return
+	}
+	if submitted, ok := meta["submitted"].(time.Time); !ok || submitted.Before(start) {
+		t.Errorf("提交时间错误 %v\n", meta["submitted"])
+		return
+	}
+
+	// 按照来源和提交时间过滤历史版本
+	versions, total, err := reg.History(1, HistoryQuery{Meta: MetaFilter{Source: "collector-bj-03", Since: &start}}, sess)
+	if err != nil || total != 2 || versions[0].Doc["a"] != 0 || versions[1].Doc["a"] != 2 {
+		t.Errorf("按来源过滤历史版本错误 %v %v %v\n", versions, total, err)
+		return
+	}
+	future := time.Now().Add(time.Hour)
+	if _, total, _ = reg.History(1, HistoryQuery{Meta: MetaFilter{Since: &future}}, sess); total != 0 {
+		t.Errorf("按提交时间过滤历史版本错误 %d\n", total)
+		return
+	}
+
+	// 删除标记记录删除请求的来源
+	reg.Delete(1, &Meta{Source: "admin"}, sess)
+	if n, _ := collection.Find(bson.M{"pk": 1, Deleted: true, "_meta.source": "admin"}).Count(); n != 1 {
+		t.Errorf("删除标记的提交来源错误 %d\n", n)
+		return
+	}
+}
@@ -1,8 +1,8 @@
 package models
 
 import (
+	"errors"
 	"fmt"
-	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -18,7 +18,7 @@ const (
 	Daily = 24 * Hourly
 	// Weekly 一个星期包含的秒数
 	Weekly = 7 * Daily
-	// Monthly 一个月包含的秒数
+	// Monthly 按30天计算的一个月包含的秒数，按自然月划分版本请使用 verUnit: month
 	Monthly = 30 * Daily
 )
 
@@ -28,18 +28,31 @@ Registry 注册模型
 	"databaseName" : "frradar", // 目标数据库
 	"collectionName" : "serverInfo", // 目标集合
 	"name" : "frradar/serverInfo", // 命名方式： databaseName/collectionName
-	"compareKey" : "serverId", // 用来标识同一个实体
+	"revision" : 3, // 修订号，由服务端维护，见registry_sync.go
+	"compareKey" : "serverId", // 用来标识同一个实体，可以是嵌套路径
+	"compareKeys": ["vendor", "serialNumber"], // 多个键共同标识实体时使用，和compareKey只能设置一个
 	'verInterval': 24 * 60 * 60, // 版本粒度，示例为一天记录一个版本
+	"verUnit": "day", // 按日历划分版本: day, week, month，设置后忽略verInterval
+	"timeZone": "Asia/Shanghai", // verUnit的时区，默认UTC
 	"indexKeys" : [ // 需要添加index的键
 		"xxx.xxx",
 		"xxx.xxxxx",
 		...
 	],
-	"verKeys" : [ // 需要版本化记录的建
+	"verKeys" : [ // 需要版本化记录的建，列表的比对方式见VerKey
 		"xxx.xxx",
 		"xx.xxx.xx",
+		{"path": "disks", "strategy": "keyed", "by": "serial"},
 		...
-	]
+	],
+	"updateKeys" : [ // 值改变时不产生新版本的键，见UpdateKey
+		"owner",
+		{"path": "meta.location", "scope": "all"},
+		...
+	],
+	"excludeKeys" : ["uptime", "loadAvg"], // 不参与比对的键，verKeys中可以使用模式，见glob.go
+	"retention": {"keepDays": 30, "downsample": "day", "deleteDays": 365}, // 历史版本保留策略，见Retention
+	"delta": {"snapshotEvery": 10} // 历史版本增量存储，见Delta
 }
 */
 type Registry struct {
@@ -48,18 +61,68 @@ type Registry struct {
 	DatabaseName   string        `json:"databaseName" bson:"databaseName" binding:"required"`
 	CollectionName string        `json:"collectionName" bson:"collectionName" binding:"required"`
 	Name           string        `json:"name" bson:"name"`
-	CompareKey     string        `json:"compareKey" bson:"compareKey" binding:"required"`
-	VerInterval    int64         `json:"verInterval" bson:"verInterval" binding:"required"`
+	CompareKey     string        `json:"compareKey" bson:"compareKey"`
+	CompareKeys    []string      `json:"compareKeys" bson:"compareKeys"`
+	VerInterval    int64         `json:"verInterval" bson:"verInterval"`
+	VerUnit        string        `json:"verUnit" bson:"verUnit"`
+	TimeZone       string        `json:"timeZone" bson:"timeZone"`
 	IndexKeys      []string      `json:"indexKeys" bson:"indexKeys"`
-	VerKeys        []string      `json:"verKeys" bson:"verKeys"`
+	VerKeys        []VerKey      `json:"verKeys" bson:"verKeys"`
+	UpdateKeys     []UpdateKey   `json:"updateKeys" bson:"updateKeys"`
+	ExcludeKeys    []string      `json:"excludeKeys" bson:"excludeKeys"` // 不参与比对的路径，见glob.go
+	Retention      *Retention    `json:"retention,omitempty" bson:"retention,omitempty"`
+	Delta          *Delta        `json:"delta,omitempty" bson:"delta,omitempty"` // 增量存储，见delta.go
+	Migration      string        `json:"migration,omitempty" bson:"migration,omitempty"` // 进行中的迁移任务id，见migration.go
+	Revision       int64         `json:"revision" bson:"revision"`                       // 修订号，每次修改加1，见registry_sync.go
+
+	job *Migration // 进行中的迁移任务
 }
 
-// GenVer 基于VerInterval生成版本号: unix seconds / interval
+// GenVer 基于版本时钟生成当前时间的版本号，见clock.go
 func (reg *Registry) GenVer() int64 {
-	if reg.VerInterval <= 0 { // 用于测试时生成新版本
-		return time.Now().UnixNano()
+	return reg.VerAt(time.Now())
+}
+
+// validate 检查注册信息是否完整
+func (reg *Registry) validate() error {
+	if reg.DatabaseName == "" || reg.CollectionName == "" || (reg.CompareKey == "" && len(reg.CompareKeys) == 0) {
+		return errors.New("db_name, db_name, compare_key cant be empty")
+	}
+	if err := reg.validateCompareKeys(); err != nil {
+		return err
+	}
+	if len(reg.VerKeys) == 0 {
+		return errors.New("ver_keys cant be empty")
+	}
+	for _, key := range reg.VerKeys {
+		if err := key.validate(); err != nil {
+			return err
+		}
+	}
+	for _, key := range reg.UpdateKeys {
+		if err := key.validate(reg.VerKeys); err != nil {
+			return err
+		}
+	}
+	for _, path := range reg.ExcludeKeys {
+		if path == "" {
+			return errors.New("exclude key path cant be empty")
+		}
+		if err := validateMetaPath(path); err != nil {
+			return err
+		}
+	}
+	if reg.Retention != nil {
+		if err := reg.Retention.validate(); err != nil {
+			return err
+		}
+	}
+	if reg.Delta != nil {
+		if err := reg.Delta.validate(); err != nil {
+			return err
+		}
 	}
-	return int64(time.Now().Second()) / reg.VerInterval
+	return reg.validateClock()
 }
 
 // GenName 基于DatabaseName, CollectionName生成name
@@ -67,11 +130,34 @@ func (reg *Registry) GenName() string {
 	return fmt.Sprintf("%s/%s", reg.DatabaseName, reg.CollectionName)
 }
 
+const (
+	// ActionInsert 实体的第一个版本
+	ActionInsert = "insert"
+	// ActionUpdate 和最新版本在同一个Interval中，更新最新版本
+	ActionUpdate = "update"
+	// ActionExtend 版本化键没有改变，延长最新版本的有效区间
+	ActionExtend = "extend"
+	// ActionVersion 版本化键发生改变，生成新版本
+	ActionVersion = "version"
+	// ActionUndo 撤销最新版本，前一个版本成为最新版本
+	ActionUndo = "undo"
+)
+
+// Outcome 一次Versionize的处理结果
+type Outcome struct {
+	Action  string   `json:"action"`
+	Ver     int64    `json:"ver"`
+	Prev    int64    `json:"prev,omitempty"`    // 生成新版本时，被比对的老版本的_ver
+	Changed []string `json:"changed,omitempty"` // 生成新版本时，发生改变的VerKeys
+	Hash    string   `json:"hash,omitempty"`    // 提交记录的内容哈希，见hash.go
+}
+
 /*
 Versionize 版本化记录数据
 1. 对于提交的记录，添加_ver,_next生成新版本new
-2. new的格式是{CompareKey: <int|string>, _ver: <int>, _next: <int>} 且 new._ver 相同于 new._next
-3. 在数据库中查询相同CompareKey，且_next最大的版本old
+2. new的格式是{CompareKey: <int|string>, _ver: <int>, _next: <int>} 且 new._ver 相同于 new._next，
+   缺少标识键的记录返回错误，多个标识键见comparekey.go
+3. 在数据库中查询相同实体key，且_next最大的版本old
 4. 如果 old._ver 相同于 new._ver
 	* 用new的内容跟新old，然后返回
 5. 如果 old 相同于 new
@@ -79,13 +165,66 @@ Versionize 版本化记录数据
 6 如果 old 不同于 new
 	* 更新old版本的_next为new的_ver
 	* 插入new，然后返回
+记录中带有观测时间(_observed_at)时，使用观测时间生成版本号，
+观测时间早于old._next时回填到历史版本中，见backfill.go
+每一步的写入和处理结果的变更日志通过日志(journal)保证原子性，见journal.go, changelog.go
+写入期间只锁定该实体，不同实体可以并发写入，见lease.go
+新版本的 _changed 记录发生改变的VerKeys，见churn.go
+更新键(UpdateKeys)不参与比对，见updatekey.go
+提交来源通过 newDoc[MetaKey] = *Meta 传入，保存在 _meta 中，见provenance.go
 */
-func (reg *Registry) Versionize(newDoc map[string]interface{}, sess *mgo.Session) error {
-	reg.Lock()
-	defer reg.Unlock()
+func (reg *Registry) Versionize(newDoc map[string]interface{}, sess *mgo.Session) (Outcome, error) {
+	key, err := reg.EntityKey(newDoc)
+	if err != nil {
+		return Outcome{}, err
+	}
+	unlock, err := reg.lockEntity(key, sess)
+	if err != nil {
+		return Outcome{}, err
+	}
+	defer unlock()
+
+	outcome, err := reg.versionize(newDoc, sess)
+	outcome.Hash, _ = newDoc[Hash].(string)
+	return outcome, err
+}
+
+// versionize 和Versionize相同，需要在锁定实体时调用
+func (reg *Registry) versionize(newDoc map[string]interface{}, sess *mgo.Session) (Outcome, error) {
+	// 先完成该实体上次未完成的写入和迁移
+	key, err := reg.EntityKey(newDoc)
+	if err != nil {
+		return Outcome{}, err
+	}
+	for _, vk := range reg.VerKeys {
+		if err := vk.validateDoc(newDoc); err != nil {
+			return Outcome{}, err
+		}
+	}
+	if err := reg.prepare(key, sess); err != nil {
+		return Outcome{}, err
+	}
 
-	// 新建记录添加版本信息
+	// 新建记录添加版本信息，_id由数据库或者日志生成，删除标记只能通过Delete写入
+	delete(newDoc, "_id")
+	delete(newDoc, Deleted)
+	delete(newDoc, "_mig")
+	delete(newDoc, "_migp")
+	delete(newDoc, ChangedKey)
+	meta, _ := newDoc[MetaKey].(*Meta)
+	newDoc[MetaKey] = withMeta(meta)
+	newDoc[Hash] = reg.ContentHash(newDoc)
+	reg.setBaseline(newDoc)
+	if job := reg.migrationJob(); job != nil { // 迁移期间写入的记录已经按照新定义生成
+		newDoc["_mig"] = job.ID
+	}
 	ver := reg.GenVer()
+	observed, ok, err := observedAt(newDoc)
+	if err != nil {
+		return Outcome{}, err
+	} else if ok {
+		ver = reg.VerAt(observed)
+	}
 	newDoc["_ver"] = ver
 	newDoc["_next"] = ver
 	newDoc["_is_latest"] = true
@@ -93,28 +232,58 @@ func (reg *Registry) Versionize(newDoc map[string]interface{}, sess *mgo.Session
 	// 记录存储表
 	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
 
-	// 查询表中同一实例最新的记录
+	// 查询表中同一实例最新的记录，先只读取版本信息和哈希
 	var oldDoc map[string]interface{}
-	err := collection.Find(bson.M{
-		reg.CompareKey: newDoc[reg.CompareKey],
-		"_is_latest":   true,
-	}).One(&oldDoc)
+	err = collection.Find(And(reg.keyQuery(key), bson.M{"_is_latest": true})).Select(reg.latestFields()).One(&oldDoc)
 
 	// 如果没有找到记录，表面新记录是第一个版本
 	if err == mgo.ErrNotFound {
-		return collection.Insert(newDoc)
+		newDoc["_id"] = bson.NewObjectId()
+		return reg.commitChange(key, Outcome{Action: ActionInsert, Ver: ver, Changed: reg.changedKeys(nil, newDoc)}, sess,
+			insertOp(newDoc))
 	} else if err != nil {
-		return err
+		return Outcome{}, err
+	}
+
+	// 如果提交记录的观测时间早于最新记录最后一次观测的时间，回填到历史版本中
+	if ver < asInt64(oldDoc["_next"]) {
+		return reg.backfill(key, ver, newDoc, sess)
+	}
+
+	// 缺少的更新键沿用最新版本的值，scope为all的更新键写入所有版本
+	if !isDeleted(oldDoc) {
+		reg.carryUpdateKeys(oldDoc, newDoc)
+	}
+	updates, err := reg.updateKeyOps(key, oldDoc, newDoc, sess)
+	if err != nil {
+		return Outcome{}, err
 	}
 
 	// 如果提交的记录和数据库中最新记录在同一个Interval中，用提交记录的信息更新数据库中的最新记录
-	if oldDoc["_ver"] == newDoc["_ver"] {
-		return collection.UpdateId(oldDoc["_id"], newDoc)
+	if asInt64(oldDoc["_ver"]) == ver {
+		if oldDoc[ChangedKey] != nil {
+			if newDoc[ChangedKey], err = reg.changedSincePrev(key, ver, newDoc, sess); err != nil {
+				return Outcome{}, err
+			}
+		}
+		newDoc["_id"] = oldDoc["_id"]
+		return reg.commitChange(key, Outcome{Action: ActionUpdate, Ver: ver}, sess, append(updates, insertOp(newDoc))...)
+	}
+
+	// 哈希不同时读取完整的最新记录逐个比对
+	same := !isDeleted(oldDoc) && oldDoc[Hash] == newDoc[Hash]
+	if !same {
+		id := oldDoc["_id"]
+		oldDoc = nil
+		if err = collection.FindId(id).One(&oldDoc); err != nil {
+			return Outcome{}, err
+		}
+		same = !reg.differs(oldDoc, newDoc)
 	}
 
 	// 如果提交的记录和数据库中的记录内容一致，更新数据库中记录_next，同时用提交数据的内容更新数据库记录
-	if !changed(oldDoc, newDoc, reg.VerKeys) {
-		setMap := bson.M{"_next": ver}
+	if same {
+		setMap := bson.M{"_next": ver, Hash: newDoc[Hash]}
 		for k, v := range newDoc {
 			// 屏蔽键： "_ver", "_next", "_id", "_is_latest"
 			if len(k) > 0 && k[0] == '_' {
@@ -122,41 +291,100 @@ func (reg *Registry) Versionize(newDoc map[string]interface{}, sess *mgo.Session
 			}
 			setMap[k] = v
 		}
-		return collection.UpdateId(
-			oldDoc["_id"],
-			bson.M{"$set": setMap},
-		)
-	}
-
-	if err = collection.UpdateId(
-		oldDoc["_id"],
-		bson.M{"$set": bson.M{
-			"_next":      ver - 1,
-			"_is_latest": false,
-		}},
-	); err != nil {
-		return err
+		return reg.commitChange(key, Outcome{Action: ActionExtend, Ver: asInt64(oldDoc["_ver"])}, sess,
+			append(updates, setOp(oldDoc["_id"], setMap))...)
+	}
+
+	// 关闭老版本，插入新版本，老版本是删除标记时开始新的生命周期
+	outcome := Outcome{
+		Action:  ActionVersion,
+		Ver:     ver,
+		Prev:    asInt64(oldDoc["_ver"]),
+		Changed: reg.changedKeys(oldDoc, newDoc),
+	}
+	if isDeleted(oldDoc) {
+		outcome.Action = ActionInsert
+	} else {
+		newDoc[ChangedKey] = outcome.Changed
 	}
-	return collection.Insert(newDoc)
+	newDoc["_id"] = bson.NewObjectId()
+	outcome, err = reg.commitChange(key, outcome, sess,
+		append(updates,
+			setOp(oldDoc["_id"], bson.M{
+				"_next":      ver - 1,
+				"_is_latest": false,
+			}),
+			insertOp(newDoc),
+		)...,
+	)
+	if err == nil { // 老版本的内容不会再改变，之前的版本编码成相对它的增量
+		reg.logEncode(key, oldDoc, sess)
+	}
+	return outcome, err
+}
+
+// differs 比对两个版本，其中一个是删除标记时认为不同，容差和ldoc生成时的值比较
+func (reg *Registry) differs(ldoc, rdoc map[string]interface{}) bool {
+	return isDeleted(ldoc) != isDeleted(rdoc) || changed(withBaseline(ldoc), rdoc, reg.VerKeys, reg.excludeKeys())
+}
+
+/*
+changedKeys 返回ldoc和rdoc之间发生改变的VerKeys路径，ldoc为空或者是删除标记时返回rdoc中有值的路径
+VerKeys中的模式展开为具体路径，见glob.go
+*/
+func (reg *Registry) changedKeys(ldoc, rdoc map[string]interface{}) []string {
+	if ldoc != nil && isDeleted(ldoc) {
+		ldoc = nil
+	}
+	if ldoc != nil {
+		ldoc = withBaseline(ldoc)
+	}
+	exclude := reg.excludeKeys()
+	var keys []string
+	for _, key := range reg.VerKeys {
+		for _, path := range key.expand(ldoc, rdoc, exclude) {
+			k := key
+			k.Path = path
+			vb := collectVals(rdoc, k)
+			if ldoc == nil {
+				if len(vb) > 0 {
+					keys = append(keys, path)
+				}
+			} else if !k.equal(collectVals(ldoc, k), vb) {
+				keys = append(keys, path)
+			}
+		}
+	}
+	return keys
 }
 
 // 比对两条记录，keys对应的值有没有改变。
-// 比对两条记录时，如果键对应的值是列表，要求列表内容有稳定性。
-// 也就是俩个高列表里面如果内容一致，但是顺序不一致会认为是不一样的列表。
-func changed(ldoc, rdoc map[string]interface{}, keys []string) bool {
+// 比对两条记录时，如果键对应的值是列表，按照VerKey的Strategy比对，
+// 默认要求列表内容有稳定性，也就是俩个列表里面如果内容一致，但是顺序不一致会认为是不一样的列表。
+// keys中的模式按照两条记录展开，exclude中的路径不参与比对，见glob.go
+// 数字容差和字符串规范化见tolerance.go
+func changed(ldoc, rdoc map[string]interface{}, keys []VerKey, exclude []string) bool {
 	for _, key := range keys {
-		parts := strings.Split(key, ".")
-		va := collectVals(ldoc, parts)
-		vb := collectVals(rdoc, parts)
-		if !reflect.DeepEqual(va, vb) {
-			return true
+		for _, path := range key.expand(ldoc, rdoc, exclude) {
+			k := key
+			k.Path = path
+			va := collectVals(ldoc, k)
+			vb := collectVals(rdoc, k)
+			if !k.equal(va, vb) {
+				return true
+			}
 		}
 	}
 	return false
 }
 
-// 从记录中收集所有keys对应的值
-func collectVals(m map[string]interface{}, parts []string) []interface{} {
+// 从记录中收集key对应的值，并按照key的比对方式整理
+func collectVals(m map[string]interface{}, key VerKey) []interface{} {
+	return key.normalize(walkVals(m, strings.Split(key.Path, ".")))
+}
+
+// 从记录中收集所有路径parts对应的值
+func walkVals(m map[string]interface{}, parts []string) []interface{} {
 	var nexts = []interface{}{m}
 	var vals []interface{}
 	for i, k := range parts {
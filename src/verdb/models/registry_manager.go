@@ -19,6 +19,8 @@ type RegManager struct {
 	collection string // 存储注册数据的表
 
 	registries map[string]*Registry // 内存注册缓存
+
+	owner bson.ObjectId // 本实例的标识，执行迁移任务时使用，见migration.go
 }
 
 // NewRegManger 返回新生成的RegManager
@@ -52,15 +54,34 @@ func NewRegManger(database, collection string, sess *mgo.Session) *RegManager {
 		database:   database,
 		collection: collection,
 		registries: map[string]*Registry{},
+		owner:      bson.NewObjectId(),
 	}
 
 	for i := range regs {
 		rm.registries[regs[i].Name] = &regs[i]
 	}
 
+	// 完成上次退出时未完成的写入
+	rm.Recover(sess)
+
+	// 接管没有实例执行的迁移任务
+	rm.resumeMigrations(sess)
+
 	return rm
 }
 
+// Recover 重放所有注册表中未完成的日志
+func (rm *RegManager) Recover(sess *mgo.Session) {
+	rm.RLock()
+	defer rm.RUnlock()
+
+	for _, reg := range rm.registries {
+		if err := reg.Recover(sess); err != nil {
+			log.Println("Recover", reg.Name, err)
+		}
+	}
+}
+
 // Size 返回注册数目
 func (rm *RegManager) Size() int {
 	rm.RLock()
@@ -74,15 +95,14 @@ func (rm *RegManager) CreateRegistry(reg *Registry, sess *mgo.Session) (*Registr
 	rm.Lock()
 	defer rm.Unlock()
 
-	if reg.DatabaseName == "" || reg.CollectionName == "" || reg.CompareKey == "" {
-		return nil, errors.New("db_name, db_name, compare_key cant be empty")
-	}
-	if len(reg.VerKeys) == 0 {
-		return nil, errors.New("ver_keys cant be empty")
+	if err := reg.validate(); err != nil {
+		return nil, err
 	}
 
 	reg.ID = bson.NewObjectId()
 	reg.Name = reg.GenName()
+	reg.Migration = ""
+	reg.Revision = 1
 
 	// 保存注册信息到数据库
 	err := sess.DB(rm.database).C(rm.collection).Insert(reg)
@@ -94,16 +114,8 @@ func (rm *RegManager) CreateRegistry(reg *Registry, sess *mgo.Session) (*Registr
 	rm.registries[reg.Name] = reg
 
 	// 添加index
-	regRepo := sess.DB(reg.DatabaseName).C(reg.CollectionName)
-	for _, index := range append(reg.IndexKeys,
-		reg.CompareKey,
-		"_ver",
-		"_next",
-		"_is_latest",
-	) {
-		if err = regRepo.EnsureIndexKey(index); err != nil {
-			return nil, err
-		}
+	if err = reg.ensureIndexes(sess); err != nil {
+		return nil, err
 	}
 
 	return reg, nil
@@ -114,6 +126,10 @@ func (rm *RegManager) UpdateRegistry(id string, reg *Registry, sess *mgo.Session
 	rm.Lock()
 	defer rm.Unlock()
 
+	if err := reg.validate(); err != nil {
+		return nil, err
+	}
+
 	_id := bson.ObjectIdHex(id)
 
 	var oldReg Registry
@@ -124,30 +140,42 @@ func (rm *RegManager) UpdateRegistry(id string, reg *Registry, sess *mgo.Session
 
 	reg.ID = _id
 	reg.Name = fmt.Sprintf("%s/%s", reg.DatabaseName, reg.CollectionName)
+	reg.Revision = oldReg.Revision + 1
+
+	// 迁移任务只能由RegManager设置，同一个表的VerKeys或者版本时钟改变时迁移历史版本
+	reg.Migration, reg.job = "", nil
+	var job *Migration
+	if oldReg.Name == reg.Name && needMigration(&oldReg, reg) {
+		if oldReg.Migration != "" {
+			return nil, errors.New("Registry " + reg.Name + " is migrating")
+		}
+		if job, err = rm.startMigration(&oldReg, reg, sess); err != nil {
+			return nil, err
+		}
+	} else if old := rm.registries[oldReg.Name]; old != nil && oldReg.Name == reg.Name {
+		reg.Migration, reg.job = old.Migration, old.job
+	}
 
-	// 保存注册信息到数据库
-	_, err = sess.DB(rm.database).C(rm.collection).UpsertId(_id, reg)
-	if err != nil {
+	// 保存注册信息到数据库，读取之后被其他实例修改过时返回错误
+	err = sess.DB(rm.database).C(rm.collection).Update(revisionQuery(_id, oldReg.Revision), reg)
+	if err == mgo.ErrNotFound {
+		return nil, errors.New("Registry " + reg.Name + " was modified concurrently, please retry")
+	} else if err != nil {
 		return nil, err
 	}
 
-	// 缓存更新后的注册信息到缓存
+	// 删除老注册信息，缓存更新后的注册信息到缓存
+	delete(rm.registries, oldReg.Name)
 	rm.registries[reg.Name] = reg
 
-	// 删除老注册信息
-	delete(rm.registries, oldReg.Name)
+	// 后台迁移历史版本
+	if job != nil {
+		go rm.runMigration(reg, job, sess.Copy())
+	}
 
 	// 添加index
-	regRepo := sess.DB(reg.DatabaseName).C(reg.CollectionName)
-	for _, index := range append(reg.IndexKeys,
-		reg.CompareKey,
-		"_ver",
-		"_next",
-		"_is_latest",
-	) {
-		if err = regRepo.EnsureIndexKey(index); err != nil {
-			return nil, err
-		}
+	if err = reg.ensureIndexes(sess); err != nil {
+		return nil, err
 	}
 
 	return reg, nil
@@ -201,3 +229,11 @@ func (rm *RegManager) GetReg(database, collection string) *Registry {
 	// return reg from regs or nil
 	return rm.registries[fmt.Sprintf("%s/%s", database, collection)]
 }
+
+// getRegByName 按照name(databaseName/collectionName)返回注册信息
+func (rm *RegManager) getRegByName(name string) *Registry {
+	rm.RLock()
+	defer rm.RUnlock()
+
+	return rm.registries[name]
+}
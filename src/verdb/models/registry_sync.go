@@ -0,0 +1,207 @@
+package models
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+注册缓存同步
+
+多个实例共享同一个注册表，每条注册信息带有修订号 revision，新建时为1，
+每次修改(包括迁移完成)加1，修改时只有修订号和读取时一致才能写入。
+每个实例定时(Watch)读取所有注册信息的 _id, name, revision，和缓存比较:
+
+	* 新增的或者修订号改变的注册信息重新读取，替换缓存
+	* 已经被删除的注册信息从缓存中删除
+
+迁移任务由持有任务的实例执行，其他实例只加载进行中的迁移任务，
+写入时先迁移被写入的实体。每次同步之后接管心跳超时的迁移任务，见migration.go
+*/
+
+// regStamp 注册信息的修订号
+type regStamp struct {
+	ID       bson.ObjectId `bson:"_id"`
+	Name     string        `bson:"name"`
+	Revision int64         `bson:"revision"`
+}
+
+// revisionQuery 修订号为rev的注册信息，修订号为0时匹配没有修订号的注册信息
+func revisionQuery(id bson.ObjectId, rev int64) bson.M {
+	if rev == 0 {
+		return bson.M{"_id": id, "revision": bson.M{"$in": []interface{}{nil, int64(0)}}}
+	}
+	return bson.M{"_id": id, "revision": rev}
+}
+
+// SyncResult 一次同步中重新加载和删除的注册信息名称
+type SyncResult struct {
+	Loaded  []string `json:"loaded"`
+	Removed []string `json:"removed"`
+}
+
+// byID 返回缓存中 _id -> 注册信息 的映射
+func (rm *RegManager) byID() map[bson.ObjectId]*Registry {
+	rm.RLock()
+	defer rm.RUnlock()
+
+	regs := make(map[bson.ObjectId]*Registry, len(rm.registries))
+	for _, reg := range rm.registries {
+		regs[reg.ID] = reg
+	}
+	return regs
+}
+
+/*
+Sync 按照修订号同步注册缓存，force为true时重新加载所有注册信息
+读取数据库时不持有rm的锁，期间本实例修改过的注册信息以修订号较大的为准
+*/
+func (rm *RegManager) Sync(force bool, sess *mgo.Session) (*SyncResult, error) {
+	coll := sess.DB(rm.database).C(rm.collection)
+	var stamps []regStamp
+	if err := coll.Find(nil).Select(bson.M{"name": 1, "revision": 1}).All(&stamps); err != nil {
+		return nil, err
+	}
+
+	cached := rm.byID()
+	stored := map[bson.ObjectId]bool{}
+	var ids []bson.ObjectId
+	for _, stamp := range stamps {
+		stored[stamp.ID] = true
+		reg := cached[stamp.ID]
+		if force || reg == nil || reg.Revision != stamp.Revision || reg.Name != stamp.Name {
+			ids = append(ids, stamp.ID)
+		}
+	}
+	var regs []Registry
+	if len(ids) > 0 {
+		if err := coll.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&regs); err != nil {
+			return nil, err
+		}
+	}
+	for i := range regs {
+		rm.loadJob(&regs[i], cached[regs[i].ID], sess)
+	}
+
+	rm.Lock()
+	defer rm.Unlock()
+
+	result := &SyncResult{Loaded: []string{}, Removed: []string{}}
+	current := map[bson.ObjectId]*Registry{}
+	for name, reg := range rm.registries {
+		// 读取之后本实例新建的注册信息不在stored中，不能删除
+		if !stored[reg.ID] && cached[reg.ID] == reg {
+			delete(rm.registries, name)
+			result.Removed = append(result.Removed, name)
+			continue
+		}
+		current[reg.ID] = reg
+	}
+	for i := range regs {
+		reg := &regs[i]
+		if old := current[reg.ID]; old != nil {
+			if old.Revision > reg.Revision {
+				continue
+			}
+			delete(rm.registries, old.Name)
+		}
+		rm.registries[reg.Name] = reg
+		result.Loaded = append(result.Loaded, reg.Name)
+	}
+	sort.Strings(result.Loaded)
+	sort.Strings(result.Removed)
+	return result, nil
+}
+
+// loadJob 加载注册信息reg进行中的迁移任务，old为缓存中同一条注册信息，正在执行同一个迁移时沿用它的任务
+func (rm *RegManager) loadJob(reg, old *Registry, sess *mgo.Session) {
+	if reg.Migration == "" {
+		return
+	}
+	if old != nil {
+		if job := old.migrationJob(); job != nil && job.ID.Hex() == reg.Migration {
+			reg.job = job
+			return
+		}
+	}
+	job, err := rm.GetMigration(reg.Migration, sess)
+	if err != nil {
+		log.Println("Sync", reg.Name, err)
+		return
+	}
+	if job.Status == MigrationRunning {
+		reg.job = job
+	}
+}
+
+// Watch 每隔interval同步一次注册缓存，阻塞直到stop被关闭
+func (rm *RegManager) Watch(interval time.Duration, stop <-chan struct{}, sess *mgo.Session) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		wsess := sess.Copy()
+		result, err := rm.Sync(false, wsess)
+		if err == nil {
+			rm.resumeMigrations(wsess)
+		}
+		wsess.Close()
+		if err != nil {
+			log.Println("Sync", err)
+			continue
+		}
+		if len(result.Loaded) > 0 || len(result.Removed) > 0 {
+			log.Printf("Sync registries: loaded %v, removed %v\n", result.Loaded, result.Removed)
+		}
+	}
+}
+
+// CacheEntry 注册信息在缓存和数据库中的修订号，不存在时为nil
+type CacheEntry struct {
+	ID        bson.ObjectId `json:"id"`
+	Name      string        `json:"name"`
+	Cached    *int64        `json:"cached"`
+	Stored    *int64        `json:"stored"`
+	Stale     bool          `json:"stale"` // 缓存和数据库不一致
+	Migration string        `json:"migration,omitempty"`
+}
+
+// CacheStatus 返回缓存中和数据库中的所有注册信息的修订号，按名称排序
+func (rm *RegManager) CacheStatus(sess *mgo.Session) ([]CacheEntry, error) {
+	var stamps []regStamp
+	if err := sess.DB(rm.database).C(rm.collection).Find(nil).Select(bson.M{"name": 1, "revision": 1}).All(&stamps); err != nil {
+		return nil, err
+	}
+
+	entries := map[bson.ObjectId]*CacheEntry{}
+	for _, reg := range rm.byID() {
+		rev := reg.Revision
+		entries[reg.ID] = &CacheEntry{ID: reg.ID, Name: reg.Name, Cached: &rev, Migration: reg.Migration}
+	}
+	for i := range stamps {
+		entry := entries[stamps[i].ID]
+		if entry == nil {
+			entry = &CacheEntry{ID: stamps[i].ID, Name: stamps[i].Name}
+			entries[stamps[i].ID] = entry
+		}
+		entry.Stored = &stamps[i].Revision
+		entry.Stale = entry.Name != stamps[i].Name
+	}
+
+	status := make([]CacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		entry.Stale = entry.Stale || entry.Cached == nil || entry.Stored == nil || *entry.Cached != *entry.Stored
+		status = append(status, *entry)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status, nil
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestRegistrySync(t *testing.T) {
+	// 注册信息存取的表
+	const (
+		database   = "metaInfo"
+		collection = "regsync"
+	)
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+	sess.DB(database).C(collection).DropCollection()
+
+	// 两个实例共享同一个注册表
+	rm1 := NewRegManger(database, collection, sess)
+	rm2 := NewRegManger(database, collection, sess)
+
+	reg, err := rm1.CreateRegistry(&Registry{DatabaseName: "testdb", CollectionName: "testsync", CompareKey: "pk", VerKeys: []VerKey{{Path: "a"}}}, sess)
+	if err != nil || reg.Revision != 1 {
+		t.Errorf("新建注册信息失败 %+v %v\n", reg, err)
+		return
+	}
+	if rm2.GetReg("testdb", "testsync") != nil {
+		t.Errorf("同步之前不应该看到其他实例新建的注册信息\n")
+		return
+	}
+	if status, _ := rm2.CacheStatus(sess); len(status) != 1 || !status[0].Stale || status[0].Cached != nil || *status[0].Stored != 1 {
+		t.Errorf("缓存状态错误 %+v\n", status)
+		return
+	}
+
+	// 新建的注册信息被加载
+	result, err := rm2.Sync(false, sess)
+	if err != nil || len(result.Loaded) != 1 || rm2.GetReg("testdb", "testsync") == nil {
+		t.Errorf("同步新建的注册信息失败 %+v %v\n", result, err)
+		return
+	}
+
+	// 修订号改变的注册信息被重新加载，没有改变的不重新加载
+	update := &Registry{DatabaseName: "testdb", CollectionName: "testsync", CompareKey: "pk", VerKeys: []VerKey{{Path: "a"}}, IndexKeys: []string{"a"}}
+	if _, err = rm2.UpdateRegistry(reg.ID.Hex(), update, sess); err != nil || update.Revision != 2 {
+		t.Errorf("更新注册信息失败 %+v %v\n", update, err)
+		return
+	}
+	if result, _ = rm2.Sync(false, sess); len(result.Loaded) != 0 {
+		t.Errorf("修订号没有改变时不应该重新加载 %+v\n", result)
+		return
+	}
+	if result, _ = rm1.Sync(false, sess); len(result.Loaded) != 1 {
+		t.Errorf("没有重新加载更新的注册信息 %+v\n", result)
+		return
+	}
+	if synced := rm1.GetReg("testdb", "testsync"); synced.Revision != 2 || len(synced.IndexKeys) != 1 {
+		t.Errorf("同步之后的注册信息错误 %+v\n", synced)
+		return
+	}
+
+	// 强制重新加载
+	if result, _ = rm1.Sync(true, sess); len(result.Loaded) != 1 {
+		t.Errorf("强制重新加载失败 %+v\n", result)
+		return
+	}
+
+	// 被删除的注册信息从缓存中删除
+	rm1.DeleteRegistry(reg.ID.Hex(), sess)
+	if result, _ = rm2.Sync(false, sess); len(result.Removed) != 1 || rm2.Size() != 0 {
+		t.Errorf("同步删除的注册信息失败 %+v\n", result)
+		return
+	}
+}
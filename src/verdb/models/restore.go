@@ -0,0 +1,114 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrWrittenSince 撤销的版本之后实体又被写入
+var ErrWrittenSince = errors.New("entity has been written since the version")
+
+/*
+Restore 把实体key恢复到版本ver时的内容
+以版本ver的内容(不包括更新键，更新键沿用最新版本的值)作为一次新的提交，
+错误的版本保留在历史中。和Versionize一样，最新版本和当前时间在同一个Interval时
+最新版本的内容会被替换。版本ver是删除标记时返回错误，恢复已删除的实体会开始新的生命周期。
+meta为这次恢复的提交来源，可以为nil
+*/
+func (reg *Registry) Restore(key interface{}, ver int64, meta *Meta, sess *mgo.Session) (Outcome, error) {
+	unlock, err := reg.lockEntity(key, sess)
+	if err != nil {
+		return Outcome{}, err
+	}
+	defer unlock()
+
+	if err = reg.prepare(key, sess); err != nil {
+		return Outcome{}, err
+	}
+
+	var target map[string]interface{}
+	err = sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(And(
+		reg.keyQuery(key),
+		during(ver, ver),
+	)).One(&target)
+	if err == mgo.ErrNotFound {
+		return Outcome{}, fmt.Errorf("cant find version %d of %v", ver, key)
+	} else if err != nil {
+		return Outcome{}, err
+	}
+	if isDeleted(target) {
+		return Outcome{}, fmt.Errorf("version %d of %v is deleted", ver, key)
+	}
+	if target, err = reg.decodeOne(target, sess); err != nil {
+		return Outcome{}, err
+	}
+
+	newDoc := strip(target)
+	for _, uk := range reg.UpdateKeys {
+		unsetPath(newDoc, uk.Path)
+	}
+	newDoc[MetaKey] = meta
+	outcome, err := reg.versionize(newDoc, sess)
+	outcome.Hash, _ = newDoc[Hash].(string)
+	return outcome, err
+}
+
+/*
+Undo 撤销实体key最近一次生成的版本ver: 删除最新版本，重新打开前一个版本
+只有最新版本是ver，并且之后没有再被延长(_next == _ver)时才能撤销，否则返回ErrWrittenSince，
+同一个Interval中的多次提交会合并为一个版本，无法区分。
+撤销实体唯一的版本会删除该实体，撤销删除标记会恢复被删除的实体。
+*/
+func (reg *Registry) Undo(key interface{}, ver int64, sess *mgo.Session) (Outcome, error) {
+	unlock, err := reg.lockEntity(key, sess)
+	if err != nil {
+		return Outcome{}, err
+	}
+	defer unlock()
+
+	if err = reg.prepare(key, sess); err != nil {
+		return Outcome{}, err
+	}
+
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	var latest map[string]interface{}
+	err = collection.Find(And(reg.keyQuery(key), bson.M{"_is_latest": true})).One(&latest)
+	if err == mgo.ErrNotFound {
+		return Outcome{}, ErrEntityNotFound
+	} else if err != nil {
+		return Outcome{}, err
+	}
+	if asInt64(latest["_ver"]) != ver || asInt64(latest["_next"]) != ver {
+		return Outcome{}, ErrWrittenSince
+	}
+
+	// 同一个Interval中被删除的版本和删除标记的_ver相同，区间为空
+	var prev map[string]interface{}
+	err = collection.Find(And(
+		reg.keyQuery(key),
+		bson.M{"_ver": bson.M{"$lte": ver}, "_id": bson.M{"$ne": latest["_id"]}},
+	)).Sort("-_ver", "-_next").One(&prev)
+	if err == mgo.ErrNotFound {
+		return reg.commitChange(key, Outcome{Action: ActionDelete, Ver: ver}, sess, removeOp(latest["_id"]))
+	} else if err != nil {
+		return Outcome{}, err
+	}
+	reopen := bson.M{"_is_latest": true}
+	if asInt64(prev["_next"]) < asInt64(prev["_ver"]) {
+		reopen["_next"] = prev["_ver"]
+	}
+	promote := setOp(prev["_id"], reopen)
+	if reg.Delta != nil { // 最新版本会被更新，不能作为增量的基准，替换成完整记录并恢复依赖它的增量记录
+		if prev, err = reg.decodeOne(prev, sess); err != nil {
+			return Outcome{}, err
+		}
+		for k, v := range reopen {
+			prev[k] = v
+		}
+		promote = insertOp(prev)
+	}
+	return reg.commitChange(key, Outcome{Action: ActionUndo, Ver: asInt64(prev["_ver"])}, sess, removeOp(latest["_id"]), promote)
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRestoreUndo(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testrestore",
+		Name:           "testdb/testrestore",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}},
+		UpdateKeys:     []UpdateKey{{Path: "owner"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	good, _ := reg.Versionize(map[string]interface{}{"pk": 1, "a": 1, "owner": "alice"}, sess)
+	reg.Versionize(map[string]interface{}{"pk": 1, "a": 2, "owner": "bob"}, sess)
+
+	// 恢复到第一个版本，错误的版本保留在历史中，更新键沿用最新版本
+	restored, err := reg.Restore(1, good.Ver, nil, sess)
+	if err != nil || restored.Action != ActionVersion {
+		t.Errorf("恢复失败 %+v %v\n", restored, err)
+		return
+	}
+	var latest bson.M
+	collection.Find(And(bson.M{"pk": 1}, Latest())).One(&latest)
+	if latest["a"] != 1 || latest["owner"] != "bob" {
+		t.Errorf("恢复后的最新版本错误 %v\n", latest)
+		return
+	}
+	if n, _ := collection.Find(bson.M{"pk": 1}).Count(); n != 3 {
+		t.Errorf("恢复后的版本数目错误 %d\n", n)
+		return
+	}
+
+	// 撤销恢复生成的版本
+	bad, _ := reg.Versionize(map[string]interface{}{"pk": 1, "a": 3}, sess)
+	if _, err = reg.Undo(1, restored.Ver, sess); err != ErrWrittenSince {
+		t.Errorf("之后有写入时撤销未报错 %v\n", err)
+		return
+	}
+	undone, err := reg.Undo(1, bad.Ver, sess)
+	if err != nil || undone.Action != ActionUndo || undone.Ver != restored.Ver {
+		t.Errorf("撤销失败 %+v %v\n", undone, err)
+		return
+	}
+	latest = nil
+	collection.Find(And(bson.M{"pk": 1}, Latest())).One(&latest)
+	if latest["a"] != 1 || asInt64(latest["_ver"]) != restored.Ver {
+		t.Errorf("撤销后的最新版本错误 %v\n", latest)
+		return
+	}
+	if n, _ := collection.Find(bson.M{"pk": 1, "_is_latest": true}).Count(); n != 1 {
+		t.Errorf("撤销后最新版本数目错误 %d\n", n)
+		return
+	}
+}
@@ -0,0 +1,310 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+Retention 历史版本的保留策略
+
+	"retention": {
+		"keepDays": 30,      // 最近30天内结束的版本保持原始粒度
+		"downsample": "day", // 更早的版本按天(day)或者周(week)降采样
+		"deleteDays": 365    // 365天之前结束的版本被删除，0表示不删除
+	}
+
+降采样按照版本结束时间所在的区间(registry时区)对相邻版本分组，
+每组只保留最后一个版本(该区间最后的状态)，其有效区间延长到组内第一个版本的_ver，
+降采样之后内容相同的相邻版本也会被合并。
+最新版本和结束时间在keepDays之内的版本不会被修改，
+保留的版本和其后第一个未过期的版本的 _changed 按照新的前一个版本重新计算(见churn.go)。
+*/
+type Retention struct {
+	KeepDays   int    `json:"keepDays" bson:"keepDays"`
+	Downsample string `json:"downsample,omitempty" bson:"downsample,omitempty"`
+	DeleteDays int    `json:"deleteDays,omitempty" bson:"deleteDays,omitempty"`
+}
+
+const (
+	// CompactMerge 版本被合并到同一区间的后一个版本
+	CompactMerge = "merge"
+	// CompactRemove 版本超过保留期限被删除
+	CompactRemove = "remove"
+)
+
+// CompactReportLimit 压缩报告中最多列出的操作数
+const CompactReportLimit = 1000
+
+// CompactAction 压缩时对一个版本的操作
+type CompactAction struct {
+	Key  interface{} `json:"key"`
+	Type string      `json:"type"`
+	Ver  int64       `json:"ver"`
+	Next int64       `json:"next"`
+	Into int64       `json:"into,omitempty"` // 合并到的版本的_next
+}
+
+// CompactReport 一次压缩的结果，DryRun时只报告不修改
+type CompactReport struct {
+	DryRun   bool            `json:"dryRun"`
+	Entities int             `json:"entities"` // 有版本被修改的实体数
+	Merged   int             `json:"merged"`
+	Removed  int             `json:"removed"`
+	Actions  []CompactAction `json:"actions"` // 最多CompactReportLimit条
+}
+
+func (r *Retention) validate() error {
+	if r.KeepDays < 0 || r.DeleteDays < 0 {
+		return fmt.Errorf("retention days cant be negative")
+	}
+	switch r.Downsample {
+	case "", Day, Week:
+	default:
+		return fmt.Errorf("unknown downsample unit %s", r.Downsample)
+	}
+	if r.DeleteDays > 0 && r.DeleteDays <= r.KeepDays {
+		return fmt.Errorf("retention deleteDays must be greater than keepDays")
+	}
+	return nil
+}
+
+/*
+Compact 按照保留策略压缩截至now的历史版本，没有保留策略时返回空报告
+每个实体单独加锁，写入通过日志完成，压缩过程中可以继续提交记录
+*/
+func (reg *Registry) Compact(now time.Time, dryRun bool, sess *mgo.Session) (*CompactReport, error) {
+	report := &CompactReport{DryRun: dryRun, Actions: []CompactAction{}}
+	if reg.Retention == nil {
+		return report, nil
+	}
+	keepFrom := reg.VerAt(now.AddDate(0, 0, -reg.Retention.KeepDays))
+
+	// 遍历有过期版本的实体，只读取实体标识
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	old := bson.M{"_is_latest": false, "_next": bson.M{"$lt": keepFrom}}
+	iter := collection.Find(old).Select(reg.keyFields()).Sort(reg.compareKeys()...).Iter()
+	var doc map[string]interface{}
+	var last string
+	for iter.Next(&doc) {
+		key, err := reg.EntityKey(doc)
+		if err != nil {
+			continue
+		}
+		if ck := canonical(key); ck != last {
+			last = ck
+			if err = reg.compactEntity(key, now, dryRun, report, sess); err != nil {
+				iter.Close()
+				return report, err
+			}
+		}
+		doc = nil
+	}
+	return report, iter.Close()
+}
+
+// compactEntity 压缩实体key的过期版本，结果记录到report
+func (reg *Registry) compactEntity(key interface{}, now time.Time, dryRun bool, report *CompactReport, sess *mgo.Session) error {
+	unlock, err := reg.lockEntity(key, sess)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// DryRun时不重放日志、不迁移实体，只读取当前的版本
+	if !dryRun {
+		if err = reg.prepare(key, sess); err != nil {
+			return err
+		}
+	}
+
+	keepFrom := reg.VerAt(now.AddDate(0, 0, -reg.Retention.KeepDays))
+	var docs []map[string]interface{}
+	err = sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(And(
+		reg.keyQuery(key),
+		bson.M{"_is_latest": false, "_next": bson.M{"$lt": keepFrom}},
+	)).Sort("_ver", "_next").All(&docs)
+	if err != nil {
+		return err
+	}
+	if err = reg.decode(docs, sess); err != nil {
+		return err
+	}
+
+	// 过期版本之后的第一个版本，它的前一个版本可能被合并或者删除
+	var next map[string]interface{}
+	if len(docs) > 0 {
+		next, err = reg.nextVersion(key, asInt64(docs[len(docs)-1]["_next"]), sess)
+		if err != nil {
+			return err
+		}
+	}
+
+	deleteBefore := int64(-1 << 63)
+	if reg.Retention.DeleteDays > 0 {
+		deleteBefore = reg.VerAt(now.AddDate(0, 0, -reg.Retention.DeleteDays))
+	}
+	ops, actions := reg.compactPlan(docs, next, deleteBefore)
+	if len(actions) == 0 {
+		return nil
+	}
+
+	report.Entities++
+	for _, action := range actions {
+		action.Key = key
+		if action.Type == CompactMerge {
+			report.Merged++
+		} else {
+			report.Removed++
+		}
+		if len(report.Actions) < CompactReportLimit {
+			report.Actions = append(report.Actions, action)
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	return reg.commit(key, sess, ops...)
+}
+
+// nextVersion 返回实体key在_next为next的版本之后的第一个版本，没有时返回nil
+func (reg *Registry) nextVersion(key interface{}, next int64, sess *mgo.Session) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	err := sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(And(
+		reg.keyQuery(key),
+		bson.M{"_ver": bson.M{"$gt": next}},
+	)).Sort("_ver", "_next").One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return reg.decodeOne(doc, sess)
+}
+
+/*
+compactPlan 计算按_ver排序的过期版本docs的压缩操作，next为docs之后的第一个版本，没有时为nil
+  - _next < deleteBefore 的版本被删除
+  - 其余版本按结束时间所在的降采样区间分组，每组保留最后一个版本
+  - 保留的相邻版本内容相同时合并到后一个版本
+  - 保留的版本和next的 _changed 相对新的前一个版本重新计算
+*/
+func (reg *Registry) compactPlan(docs []map[string]interface{}, next map[string]interface{}, deleteBefore int64) ([]journalOp, []CompactAction) {
+	var ops []journalOp
+	var actions []CompactAction
+
+	var kept []map[string]interface{}
+	for _, doc := range docs {
+		if asInt64(doc["_next"]) < deleteBefore {
+			ops = append(ops, removeOp(doc["_id"]))
+			actions = append(actions, CompactAction{
+				Type: CompactRemove,
+				Ver:  asInt64(doc["_ver"]),
+				Next: asInt64(doc["_next"]),
+			})
+			continue
+		}
+		kept = append(kept, doc)
+	}
+
+	bucket := func(doc map[string]interface{}) int64 { return asInt64(doc["_next"]) }
+	if reg.Retention.Downsample != "" {
+		clock := &Registry{VerUnit: reg.Retention.Downsample, TimeZone: reg.TimeZone}
+		bucket = func(doc map[string]interface{}) int64 {
+			end := reg.VerTime(asInt64(doc["_next"]) + 1).Add(-time.Nanosecond)
+			return clock.VerAt(end)
+		}
+	}
+
+	// 合并到下一个保留的版本: 同一区间或者内容相同
+	var survivors []map[string]interface{}
+	var prev map[string]interface{}
+	var first int64
+	for _, doc := range kept {
+		if prev == nil {
+			prev, first = doc, asInt64(doc["_ver"])
+			continue
+		}
+		// 不连续的版本(中间有被删除的版本)不合并
+		if asInt64(prev["_next"])+1 == asInt64(doc["_ver"]) &&
+			(bucket(prev) == bucket(doc) || !reg.differs(prev, doc)) {
+			ops = append(ops, removeOp(prev["_id"]))
+			actions = append(actions, CompactAction{
+				Type: CompactMerge,
+				Ver:  asInt64(prev["_ver"]),
+				Next: asInt64(prev["_next"]),
+				Into: asInt64(doc["_next"]),
+			})
+		} else {
+			ops = appendShift(ops, prev, first)
+			survivors = append(survivors, prev)
+			first = asInt64(doc["_ver"])
+		}
+		prev = doc
+	}
+	if prev != nil {
+		ops = appendShift(ops, prev, first)
+		survivors = append(survivors, prev)
+	}
+
+	// 前一个版本被合并或者删除之后 _changed 改变
+	if next != nil {
+		survivors = append(survivors, next)
+	}
+	prev = nil
+	for _, doc := range survivors {
+		if canonical(reg.versionChanged(prev, doc)) != canonical(doc[ChangedKey]) {
+			ops = append(ops, reg.changedOp(prev, doc))
+		}
+		prev = doc
+	}
+	return ops, actions
+}
+
+// appendShift 保留的版本doc从first开始生效
+func appendShift(ops []journalOp, doc map[string]interface{}, first int64) []journalOp {
+	if asInt64(doc["_ver"]) == first {
+		return ops
+	}
+	return append(ops, setOp(doc["_id"], bson.M{"_ver": first}))
+}
+
+// Maintain 每隔interval按照保留策略压缩所有注册表，阻塞直到stop被关闭
+func (rm *RegManager) Maintain(interval time.Duration, stop <-chan struct{}, sess *mgo.Session) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		rm.RLock()
+		var regs []*Registry
+		for _, reg := range rm.registries {
+			if reg.Retention != nil {
+				regs = append(regs, reg)
+			}
+		}
+		rm.RUnlock()
+
+		msess := sess.Copy()
+		for _, reg := range regs {
+			report, err := reg.Compact(time.Now(), false, msess)
+			if err != nil {
+				log.Println("Compact", reg.Name, err)
+				continue
+			}
+			if report.Entities > 0 {
+				log.Printf("Compact %s: %d entities, %d merged, %d removed\n",
+					reg.Name, report.Entities, report.Merged, report.Removed)
+			}
+		}
+		msess.Close()
+	}
+}
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCompactPlan(t *testing.T) {
+	reg := &Registry{
+		CompareKey:  "pk",
+		VerInterval: Hourly,
+		VerKeys:     []VerKey{{Path: "a"}},
+		Retention:   &Retention{KeepDays: 1, Downsample: Day, DeleteDays: 10},
+	}
+
+	// 按小时的版本区间 [ver, next] 和内容
+	h := func(day, hour int64) int64 { return day*24 + hour }
+	ranges := [][]int64{
+		{h(0, 0), h(0, 23), 1},  // 删除
+		{h(1, 0), h(1, 5), 1},   // 第1天合并到 [h(1,0), h(1,23)]
+		{h(1, 6), h(1, 20), 2},  //
+		{h(1, 21), h(1, 23), 3}, //
+		{h(2, 0), h(2, 11), 4},  // 第2天合并到 [h(2,0), h(2,23)]
+		{h(2, 12), h(2, 23), 3}, //
+		{h(3, 0), h(3, 5), 3},   // 第3天和第2天内容相同，合并到 [h(2,0), h(3,5)]
+	}
+	var docs []map[string]interface{}
+	for i, r := range ranges {
+		docs = append(docs, map[string]interface{}{"_id": i, "_ver": r[0], "_next": r[1], "a": r[2]})
+	}
+
+	next := map[string]interface{}{"_id": 7, "_ver": h(3, 6), "_next": h(3, 6), "a": 5, ChangedKey: []interface{}{"a"}}
+	ops, actions := reg.compactPlan(docs, next, h(1, 0))
+
+	var removed []interface{}
+	shifted := map[interface{}]interface{}{}
+	changes := map[interface{}]interface{}{}
+	for _, op := range ops {
+		if op.Remove {
+			removed = append(removed, op.ID)
+		}
+		for _, set := range op.Set {
+			if set.Key == ChangedKey {
+				changes[op.ID] = set.Val
+			} else {
+				shifted[op.ID] = set.Val
+			}
+		}
+	}
+	if !reflect.DeepEqual(removed, []interface{}{0, 1, 2, 4, 5}) {
+		t.Errorf("删除的版本错误 %v\n", removed)
+		return
+	}
+	if !reflect.DeepEqual(shifted, map[interface{}]interface{}{3: h(1, 0), 6: h(2, 0)}) {
+		t.Errorf("保留版本的区间错误 %v\n", shifted)
+		return
+	}
+	var types []string
+	for _, action := range actions {
+		types = append(types, action.Type)
+	}
+	if !reflect.DeepEqual(types, []string{CompactRemove, CompactMerge, CompactMerge, CompactMerge, CompactMerge}) {
+		t.Errorf("压缩报告错误 %v\n", actions)
+		return
+	}
+	// 第2天保留的版本的前一个版本变成第1天保留的版本，内容相同；next的前一个版本内容不变
+	if !reflect.DeepEqual(changes, map[interface{}]interface{}{6: []string{}}) {
+		t.Errorf("保留版本的_changed错误 %v\n", changes)
+		return
+	}
+
+	// 前一个版本被删除之后，next是第一个版本，没有 _changed
+	ops, _ = reg.compactPlan(docs[:1], next, h(1, 0))
+	if len(ops) != 2 || !ops[0].Remove || !reflect.DeepEqual(ops[1].Unset, []string{ChangedKey}) {
+		t.Errorf("删除之后_changed错误 %+v\n", ops)
+		return
+	}
+
+	invalid := []Retention{{KeepDays: -1}, {Downsample: Month}, {KeepDays: 10, DeleteDays: 5}}
+	for _, r := range invalid {
+		if err := r.validate(); err == nil {
+			t.Errorf("非法保留策略未报错 %+v\n", r)
+			return
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testcompact",
+		Name:           "testdb/testcompact",
+		CompareKey:     "pk",
+		VerInterval:    Hourly,
+		VerKeys:        []VerKey{{Path: "a"}},
+		Retention:      &Retention{KeepDays: 1, Downsample: Day},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	// 三天前每小时变化一次
+	start := time.Now().UTC().Truncate(Daily*time.Second).AddDate(0, 0, -3)
+	for i := 0; i < 24; i++ {
+		observed := start.Add(time.Duration(i) * time.Hour).Format(time.RFC3339)
+		if _, err = reg.Versionize(map[string]interface{}{"pk": 1, "a": i, ObservedAt: observed}, sess); err != nil {
+			t.Errorf("版本化失败 %v\n", err)
+			return
+		}
+	}
+	if _, err = reg.Versionize(map[string]interface{}{"pk": 1, "a": 100}, sess); err != nil {
+		t.Errorf("版本化失败 %v\n", err)
+		return
+	}
+
+	report, err := reg.Compact(time.Now(), true, sess)
+	if err != nil || report.Entities != 1 || report.Merged != 23 {
+		t.Errorf("dry run 报告错误 %+v %v\n", report, err)
+		return
+	}
+	if n, _ := collection.Count(); n != 25 {
+		t.Errorf("dry run 修改了数据 %d\n", n)
+		return
+	}
+
+	if report, err = reg.Compact(time.Now(), false, sess); err != nil || report.Merged != 23 {
+		t.Errorf("压缩失败 %+v %v\n", report, err)
+		return
+	}
+	var docs []bson.M
+	collection.Find(bson.M{"pk": 1}).Sort("_ver").All(&docs)
+	if len(docs) != 2 || docs[0]["a"] != 23 || asInt64(docs[0]["_ver"]) != reg.VerAt(start) {
+		t.Errorf("压缩后的版本错误 %v\n", docs)
+		return
+	}
+}
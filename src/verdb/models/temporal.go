@@ -0,0 +1,98 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+时间维度查询
+
+每条记录的有效区间为 [_ver, _next]，最新记录(_is_latest)在 _next 之后依然有效，
+直到有新的版本产生。删除标记(_deleted)也有有效区间，但不会出现在查询结果中。
+	* Latest: 只返回每个实体的最新版本
+	* AsOf(ver): 返回每个实体在版本ver时的状态
+	* During(start, end): 返回每个实体在区间 [start, end] 内出现过的所有版本
+*/
+
+// Latest 返回最新版本的查询条件
+func Latest() bson.M {
+	return bson.M{"_is_latest": true, Deleted: bson.M{"$ne": true}}
+}
+
+// AsOf 返回在版本ver时有效记录的查询条件
+func AsOf(ver int64) bson.M {
+	q := during(ver, ver)
+	q[Deleted] = bson.M{"$ne": true}
+	return q
+}
+
+// During 返回有效区间和 [start, end] 相交记录的查询条件
+func During(start, end int64) bson.M {
+	q := during(start, end)
+	q[Deleted] = bson.M{"$ne": true}
+	return q
+}
+
+// during 和During相同，包括删除标记
+func during(start, end int64) bson.M {
+	return bson.M{
+		"_ver": bson.M{"$lte": end},
+		"$or": []bson.M{
+			{"_next": bson.M{"$gte": start}},
+			{"_is_latest": true},
+		},
+	}
+}
+
+// And 合并查询条件，空条件会被忽略
+func And(queries ...bson.M) bson.M {
+	var conds []bson.M
+	for _, q := range queries {
+		if len(q) > 0 {
+			conds = append(conds, q)
+		}
+	}
+	switch len(conds) {
+	case 0:
+		return bson.M{}
+	case 1:
+		return conds[0]
+	}
+	return bson.M{"$and": conds}
+}
+
+// ParseVer 解析版本号或者RFC3339格式的时间，时间会被转换成对应的版本号
+func (reg *Registry) ParseVer(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if ver, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ver, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.New("invalid version or time: " + s)
+	}
+	return reg.VerAt(t), nil
+}
+
+// ParseInterval 解析 "start,end" 格式的区间，start和end可以是版本号或者时间
+func (reg *Registry) ParseInterval(s string) (start, end int64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("interval must be in format start,end: " + s)
+	}
+	if start, err = reg.ParseVer(parts[0]); err != nil {
+		return
+	}
+	if end, err = reg.ParseVer(parts[1]); err != nil {
+		return
+	}
+	if start > end {
+		err = errors.New("interval start is after end: " + s)
+	}
+	return
+}
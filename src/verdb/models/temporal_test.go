@@ -0,0 +1,58 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseVer(t *testing.T) {
+	reg := &Registry{VerInterval: Daily}
+
+	ver, err := reg.ParseVer("42")
+	if err != nil || ver != 42 {
+		t.Errorf("版本号解析错误 %v %v\n", ver, err)
+		return
+	}
+
+	tm := time.Date(2016, 3, 2, 10, 0, 0, 0, time.UTC)
+	ver, err = reg.ParseVer(tm.Format(time.RFC3339))
+	if err != nil || ver != reg.VerAt(tm) {
+		t.Errorf("时间解析错误 %v %v\n", ver, err)
+		return
+	}
+
+	if _, err = reg.ParseVer("yesterday"); err == nil {
+		t.Errorf("非法输入未报错\n")
+		return
+	}
+
+	start, end, err := reg.ParseInterval("10,2016-03-02T10:00:00Z")
+	if err != nil || start != 10 || end != reg.VerAt(tm) {
+		t.Errorf("区间解析错误 %v %v %v\n", start, end, err)
+		return
+	}
+	if _, _, err = reg.ParseInterval("20,10"); err == nil {
+		t.Errorf("区间起点大于终点未报错\n")
+		return
+	}
+}
+
+func TestAnd(t *testing.T) {
+	if q := And(nil, bson.M{}); len(q) != 0 {
+		t.Errorf("空条件合并错误 %v\n", q)
+		return
+	}
+	a := bson.M{"a": 1}
+	if q := And(a, nil); !reflect.DeepEqual(q, a) {
+		t.Errorf("单个条件合并错误 %v\n", q)
+		return
+	}
+	b := Latest()
+	if q := And(a, b); !reflect.DeepEqual(q, bson.M{"$and": []bson.M{a, b}}) {
+		t.Errorf("多个条件合并错误 %v\n", q)
+		return
+	}
+}
@@ -0,0 +1,226 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+容差和字符串规范化
+
+VerKey 可以声明数字的容差和字符串的规范化方式，容差范围内的变化不产生新版本，
+只延长最新版本的有效区间，最新版本中保存的仍然是最后一次提交的值:
+
+	"verKeys": [
+		{"path": "memInfo.total", "tolerance": "0.5%"}, // 相对最新版本的值变化不超过0.5%
+		{"path": "cpuInfo.mhz", "tolerance": "10"},     // 变化的绝对值不超过10
+		{"path": "hostname", "normalize": "trim,fold"}  // 忽略首尾空白和大小写
+	]
+
+容差和版本生成时的值比较，而不是最新版本中保存的值，多次容差内的变化累积起来超过容差时产生新版本。
+版本生成时带容差的VerKeys所在的顶层字段保存在 _baseline 中，延长版本时不会被覆盖:
+
+	{memInfo: {total: 1004}, _baseline: {memInfo: {total: 1000}}, ...}
+
+_baseline 之前写入的版本和保存的值比较。
+*/
+
+// BaselineKey 版本生成时带容差的VerKeys的值的保留键
+const BaselineKey = "_baseline"
+
+const (
+	// NormalizeTrim 去掉字符串首尾空白
+	NormalizeTrim = "trim"
+	// NormalizeFold 忽略字符串大小写
+	NormalizeFold = "fold"
+)
+
+// tolerance 解析容差，以%结尾时为百分比
+func (key VerKey) tolerance() (value float64, percent bool, err error) {
+	s := strings.TrimSpace(key.Tolerance)
+	if strings.HasSuffix(s, "%") {
+		s, percent = strings.TrimSpace(strings.TrimSuffix(s, "%")), true
+	}
+	if value, err = strconv.ParseFloat(s, 64); err != nil {
+		return 0, false, fmt.Errorf("ver key %s: invalid tolerance %s", key.Path, key.Tolerance)
+	}
+	if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false, fmt.Errorf("ver key %s: invalid tolerance %s", key.Path, key.Tolerance)
+	}
+	return value, percent, nil
+}
+
+// normalizers 返回字符串规范化方式列表
+func (key VerKey) normalizers() []string {
+	if key.Normalize == "" {
+		return nil
+	}
+	var ns []string
+	for _, n := range strings.Split(key.Normalize, ",") {
+		ns = append(ns, strings.TrimSpace(n))
+	}
+	return ns
+}
+
+// validateNoise 检查容差和规范化方式
+func (key VerKey) validateNoise() error {
+	if key.Tolerance != "" {
+		if _, _, err := key.tolerance(); err != nil {
+			return err
+		}
+	}
+	for _, n := range key.normalizers() {
+		if n != NormalizeTrim && n != NormalizeFold {
+			return fmt.Errorf("ver key %s: unknown normalize %s", key.Path, n)
+		}
+	}
+	return nil
+}
+
+// normalizeStrings 按照Normalize规范化值中所有的字符串，返回拷贝
+func (key VerKey) normalizeStrings(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case string:
+		for _, n := range key.normalizers() {
+			switch n {
+			case NormalizeTrim:
+				tv = strings.TrimSpace(tv)
+			case NormalizeFold:
+				tv = strings.ToLower(tv)
+			}
+		}
+		return tv
+	case []interface{}:
+		nl := make([]interface{}, len(tv))
+		for i, elem := range tv {
+			nl[i] = key.normalizeStrings(elem)
+		}
+		return nl
+	}
+	if m, ok := asMap(v); ok {
+		nm := make(map[string]interface{}, len(m))
+		for k, elem := range m {
+			nm[k] = key.normalizeStrings(elem)
+		}
+		return nm
+	}
+	return v
+}
+
+// baseline 返回doc中带容差的VerKeys所在的顶层字段的拷贝，没有带容差的VerKeys时返回nil
+func (reg *Registry) baseline(doc map[string]interface{}) map[string]interface{} {
+	var base map[string]interface{}
+	for _, key := range reg.VerKeys {
+		if key.Tolerance == "" {
+			continue
+		}
+		if base == nil {
+			base = map[string]interface{}{}
+		}
+		top := strings.SplitN(key.Path, ".", 2)[0]
+		for k, v := range doc {
+			if len(k) > 0 && k[0] != '_' && (k == top || globMatch(top, k)) {
+				base[k] = deepCopy(v)
+			}
+		}
+	}
+	return base
+}
+
+// setBaseline 设置新版本doc的_baseline
+func (reg *Registry) setBaseline(doc map[string]interface{}) {
+	if base := reg.baseline(doc); base != nil {
+		doc[BaselineKey] = base
+	} else {
+		delete(doc, BaselineKey)
+	}
+}
+
+// withBaseline 返回用_baseline替换顶层字段之后的doc，用于和版本生成时的值比对，没有_baseline时返回doc
+func withBaseline(doc map[string]interface{}) map[string]interface{} {
+	base, ok := asMap(doc[BaselineKey])
+	if !ok {
+		return doc
+	}
+	m := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		m[k] = v
+	}
+	for k, v := range base {
+		m[k] = v
+	}
+	return m
+}
+
+// equal 比对collectVals从老版本和新记录收集到的值，数字在容差范围内视为相同
+func (key VerKey) equal(ovals, nvals []interface{}) bool {
+	if key.Tolerance == "" {
+		return reflect.DeepEqual(ovals, nvals)
+	}
+	value, percent, err := key.tolerance()
+	if err != nil {
+		return reflect.DeepEqual(ovals, nvals)
+	}
+	if key.Strategy == Keyed && !key.sameIDs(ovals, nvals) {
+		return false
+	}
+	within := func(x, y float64) bool {
+		if percent {
+			return math.Abs(x-y) <= math.Abs(x)*value/100
+		}
+		return math.Abs(x-y) <= value
+	}
+	return approxEqual(ovals, nvals, within)
+}
+
+// approxEqual 递归比对a和b，数字使用within比对
+func approxEqual(a, b interface{}, within func(x, y float64) bool) bool {
+	if x, ok := asFloat(a); ok {
+		y, ok := asFloat(b)
+		return ok && within(x, y)
+	}
+	if la, ok := a.([]interface{}); ok {
+		lb, ok := b.([]interface{})
+		if !ok || len(la) != len(lb) {
+			return false
+		}
+		for i := range la {
+			if !approxEqual(la[i], lb[i], within) {
+				return false
+			}
+		}
+		return true
+	}
+	if ma, ok := asMap(a); ok {
+		mb, ok := asMap(b)
+		if !ok || len(ma) != len(mb) {
+			return false
+		}
+		for k, va := range ma {
+			vb, ok := mb[k]
+			if !ok || !approxEqual(va, vb, within) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// asFloat 把数字转换成float64
+func asFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestVerKeyNoise(t *testing.T) {
+	for _, key := range []VerKey{
+		{Path: "a", Tolerance: "x"},
+		{Path: "a", Tolerance: "-1"},
+		{Path: "a", Tolerance: "1%%"},
+		{Path: "a", Normalize: "upper"},
+	} {
+		if err := key.validate(); err == nil {
+			t.Errorf("非法版本化键未报错 %+v\n", key)
+			return
+		}
+	}
+
+	cases := []struct {
+		key      VerKey
+		old, new interface{}
+		changed  bool
+	}{
+		{VerKey{Path: "v", Tolerance: "1%"}, 1000, 1009.5, false},
+		{VerKey{Path: "v", Tolerance: "1%"}, 1000, 1011, true},
+		{VerKey{Path: "v", Tolerance: "10"}, 100, 91, false},
+		{VerKey{Path: "v", Tolerance: "10"}, 100, 89, true},
+		{VerKey{Path: "v", Tolerance: "10"}, []interface{}{1, 2}, []interface{}{5, 9}, false},
+		{VerKey{Path: "v", Tolerance: "10"}, []interface{}{1, 2}, []interface{}{1}, true},
+		{VerKey{Path: "v", Tolerance: "10"}, "a", "b", true},
+		{VerKey{Path: "v"}, 1000, 1001, true},
+		{VerKey{Path: "v", Normalize: "trim,fold"}, " Host-A ", "host-a", false},
+		{VerKey{Path: "v", Normalize: "trim"}, " Host-A ", "host-a", true},
+		{VerKey{Path: "v", Normalize: "fold", Strategy: Unordered}, []interface{}{"A", "b"}, []interface{}{"B", "a"}, false},
+	}
+	for i, cs := range cases {
+		ldoc := map[string]interface{}{"v": cs.old}
+		rdoc := map[string]interface{}{"v": cs.new}
+		if changed(ldoc, rdoc, []VerKey{cs.key}, nil) != cs.changed {
+			t.Errorf("第%d个比对结果错误 %+v %v %v\n", i, cs.key, cs.old, cs.new)
+		}
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	reg := &Registry{VerKeys: []VerKey{{Path: "mem.total", Tolerance: "1%"}, {Path: "host"}}}
+	doc := map[string]interface{}{"mem": map[string]interface{}{"total": 1000}, "host": "a"}
+	reg.setBaseline(doc)
+	if !reflect.DeepEqual(doc[BaselineKey], map[string]interface{}{"mem": map[string]interface{}{"total": 1000}}) {
+		t.Errorf("_baseline错误 %v\n", doc[BaselineKey])
+		return
+	}
+
+	// 延长版本之后保存的值改变，_baseline不变
+	doc["mem"] = map[string]interface{}{"total": 1008}
+	if reg.differs(doc, map[string]interface{}{"mem": map[string]interface{}{"total": 1009}, "host": "a"}) {
+		t.Errorf("容差内的变化产生新版本\n")
+	}
+	if !reg.differs(doc, map[string]interface{}{"mem": map[string]interface{}{"total": 1016}, "host": "a"}) {
+		t.Errorf("相对版本生成时的值超过容差没有产生新版本\n")
+	}
+
+	reg = &Registry{VerKeys: []VerKey{{Path: "host"}}}
+	if reg.setBaseline(doc); doc[BaselineKey] != nil {
+		t.Errorf("没有容差时不需要_baseline %v\n", doc[BaselineKey])
+	}
+}
+
+func TestVersionizeWithinTolerance(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testtolerance",
+		Name:           "testdb/testtolerance",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "mem", Tolerance: "1%"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	steps := []struct {
+		mem    float64
+		action string
+	}{
+		{1000, ActionInsert},
+		{1005, ActionExtend},
+		{998, ActionExtend},
+		{1100, ActionVersion},
+		{1108, ActionExtend},
+		{1116, ActionVersion}, // 相对1108没有超过容差，相对版本生成时的1100超过容差
+	}
+	for i, step := range steps {
+		outcome, err := reg.Versionize(map[string]interface{}{"pk": 1, "mem": step.mem}, sess)
+		if err != nil || outcome.Action != step.action {
+			t.Errorf("第%d条记录处理结果错误 %+v %v\n", i, outcome, err)
+			return
+		}
+		if i == 2 {
+			// 容差内的变化只延长版本，最新版本保存最后一次提交的值
+			var latest bson.M
+			collection.Find(bson.M{"pk": 1, "_is_latest": true}).One(&latest)
+			if latest["mem"] != float64(998) {
+				t.Errorf("最新版本的值没有更新 %v\n", latest)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"errors"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Deleted 删除标记的键
+const Deleted = "_deleted"
+
+// ActionDelete 实体被删除，写入删除标记
+const ActionDelete = "delete"
+
+// ErrEntityNotFound 实体不存在或者已经被删除
+var ErrEntityNotFound = errors.New("entity not found")
+
+func isDeleted(doc map[string]interface{}) bool {
+	return doc[Deleted] == true
+}
+
+// notDeleted 排除删除标记的查询条件
+func notDeleted() bson.M {
+	return bson.M{Deleted: bson.M{"$ne": true}}
+}
+
+/*
+Delete 删除实体key，实体的历史版本会被保留
+1. 关闭实体的最新版本: _next = ver-1, _is_latest = false
+2. 插入删除标记 {<实体标识>, _ver: ver, _next: ver, _is_latest: true, _deleted: true, _meta: meta}
+如果最新版本和删除在同一个Interval中，删除标记使用最新版本的_ver，最新版本的区间为空(_next = _ver-1)，
+不会出现在时间维度查询中，但仍然保留在历史中。
+删除标记和普通版本一样有有效区间，时间维度查询会排除删除标记，
+因此删除之后实体不会出现在查询结果中。实体再次提交时关闭删除标记，开始新的生命周期。
+*/
+func (reg *Registry) Delete(key interface{}, meta *Meta, sess *mgo.Session) (Outcome, error) {
+	unlock, err := reg.lockEntity(key, sess)
+	if err != nil {
+		return Outcome{}, err
+	}
+	defer unlock()
+
+	if err = reg.prepare(key, sess); err != nil {
+		return Outcome{}, err
+	}
+
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	var oldDoc map[string]interface{}
+	err = collection.Find(And(reg.keyQuery(key), bson.M{"_is_latest": true})).One(&oldDoc)
+	if err == mgo.ErrNotFound || (err == nil && isDeleted(oldDoc)) {
+		return Outcome{}, ErrEntityNotFound
+	} else if err != nil {
+		return Outcome{}, err
+	}
+
+	ver := reg.GenVer()
+	tombstone := reg.keyDoc(key)
+	tombstone["_id"] = bson.NewObjectId()
+	tombstone["_ver"] = ver
+	tombstone["_next"] = ver
+	tombstone["_is_latest"] = true
+	tombstone[Deleted] = true
+	tombstone[MetaKey] = withMeta(meta)
+
+	outcome := Outcome{Action: ActionDelete, Ver: ver}
+	if asInt64(oldDoc["_ver"]) >= ver {
+		tombstone["_ver"] = oldDoc["_ver"]
+	}
+	outcome, err = reg.commitChange(key, outcome, sess,
+		setOp(oldDoc["_id"], bson.M{
+			"_next":      asInt64(tombstone["_ver"]) - 1,
+			"_is_latest": false,
+		}),
+		insertOp(tombstone),
+	)
+	if err == nil {
+		reg.logEncode(key, oldDoc, sess)
+	}
+	return outcome, err
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDelete(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testdelete",
+		Name:           "testdb/testdelete",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	if _, err = reg.Delete(1, nil, sess); err != ErrEntityNotFound {
+		t.Errorf("删除不存在的实体未报错 %v\n", err)
+		return
+	}
+
+	first, err := reg.Versionize(map[string]interface{}{"pk": 1, "a": 1}, sess)
+	if err != nil {
+		t.Errorf("版本化失败 %v\n", err)
+		return
+	}
+	deleted, err := reg.Delete(1, nil, sess)
+	if err != nil || deleted.Action != ActionDelete {
+		t.Errorf("删除失败 %+v %v\n", deleted, err)
+		return
+	}
+	if _, err = reg.Delete(1, nil, sess); err != ErrEntityNotFound {
+		t.Errorf("重复删除未报错 %v\n", err)
+		return
+	}
+
+	// 删除之后实体不出现在查询结果中
+	if n, _ := collection.Find(AsOf(first.Ver)).Count(); n != 1 {
+		t.Errorf("删除之前的版本查询错误 %d\n", n)
+		return
+	}
+	if n, _ := collection.Find(AsOf(deleted.Ver)).Count(); n != 0 {
+		t.Errorf("删除之后的版本查询错误 %d\n", n)
+		return
+	}
+	if n, _ := collection.Find(Latest()).Count(); n != 0 {
+		t.Errorf("删除之后的最新版本查询错误 %d\n", n)
+		return
+	}
+
+	// 实体再次出现，开始新的生命周期
+	again, err := reg.Versionize(map[string]interface{}{"pk": 1, "a": 1}, sess)
+	if err != nil || again.Action != ActionInsert {
+		t.Errorf("再次出现的处理结果错误 %+v %v\n", again, err)
+		return
+	}
+	if n, _ := collection.Find(AsOf(deleted.Ver)).Count(); n != 0 {
+		t.Errorf("删除区间的版本查询错误 %d\n", n)
+		return
+	}
+	var doc bson.M
+	if err = collection.Find(Latest()).One(&doc); err != nil || asInt64(doc["_ver"]) != again.Ver {
+		t.Errorf("新生命周期的最新版本错误 %v %v\n", doc, err)
+		return
+	}
+
+	// 历史版本保留删除标记
+	versions, total, err := reg.History(1, HistoryQuery{}, sess)
+	if err != nil || total != 3 {
+		t.Errorf("历史版本数量错误 %d %v\n", total, err)
+		return
+	}
+	for i, deleted := range []bool{false, true, false} {
+		if versions[i].Deleted != deleted {
+			t.Errorf("第%d个版本删除标记错误 %+v\n", i, versions[i])
+			return
+		}
+	}
+	if versions[0].Next != versions[1].Ver-1 || versions[1].Next != versions[2].Ver-1 {
+		t.Errorf("版本区间不连续 %+v\n", versions)
+		return
+	}
+
+	// 同一个Interval中删除: 内容版本的区间为空，保留在历史中
+	reg.VerInterval = Daily
+	if _, err = reg.Versionize(map[string]interface{}{"pk": 2, "a": 1}, sess); err != nil {
+		t.Errorf("版本化失败 %v\n", err)
+		return
+	}
+	if deleted, err = reg.Delete(2, nil, sess); err != nil {
+		t.Errorf("删除失败 %v\n", err)
+		return
+	}
+	if n, _ := collection.Find(And(bson.M{"pk": 2}, AsOf(deleted.Ver))).Count(); n != 0 {
+		t.Errorf("同一个Interval中删除之后的版本查询错误 %d\n", n)
+		return
+	}
+	versions, total, err = reg.History(2, HistoryQuery{}, sess)
+	if err != nil || total != 2 || versions[0].Deleted || !versions[1].Deleted || versions[0].Doc["a"] != 1 ||
+		versions[0].Ver != versions[1].Ver || versions[0].Next != versions[0].Ver-1 {
+		t.Errorf("同一个Interval中删除之后的历史错误 %+v %v\n", versions, err)
+		return
+	}
+
+	// 撤销删除恢复内容版本
+	if _, err = reg.Undo(2, deleted.Ver, sess); err != nil {
+		t.Errorf("撤销删除失败 %v\n", err)
+		return
+	}
+	if err = collection.Find(And(bson.M{"pk": 2}, AsOf(deleted.Ver))).One(&doc); err != nil || doc["a"] != 1 {
+		t.Errorf("撤销删除之后的版本错误 %v %v\n", doc, err)
+		return
+	}
+}
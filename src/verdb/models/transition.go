@@ -0,0 +1,406 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+键的变化查询
+
+查询一段时间内指定VerKeys发生的变化，每次变化返回一条记录:
+
+	{"key": 1, "path": "osInfo.kernelRelease", "ver": 20, "prev": 15, "old": "4.4.0", "new": "4.8.0"}
+
+ver是新版本的_ver，prev是前一个版本(_next == ver-1)的_ver，old, new是该路径在两个版本中的值。
+有 _changed 的版本(见churn.go)直接使用其中等于查询路径、匹配查询路径或者在它们下级的路径，
+没有 _changed 的版本(记录 _changed 之前写入的版本)和前一个版本逐个比对，
+比对方式和生成版本时一致(列表策略、容差、字符串规范化)。
+实体的第一个版本和删除之后重新开始的版本没有前一个版本，不返回变化。
+
+指定Filter时先从最新版本中选出满足条件的实体，候选版本限定在这些实体中。
+候选版本按照 (_ver, 标识键) 的顺序分批读取，每批一次读取完整内容、一次读取前一个版本，
+只读取当前页和没有 _changed 的版本的内容，内存中最多保留一批候选版本和一页结果。
+*/
+
+// TransitionQuery 键的变化查询条件
+type TransitionQuery struct {
+	Keys        []string // 需要查询的VerKeys路径，可以是VerKeys中的模式或者模式匹配的路径
+	From        *int64   // 新版本的_ver >= From
+	To          *int64   // 新版本的_ver <= To
+	Filter      bson.M   // 实体的最新版本需要满足的条件，为空时不过滤
+	Skip, Limit int      // 分页，Limit <= 0 时不限制
+}
+
+// Transition 一个键在相邻两个版本之间的变化
+type Transition struct {
+	Key  interface{} `json:"key"`
+	Path string      `json:"path"`
+	Ver  int64       `json:"ver"`
+	Time time.Time   `json:"time"` // 新版本开始的时间
+	Prev int64       `json:"prev"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// transitionKeys 返回每个查询路径对应的VerKey定义，路径不是VerKey时返回错误
+func (reg *Registry) transitionKeys(paths []string) ([]VerKey, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("keys cant be empty")
+	}
+	keys := make([]VerKey, len(paths))
+	for i, path := range paths {
+		found := false
+		for _, key := range reg.VerKeys {
+			if key.Path == path || globMatch(key.Path, path) {
+				keys[i], found = key, true
+				keys[i].Path = path
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s is not a verKey", path)
+		}
+	}
+	return keys, nil
+}
+
+// valueAt 路径path在doc中的值，经过列表时返回所有的值
+func valueAt(doc map[string]interface{}, path string) interface{} {
+	if v, ok := lookup(doc, path); ok {
+		return v
+	}
+	vals := walkVals(doc, strings.Split(path, "."))
+	switch len(vals) {
+	case 0:
+		return nil
+	case 1:
+		return vals[0]
+	}
+	return vals
+}
+
+// transitionBatch 每批读取的候选版本数
+const transitionBatch = 500
+
+// underPath 具体路径path是否匹配查询路径key，或者在匹配的路径的下级
+func underPath(key, path string) bool {
+	return excluded(path, []string{key})
+}
+
+// changedQuery 候选版本的 _changed 需要满足的条件: 包含查询路径或者它们下级的路径，有模式时只要求存在
+func changedQuery(paths []string) bson.M {
+	var in []interface{}
+	for _, path := range paths {
+		if isPattern(path) {
+			return bson.M{"$exists": true}
+		}
+		in = append(in, path, bson.RegEx{Pattern: "^" + regexp.QuoteMeta(path) + `\.`})
+	}
+	return bson.M{"$in": in}
+}
+
+// transitionPage 按顺序累计变化总数，只保留第Skip个之后的Limit个变化
+type transitionPage struct {
+	skip, limit, total int
+	items              []Transition
+}
+
+// wants 接下来的n个变化中是否有在当前页中的
+func (p *transitionPage) wants(n int) bool {
+	return n > 0 && p.total+n > p.skip && (p.limit <= 0 || p.total < p.skip+p.limit)
+}
+
+// add 按顺序追加变化，只保留当前页中的
+func (p *transitionPage) add(found []Transition) {
+	for _, tr := range found {
+		if p.total >= p.skip && (p.limit <= 0 || len(p.items) < p.limit) {
+			p.items = append(p.items, tr)
+		}
+		p.total++
+	}
+}
+
+/*
+Transitions 返回q.Keys在[q.From, q.To]中生成的版本里发生的变化，以及变化总数
+按照新版本的_ver排序，同一个版本中按照实体key、路径排序
+*/
+func (reg *Registry) Transitions(q TransitionQuery, sess *mgo.Session) ([]Transition, int, error) {
+	keys, err := reg.transitionKeys(q.Keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	var start, end int64 = 0, 1<<63 - 1
+	if q.From != nil {
+		start = *q.From
+	}
+	if q.To != nil {
+		end = *q.To
+	}
+
+	// 候选版本: _changed 包含查询的路径，或者没有 _changed
+	cond := bson.M{
+		"_ver":  bson.M{"$gte": start, "$lte": end},
+		Deleted: bson.M{"$ne": true},
+		"$or": []bson.M{
+			{ChangedKey: changedQuery(q.Keys)},
+			{ChangedKey: bson.M{"$exists": false}},
+		},
+	}
+	entities, err := reg.filterEntities(q.Filter, sess)
+	if err != nil {
+		return nil, 0, err
+	}
+	if entities != nil {
+		if len(entities) == 0 {
+			return []Transition{}, 0, nil
+		}
+		var in []interface{}
+		for _, key := range entities {
+			in = append(in, key)
+		}
+		cond = And(cond, reg.keyIn(in))
+	}
+
+	fields := reg.keyFields()
+	fields["_ver"], fields[ChangedKey] = 1, 1
+	iter := sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(cond).
+		Select(fields).Sort(append([]string{"_ver"}, reg.compareKeys()...)...).Iter()
+	page := &transitionPage{skip: q.Skip, limit: q.Limit, items: []Transition{}}
+	var batch []map[string]interface{}
+	for {
+		var doc map[string]interface{}
+		more := iter.Next(&doc)
+		if more {
+			key, err := reg.EntityKey(doc)
+			if err != nil {
+				continue
+			}
+			if entities != nil && entities[canonical(key)] == nil {
+				continue
+			}
+			batch = append(batch, doc)
+		}
+		if len(batch) > 0 && (!more || len(batch) == transitionBatch) {
+			if err = reg.transitionBatch(batch, keys, page, sess); err != nil {
+				iter.Close()
+				return nil, 0, err
+			}
+			batch = nil
+		}
+		if !more {
+			break
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return nil, 0, err
+	}
+	return page.items, page.total, nil
+}
+
+// transitionBatch 计算一批候选版本(只有实体标识、_ver和_changed)中的变化，累计到page
+func (reg *Registry) transitionBatch(batch []map[string]interface{}, keys []VerKey, page *transitionPage, sess *mgo.Session) error {
+	// 没有 _changed 的版本先比对，得到变化数目
+	var legacy []map[string]interface{}
+	for _, doc := range batch {
+		if _, ok := doc[ChangedKey]; !ok {
+			legacy = append(legacy, doc)
+		}
+	}
+	full, prevs, err := reg.loadVersions(legacy, true, sess)
+	if err != nil {
+		return err
+	}
+	found := make([][]Transition, len(batch))
+	for i, doc := range batch {
+		if _, ok := doc[ChangedKey]; !ok {
+			found[i] = reg.compareTransitions(full[doc["_id"]], prevs[doc["_id"]], keys)
+		}
+	}
+
+	// 有 _changed 的版本只读取当前页中的
+	paths := make([][]string, len(batch))
+	var wanted []map[string]interface{}
+	pos := *page
+	for i, doc := range batch {
+		if changed, ok := doc[ChangedKey].([]interface{}); ok {
+			paths[i] = changedPaths(changed, keys)
+			if pos.wants(len(paths[i])) {
+				wanted = append(wanted, doc)
+			}
+			pos.total += len(paths[i])
+		} else {
+			pos.total += len(found[i])
+		}
+	}
+	if full, prevs, err = reg.loadVersions(wanted, false, sess); err != nil {
+		return err
+	}
+
+	for i, doc := range batch {
+		if paths[i] == nil {
+			page.add(found[i])
+			continue
+		}
+		if !page.wants(len(paths[i])) {
+			page.total += len(paths[i])
+			continue
+		}
+		cur, prev := full[doc["_id"]], prevs[doc["_id"]]
+		if cur == nil {
+			cur = doc
+		}
+		key, _ := reg.EntityKey(doc)
+		ver := asInt64(doc["_ver"])
+		for _, path := range paths[i] {
+			tr := Transition{Key: key, Path: path, Ver: ver, Time: reg.VerTime(ver), New: valueAt(cur, path)}
+			if prev != nil {
+				tr.Prev, tr.Old = asInt64(prev["_ver"]), valueAt(prev, path)
+			}
+			page.add([]Transition{tr})
+		}
+	}
+	return nil
+}
+
+// changedPaths 返回 _changed 中等于、匹配或者在查询路径下级的路径，按路径排序
+func changedPaths(changed []interface{}, keys []VerKey) []string {
+	paths := []string{}
+	for _, c := range changed {
+		path, _ := c.(string)
+		for _, k := range keys {
+			if underPath(k.Path, path) {
+				paths = append(paths, path)
+				break
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// compareTransitions 比对没有 _changed 的版本doc和前一个版本prev，返回按路径排序的变化
+func (reg *Registry) compareTransitions(doc, prev map[string]interface{}, keys []VerKey) []Transition {
+	if doc == nil || prev == nil || isDeleted(prev) {
+		return nil
+	}
+	key, err := reg.EntityKey(doc)
+	if err != nil {
+		return nil
+	}
+	ver := asInt64(doc["_ver"])
+	exclude := reg.excludeKeys()
+	var found []Transition
+	seen := map[string]bool{}
+	for _, k := range keys {
+		for _, path := range k.expand(prev, doc, exclude) {
+			kc := k
+			kc.Path = path
+			if seen[path] || kc.equal(collectVals(withBaseline(prev), kc), collectVals(doc, kc)) {
+				continue
+			}
+			seen[path] = true
+			found = append(found, Transition{
+				Key:  key,
+				Path: path,
+				Ver:  ver,
+				Time: reg.VerTime(ver),
+				Prev: asInt64(prev["_ver"]),
+				Old:  valueAt(prev, path),
+				New:  valueAt(doc, path),
+			})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+	return found
+}
+
+/*
+loadVersions 读取版本docs的前一个版本(同一个实体，_next == _ver-1)和完整内容，都按照docs中的_id索引
+前一个版本和完整内容各使用一次查询，增量记录被重建，requirePrev为true时只读取前一个版本存在且不是删除标记的版本
+*/
+func (reg *Registry) loadVersions(docs []map[string]interface{}, requirePrev bool, sess *mgo.Session) (full, prevs map[interface{}]map[string]interface{}, err error) {
+	full, prevs = map[interface{}]map[string]interface{}{}, map[interface{}]map[string]interface{}{}
+	if len(docs) == 0 {
+		return full, prevs, nil
+	}
+	var keys, nexts []interface{}
+	for _, doc := range docs {
+		if key, err := reg.EntityKey(doc); err == nil {
+			keys = append(keys, key)
+			nexts = append(nexts, asInt64(doc["_ver"])-1)
+		}
+	}
+	if len(keys) == 0 {
+		return full, prevs, nil
+	}
+
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	var before []map[string]interface{}
+	if err = collection.Find(And(reg.keyIn(keys), bson.M{"_next": bson.M{"$in": nexts}})).All(&before); err != nil {
+		return nil, nil, err
+	}
+	if err = reg.decode(before, sess); err != nil {
+		return nil, nil, err
+	}
+
+	// 前一个版本按照 (实体key, _next) 索引，多个标识键时$in可能匹配到其他实体
+	byNext := map[string]map[string]interface{}{}
+	for _, doc := range before {
+		if key, err := reg.EntityKey(doc); err == nil {
+			byNext[canonical([]interface{}{key, asInt64(doc["_next"])})] = doc
+		}
+	}
+	var ids []interface{}
+	for _, doc := range docs {
+		key, err := reg.EntityKey(doc)
+		if err != nil {
+			continue
+		}
+		prev := byNext[canonical([]interface{}{key, asInt64(doc["_ver"]) - 1})]
+		if prev != nil {
+			prevs[doc["_id"]] = prev
+		}
+		if !requirePrev || (prev != nil && !isDeleted(prev)) {
+			ids = append(ids, doc["_id"])
+		}
+	}
+	if len(ids) == 0 {
+		return full, prevs, nil
+	}
+
+	var loaded []map[string]interface{}
+	if err = collection.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&loaded); err != nil {
+		return nil, nil, err
+	}
+	if err = reg.decode(loaded, sess); err != nil {
+		return nil, nil, err
+	}
+	for _, doc := range loaded {
+		full[doc["_id"]] = doc
+	}
+	return full, prevs, nil
+}
+
+// filterEntities 返回最新版本满足filter的实体，canonical(key) -> key，filter为空时返回nil
+func (reg *Registry) filterEntities(filter bson.M, sess *mgo.Session) (map[string]interface{}, error) {
+	if len(filter) == 0 {
+		return nil, nil
+	}
+	entities := map[string]interface{}{}
+	iter := sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(And(filter, Latest())).Select(reg.keyFields()).Iter()
+	var doc map[string]interface{}
+	for iter.Next(&doc) {
+		if key, err := reg.EntityKey(doc); err == nil {
+			entities[canonical(key)] = key
+		}
+		doc = nil
+	}
+	return entities, iter.Close()
+}
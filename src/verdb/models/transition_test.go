@@ -0,0 +1,189 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTransitionKeys(t *testing.T) {
+	reg := &Registry{VerKeys: []VerKey{{Path: "a"}, {Path: "osInfo.*", Normalize: NormalizeTrim}}}
+
+	keys, err := reg.transitionKeys([]string{"a", "osInfo.kernelRelease", "osInfo.*"})
+	expected := []VerKey{{Path: "a"}, {Path: "osInfo.kernelRelease", Normalize: NormalizeTrim}, {Path: "osInfo.*", Normalize: NormalizeTrim}}
+	if err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("查询路径的VerKey定义错误 %+v %v\n", keys, err)
+		return
+	}
+	for _, paths := range [][]string{nil, {"b"}, {"osInfo.kernel.major"}} {
+		if _, err = reg.transitionKeys(paths); err == nil {
+			t.Errorf("%v 不是VerKeys时没有报错\n", paths)
+		}
+	}
+
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{"os": {"kernel": "4.4"}, "disks": [{"serial": "S1"}, {"serial": "S2"}]}`), &doc)
+	if v := valueAt(doc, "os.kernel"); v != "4.4" {
+		t.Errorf("路径的值错误 %v\n", v)
+	}
+	if v := valueAt(doc, "disks.serial"); !reflect.DeepEqual(v, []interface{}{"S1", "S2"}) {
+		t.Errorf("列表中路径的值错误 %v\n", v)
+	}
+	if v := valueAt(doc, "owner"); v != nil {
+		t.Errorf("不存在的路径的值错误 %v\n", v)
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testtransition",
+		Name:           "testdb/testtransition",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "osInfo.kernelRelease"}, {Path: "a"}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	doc := func(pk int, idc, kernel string, a int) map[string]interface{} {
+		return map[string]interface{}{"pk": pk, "idc": idc, "a": a, "osInfo": map[string]interface{}{"kernelRelease": kernel}}
+	}
+	docs := []map[string]interface{}{
+		doc(1, "bj", "4.4", 1),
+		doc(2, "sh", "4.4", 1),
+		doc(1, "bj", "4.8", 1), // 1: 4.4 -> 4.8
+		doc(1, "bj", "4.8", 2), // 只有a改变
+		doc(2, "sh", "4.9", 1), // 2: 4.4 -> 4.9
+		doc(1, "bj", "4.9", 3), // 1: 4.8 -> 4.9
+	}
+	var vers []int64
+	for i, d := range docs {
+		outcome, err := reg.Versionize(d, sess)
+		if err != nil {
+			t.Errorf("第%d条记录处理失败 %v\n", i, err)
+			return
+		}
+		vers = append(vers, outcome.Ver)
+	}
+
+	// 没有_changed的历史版本和前一个版本比对
+	collection.Update(bson.M{"pk": 2, "_ver": vers[4]}, bson.M{"$unset": bson.M{ChangedKey: ""}})
+
+	transitions, total, err := reg.Transitions(TransitionQuery{Keys: []string{"osInfo.kernelRelease"}, From: &vers[1]}, sess)
+	if err != nil || total != 3 {
+		t.Errorf("查询变化失败 %+v %d %v\n", transitions, total, err)
+		return
+	}
+	var got [][]interface{}
+	for _, tr := range transitions {
+		got = append(got, []interface{}{tr.Key, tr.Ver, tr.Prev, tr.Old, tr.New})
+	}
+	expected := [][]interface{}{
+		{1, vers[2], vers[0], "4.4", "4.8"},
+		{2, vers[4], vers[1], "4.4", "4.9"},
+		{1, vers[5], vers[3], "4.8", "4.9"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("变化记录错误\n%v\n%v\n", got, expected)
+		return
+	}
+
+	// 按照时间窗口和最新版本过滤
+	to := vers[4]
+	transitions, total, err = reg.Transitions(TransitionQuery{
+		Keys:   []string{"osInfo.kernelRelease"},
+		To:     &to,
+		Filter: bson.M{"idc": "bj"},
+	}, sess)
+	if err != nil || total != 1 || transitions[0].Key != 1 || transitions[0].Ver != vers[2] {
+		t.Errorf("过滤之后的变化记录错误 %+v %d %v\n", transitions, total, err)
+		return
+	}
+
+	// 分页
+	if transitions, total, _ = reg.Transitions(TransitionQuery{Keys: []string{"osInfo.kernelRelease", "a"}, Skip: 1, Limit: 2}, sess); total != 5 || len(transitions) != 2 {
+		t.Errorf("分页错误 %+v %d\n", transitions, total)
+		return
+	}
+}
+
+func TestTransitionPage(t *testing.T) {
+	keys := []VerKey{{Path: "osInfo"}, {Path: "disks.*"}}
+	changed := []interface{}{"osInfo.kernelRelease", "osInfoX", "disks.size", "a", "disks"}
+	if paths := changedPaths(changed, keys); !reflect.DeepEqual(paths, []string{"disks.size", "osInfo.kernelRelease"}) {
+		t.Errorf("_changed中的查询路径错误 %v\n", paths)
+	}
+	if q := changedQuery([]string{"osInfo.*"}); !reflect.DeepEqual(q, bson.M{"$exists": true}) {
+		t.Errorf("模式的候选条件错误 %v\n", q)
+	}
+
+	// 第2个开始的2个变化
+	page := &transitionPage{skip: 1, limit: 2}
+	if !page.wants(2) || page.wants(0) {
+		t.Errorf("当前页判断错误\n")
+	}
+	page.add([]Transition{{Ver: 1}, {Ver: 2}})
+	page.add([]Transition{{Ver: 3}, {Ver: 4}})
+	if page.wants(1) || page.total != 4 || len(page.items) != 2 || page.items[0].Ver != 2 || page.items[1].Ver != 3 {
+		t.Errorf("分页错误 %+v\n", page)
+	}
+}
+
+func TestTransitionsExcludeKeys(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testtransitionexclude",
+		Name:           "testdb/testtransitionexclude",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "osInfo"}},
+		ExcludeKeys:    []string{"osInfo.uptime"},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	doc := func(kernel string, uptime int) map[string]interface{} {
+		return map[string]interface{}{"pk": 1, "osInfo": map[string]interface{}{"kernelRelease": kernel, "uptime": uptime}}
+	}
+	var vers []int64
+	for i, d := range []map[string]interface{}{doc("4.4", 1), doc("4.4", 2), doc("4.8", 3)} {
+		outcome, err := reg.Versionize(d, sess)
+		if err != nil {
+			t.Errorf("第%d条记录处理失败 %v\n", i, err)
+			return
+		}
+		vers = append(vers, outcome.Ver)
+	}
+
+	// osInfo 排除下级的uptime之后展开为叶子路径，_changed 中记录的是 osInfo.kernelRelease
+	transitions, total, err := reg.Transitions(TransitionQuery{Keys: []string{"osInfo"}}, sess)
+	if err != nil || total != 1 || transitions[0].Path != "osInfo.kernelRelease" ||
+		transitions[0].Ver != vers[2] || transitions[0].Old != "4.4" || transitions[0].New != "4.8" {
+		t.Errorf("排除键之后的变化记录错误 %+v %d %v\n", transitions, total, err)
+		return
+	}
+}
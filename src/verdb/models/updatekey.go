@@ -0,0 +1,147 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// ScopeLatest 只写入提交记录所在的版本，默认方式
+	ScopeLatest = "latest"
+	// ScopeAll 写入实体的所有版本
+	ScopeAll = "all"
+)
+
+/*
+UpdateKey 更新键，值的改变不会产生新版本，例如资产的负责人
+注册信息中可以只写路径，也可以写成对象：
+
+	"updateKeys": [
+		"owner",
+		{"path": "meta.location", "scope": "all"}
+	]
+
+	* 更新键不参与版本比对，不能和VerKeys重叠(相同或者互为上下级路径)
+	* 提交的记录缺少更新键时沿用最新版本的值
+	* scope 为 latest 时，值和其他字段一样只写入提交记录所在的版本
+	* scope 为 all 时，值还会写入实体的所有历史版本(不包括删除标记)，
+	  回填到历史中的记录(见backfill.go)不会修改其他版本的值
+*/
+type UpdateKey struct {
+	Path  string `json:"path" bson:"path"`
+	Scope string `json:"scope,omitempty" bson:"scope,omitempty"`
+}
+
+// updateKey 用于避免MarshalJSON, GetBSON递归调用
+type updateKey UpdateKey
+
+// MarshalJSON 只有路径时输出为字符串
+func (key UpdateKey) MarshalJSON() ([]byte, error) {
+	if key.Scope == "" {
+		return json.Marshal(key.Path)
+	}
+	return json.Marshal(updateKey(key))
+}
+
+// UnmarshalJSON 兼容字符串和对象两种格式
+func (key *UpdateKey) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*key = UpdateKey{Path: path}
+		return nil
+	}
+	return json.Unmarshal(data, (*updateKey)(key))
+}
+
+// GetBSON 只有路径时保存为字符串
+func (key UpdateKey) GetBSON() (interface{}, error) {
+	if key.Scope == "" {
+		return key.Path, nil
+	}
+	return updateKey(key), nil
+}
+
+// SetBSON 兼容字符串和对象两种格式
+func (key *UpdateKey) SetBSON(raw bson.Raw) error {
+	if raw.Kind == 0x02 { // string
+		*key = UpdateKey{}
+		return raw.Unmarshal(&key.Path)
+	}
+	return raw.Unmarshal((*updateKey)(key))
+}
+
+func (key UpdateKey) validate(verKeys []VerKey) error {
+	if key.Path == "" {
+		return errors.New("update key path cant be empty")
+	}
+	if err := validateMetaPath(key.Path); err != nil {
+		return err
+	}
+	switch key.Scope {
+	case "", ScopeLatest, ScopeAll:
+	default:
+		return fmt.Errorf("update key %s: unknown scope %s", key.Path, key.Scope)
+	}
+	for _, vk := range verKeys {
+		if vk.Path == key.Path || strings.HasPrefix(key.Path, vk.Path+".") || strings.HasPrefix(vk.Path, key.Path+".") {
+			return fmt.Errorf("update key %s overlaps ver key %s", key.Path, vk.Path)
+		}
+	}
+	return nil
+}
+
+// carryUpdateKeys 提交记录中缺少的更新键沿用最新版本oldDoc的值
+func (reg *Registry) carryUpdateKeys(oldDoc, newDoc map[string]interface{}) {
+	for _, key := range reg.UpdateKeys {
+		if _, ok := lookup(newDoc, key.Path); ok {
+			continue
+		}
+		if v, ok := lookup(oldDoc, key.Path); ok {
+			setPath(newDoc, key.Path, v)
+		}
+	}
+}
+
+/*
+updateKeyOps 返回把scope为all的更新键写入实体所有版本的操作，和版本的修改在同一条日志中提交，
+值和最新版本oldDoc相同时其他版本已经是这个值，不需要写入。增量记录重建时从完整记录读取，见delta.go
+*/
+func (reg *Registry) updateKeyOps(key interface{}, oldDoc, newDoc map[string]interface{}, sess *mgo.Session) ([]journalOp, error) {
+	set := bson.M{}
+	for _, uk := range reg.UpdateKeys {
+		if uk.Scope != ScopeAll {
+			continue
+		}
+		v, ok := lookup(newDoc, uk.Path)
+		if !ok {
+			continue
+		}
+		if old, ok := lookup(oldDoc, uk.Path); ok && canonical(old) == canonical(v) {
+			continue
+		}
+		set[uk.Path] = v
+	}
+	if len(set) == 0 {
+		return nil, nil
+	}
+
+	var docs []struct {
+		ID interface{} `bson:"_id"`
+	}
+	err := sess.DB(reg.DatabaseName).C(reg.CollectionName).Find(
+		And(reg.keyQuery(key), notDeleted(), bson.M{"_base": bson.M{"$exists": false}}),
+	).Select(bson.M{"_id": 1}).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]journalOp, 0, len(docs))
+	for _, doc := range docs {
+		ops = append(ops, setOp(doc.ID, set))
+	}
+	return ops, nil
+}
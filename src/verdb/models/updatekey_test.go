@@ -0,0 +1,134 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestUpdateKeyEncoding(t *testing.T) {
+	keys := []UpdateKey{{Path: "owner"}, {Path: "meta.location", Scope: ScopeAll}}
+	data, _ := json.Marshal(keys)
+	if string(data) != `["owner",{"path":"meta.location","scope":"all"}]` {
+		t.Errorf("json编码错误 %s\n", data)
+		return
+	}
+	var jkeys []UpdateKey
+	if err := json.Unmarshal(data, &jkeys); err != nil || !reflect.DeepEqual(jkeys, keys) {
+		t.Errorf("json解码错误 %v %v\n", jkeys, err)
+		return
+	}
+
+	raw, _ := bson.Marshal(bson.M{"keys": keys})
+	var bdoc struct {
+		Keys []UpdateKey `bson:"keys"`
+	}
+	if err := bson.Unmarshal(raw, &bdoc); err != nil || !reflect.DeepEqual(bdoc.Keys, keys) {
+		t.Errorf("bson编解码错误 %v %v\n", bdoc.Keys, err)
+		return
+	}
+
+	verKeys := []VerKey{{Path: "a.b"}}
+	for _, key := range []UpdateKey{{Path: ""}, {Path: "a", Scope: "some"}, {Path: "a.b"}, {Path: "a"}, {Path: "a.b.c"}} {
+		if err := key.validate(verKeys); err == nil {
+			t.Errorf("非法更新键未报错 %+v\n", key)
+			return
+		}
+	}
+	if err := (UpdateKey{Path: "a.bc"}).validate(verKeys); err != nil {
+		t.Errorf("合法更新键报错 %v\n", err)
+		return
+	}
+}
+
+func TestUpdateKeys(t *testing.T) {
+	reg := &Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testupdatekeys",
+		Name:           "testdb/testupdatekeys",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}},
+		UpdateKeys:     []UpdateKey{{Path: "owner"}, {Path: "meta.location", Scope: ScopeAll}},
+	}
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+
+	// 清空数据库
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	collection.DropCollection()
+
+	steps := []struct {
+		doc    map[string]interface{}
+		action string
+	}{
+		{map[string]interface{}{"pk": 1, "a": 1, "owner": "alice", "meta": map[string]interface{}{"location": "bj"}}, ActionInsert},
+		{map[string]interface{}{"pk": 1, "a": 1, "owner": "bob"}, ActionExtend},
+		{map[string]interface{}{"pk": 1, "a": 2}, ActionVersion},
+		{map[string]interface{}{"pk": 1, "a": 2, "meta": map[string]interface{}{"location": "sh"}}, ActionExtend},
+	}
+	for i, step := range steps {
+		outcome, err := reg.Versionize(step.doc, sess)
+		if err != nil || outcome.Action != step.action {
+			t.Errorf("第%d条记录处理结果错误 %+v %v\n", i, outcome, err)
+			return
+		}
+	}
+
+	var docs []bson.M
+	collection.Find(bson.M{"pk": 1}).Sort("_ver").All(&docs)
+	if len(docs) != 2 {
+		t.Errorf("更新键产生了新版本 %v\n", docs)
+		return
+	}
+	for i, doc := range docs {
+		// owner只写入所在版本，新版本沿用最新版本的值
+		if doc["owner"] != "bob" {
+			t.Errorf("第%d个版本的owner错误 %v\n", i, doc)
+			return
+		}
+		// meta.location写入所有版本
+		if v, _ := lookup(doc, "meta.location"); v != "sh" {
+			t.Errorf("第%d个版本的meta.location错误 %v\n", i, doc)
+			return
+		}
+	}
+
+	// 值没有改变时不写入其他版本
+	ops, err := reg.updateKeyOps(1, docs[1], map[string]interface{}{"pk": 1, "a": 3, "meta": map[string]interface{}{"location": "sh"}}, sess)
+	if err != nil || len(ops) != 0 {
+		t.Errorf("值没有改变时写入了其他版本 %v %v\n", ops, err)
+		return
+	}
+
+	// 更新键和版本的修改在同一条日志中，中断之后一起被重放
+	commitHook = func(i int) error { return errors.New("crash") }
+	_, err = reg.Versionize(map[string]interface{}{"pk": 1, "a": 3, "meta": map[string]interface{}{"location": "gz"}}, sess)
+	commitHook = nil
+	if err == nil {
+		t.Errorf("注入的错误没有返回\n")
+		return
+	}
+	if n, _ := collection.Find(bson.M{"pk": 1, "meta.location": "gz"}).Count(); n != 1 {
+		t.Errorf("中断之后更新键的写入错误 %d\n", n)
+		return
+	}
+	if err = reg.Recover(sess); err != nil {
+		t.Errorf("重放日志错误 %v\n", err)
+		return
+	}
+	if n, _ := collection.Find(bson.M{"pk": 1, "meta.location": "gz"}).Count(); n != 3 {
+		t.Errorf("重放之后更新键没有写入所有版本 %d\n", n)
+		return
+	}
+}
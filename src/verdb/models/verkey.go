@@ -0,0 +1,210 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Ordered 列表按顺序比对，默认方式
+	Ordered = "ordered"
+	// Unordered 列表作为多重集合比对，忽略顺序
+	Unordered = "unordered"
+	// Keyed 文档列表按照元素的标识键(By)比对，忽略顺序
+	Keyed = "keyed"
+)
+
+/*
+VerKey 版本化键及其列表比对方式
+注册信息中可以只写路径，也可以写成对象：
+
+	"verKeys": [
+		"osInfo.kernelRelease",
+		{"path": "nics.mac", "strategy": "unordered"},
+		{"path": "disks", "strategy": "keyed", "by": "serial"}
+	]
+
+keyed 要求路径对应的值是文档列表，元素按照标识键配对比对，提交的记录中路径对应的值不是文档列表时返回错误，
+容差(tolerance)和规范化(normalize)见tolerance.go
+*/
+type VerKey struct {
+	Path      string `json:"path" bson:"path"`
+	Strategy  string `json:"strategy,omitempty" bson:"strategy,omitempty"`
+	By        string `json:"by,omitempty" bson:"by,omitempty"`
+	Tolerance string `json:"tolerance,omitempty" bson:"tolerance,omitempty"`
+	Normalize string `json:"normalize,omitempty" bson:"normalize,omitempty"`
+}
+
+// verKey 用于避免MarshalJSON, GetBSON递归调用
+type verKey VerKey
+
+// plain 只有路径，没有其他选项
+func (key VerKey) plain() bool {
+	return key == VerKey{Path: key.Path}
+}
+
+// MarshalJSON 只有路径时输出为字符串
+func (key VerKey) MarshalJSON() ([]byte, error) {
+	if key.plain() {
+		return json.Marshal(key.Path)
+	}
+	return json.Marshal(verKey(key))
+}
+
+// UnmarshalJSON 兼容字符串和对象两种格式
+func (key *VerKey) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*key = VerKey{Path: path}
+		return nil
+	}
+	return json.Unmarshal(data, (*verKey)(key))
+}
+
+// GetBSON 只有路径时保存为字符串
+func (key VerKey) GetBSON() (interface{}, error) {
+	if key.plain() {
+		return key.Path, nil
+	}
+	return verKey(key), nil
+}
+
+// SetBSON 兼容字符串和对象两种格式
+func (key *VerKey) SetBSON(raw bson.Raw) error {
+	if raw.Kind == 0x02 { // string
+		*key = VerKey{}
+		return raw.Unmarshal(&key.Path)
+	}
+	return raw.Unmarshal((*verKey)(key))
+}
+
+func (key VerKey) validate() error {
+	if key.Path == "" {
+		return errors.New("ver key path cant be empty")
+	}
+	if err := validateMetaPath(key.Path); err != nil {
+		return err
+	}
+	switch key.Strategy {
+	case "", Ordered, Unordered:
+	case Keyed:
+		if key.By == "" {
+			return fmt.Errorf("ver key %s: keyed strategy requires by", key.Path)
+		}
+	default:
+		return fmt.Errorf("ver key %s: unknown strategy %s", key.Path, key.Strategy)
+	}
+	return key.validateNoise()
+}
+
+// validateDoc 检查提交的记录doc中keyed方式的路径对应的值是文档列表
+func (key VerKey) validateDoc(doc map[string]interface{}) error {
+	if key.Strategy != Keyed {
+		return nil
+	}
+	for _, path := range key.expand(doc, nil, nil) {
+		for _, v := range walkVals(doc, strings.Split(path, ".")) {
+			if l, ok := v.([]interface{}); !ok || !isDocList(l) {
+				return fmt.Errorf("ver key %s: keyed strategy requires a list of documents", path)
+			}
+		}
+	}
+	return nil
+}
+
+// normalize 按照比对方式整理collectVals收集到的值，整理后的值可以直接用DeepEqual比对
+func (key VerKey) normalize(vals []interface{}) []interface{} {
+	if key.Normalize != "" {
+		vals = key.normalizeStrings(vals).([]interface{})
+	}
+	switch key.Strategy {
+	case Unordered:
+		nvals := make([]interface{}, len(vals))
+		for i, v := range vals {
+			if l, ok := v.([]interface{}); ok {
+				v = sortList(l, canonical)
+			}
+			nvals[i] = v
+		}
+		return sortList(nvals, canonical)
+
+	case Keyed: // 按照标识键排序，标识键相同的元素按照内容排序，比对时按照标识键配对(见sameIDs)
+		nvals := make([]interface{}, len(vals))
+		for i, v := range vals {
+			if l, ok := v.([]interface{}); ok {
+				v = sortList(l, func(elem interface{}) string {
+					m, _ := asMap(elem)
+					return canonical(m[key.By]) + "\x00" + canonical(elem)
+				})
+			}
+			nvals[i] = v
+		}
+		return nvals
+	}
+	return vals
+}
+
+// sameIDs keyed方式下normalize整理后的ovals, nvals中，每个位置的元素的标识键是否完全相同
+// 容差只作用在标识键相同的元素上，不同的标识键即使是容差范围内的数字也是不同的元素
+func (key VerKey) sameIDs(ovals, nvals []interface{}) bool {
+	if len(ovals) != len(nvals) {
+		return false
+	}
+	for i := range ovals {
+		lo, ok := ovals[i].([]interface{})
+		ln, nok := nvals[i].([]interface{})
+		if !ok || !nok {
+			continue
+		}
+		if len(lo) != len(ln) {
+			return false
+		}
+		for j := range lo {
+			mo, _ := asMap(lo[j])
+			mn, _ := asMap(ln[j])
+			if canonical(mo[key.By]) != canonical(mn[key.By]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sortList 返回按照sortKey排序后的列表拷贝
+func sortList(l []interface{}, sortKey func(interface{}) string) []interface{} {
+	items := make(keyedItems, len(l))
+	for i, v := range l {
+		items[i] = keyedItem{sortKey(v), v}
+	}
+	sort.Stable(items)
+	nl := make([]interface{}, len(l))
+	for i := range items {
+		nl[i] = items[i].val
+	}
+	return nl
+}
+
+// canonical 返回值的规范编码，数字类型不同但值相同时编码相同
+func canonical(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%#v", v)
+	}
+	return string(data)
+}
+
+type keyedItem struct {
+	key string
+	val interface{}
+}
+
+type keyedItems []keyedItem
+
+func (items keyedItems) Len() int           { return len(items) }
+func (items keyedItems) Less(i, j int) bool { return items[i].key < items[j].key }
+func (items keyedItems) Swap(i, j int)      { items[i], items[j] = items[j], items[i] }
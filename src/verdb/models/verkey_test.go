@@ -0,0 +1,123 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestVerKeyEncoding(t *testing.T) {
+	keysJSON := `["a.b", {"path": "disks", "strategy": "keyed", "by": "serial"}]`
+	expected := []VerKey{
+		{Path: "a.b"},
+		{Path: "disks", Strategy: Keyed, By: "serial"},
+	}
+
+	var keys []VerKey
+	if err := json.Unmarshal([]byte(keysJSON), &keys); err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("json解析错误 %v %v\n", keys, err)
+		return
+	}
+	data, _ := json.Marshal(keys)
+	if string(data) != `["a.b",{"path":"disks","strategy":"keyed","by":"serial"}]` {
+		t.Errorf("json编码错误 %s\n", data)
+		return
+	}
+
+	data, err := bson.Marshal(bson.M{"verKeys": keys})
+	if err != nil {
+		t.Errorf("bson编码错误 %s\n", err)
+		return
+	}
+	var raw bson.M
+	bson.Unmarshal(data, &raw)
+	if raw["verKeys"].([]interface{})[0] != "a.b" {
+		t.Errorf("只有路径的键没有保存为字符串 %v\n", raw)
+		return
+	}
+	var doc struct {
+		VerKeys []VerKey `bson:"verKeys"`
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil || !reflect.DeepEqual(doc.VerKeys, expected) {
+		t.Errorf("bson解析错误 %v %v\n", doc.VerKeys, err)
+		return
+	}
+}
+
+func TestChangedStrategy(t *testing.T) {
+	oldJSON := `
+	{
+		"tags": ["x", "y"],
+		"nics": [{"mac": "m1"}, {"mac": "m2"}],
+		"disks": [{"serial": "S1", "size": 1}, {"serial": "S2", "size": 2}]
+	}`
+	reorderedJSON := `
+	{
+		"tags": ["y", "x"],
+		"nics": [{"mac": "m2"}, {"mac": "m1"}],
+		"disks": [{"serial": "S2", "size": 2}, {"serial": "S1", "size": 1}]
+	}`
+	modifiedJSON := `
+	{
+		"tags": ["y", "x", "x"],
+		"nics": [{"mac": "m2"}, {"mac": "m3"}],
+		"disks": [{"serial": "S2", "size": 1}, {"serial": "S1", "size": 2}]
+	}`
+	var oldDoc, reordered, modified map[string]interface{}
+	json.Unmarshal([]byte(oldJSON), &oldDoc)
+	json.Unmarshal([]byte(reorderedJSON), &reordered)
+	json.Unmarshal([]byte(modifiedJSON), &modified)
+
+	cases := []struct {
+		key       VerKey
+		reordered bool
+	}{
+		{VerKey{Path: "tags"}, true},
+		{VerKey{Path: "tags", Strategy: Unordered}, false},
+		{VerKey{Path: "nics.mac"}, true},
+		{VerKey{Path: "nics.mac", Strategy: Unordered}, false},
+		{VerKey{Path: "disks"}, true},
+		{VerKey{Path: "disks", Strategy: Keyed, By: "serial"}, false},
+	}
+	for _, cs := range cases {
+		keys := []VerKey{cs.key}
+		if changed(oldDoc, reordered, keys, nil) != cs.reordered {
+			t.Errorf("%+v 顺序变化比对错误\n", cs.key)
+			return
+		}
+		if !changed(oldDoc, modified, keys, nil) {
+			t.Errorf("%+v 内容变化比对错误\n", cs.key)
+			return
+		}
+	}
+
+	if (VerKey{Path: "disks", Strategy: Keyed}).validate() == nil {
+		t.Errorf("keyed方式缺少by未报错\n")
+		return
+	}
+
+	// 按照标识键配对，容差范围内的不同标识键是不同的元素
+	keyed := []VerKey{{Path: "slots", Strategy: Keyed, By: "slot", Tolerance: "5"}}
+	before := map[string]interface{}{"slots": []interface{}{map[string]interface{}{"slot": 1.0, "size": 10.0}}}
+	after := map[string]interface{}{"slots": []interface{}{map[string]interface{}{"slot": 2.0, "size": 10.0}}}
+	resized := map[string]interface{}{"slots": []interface{}{map[string]interface{}{"slot": 1.0, "size": 12.0}}}
+	if !changed(before, after, keyed, nil) || changed(before, resized, keyed, nil) {
+		t.Errorf("keyed方式没有按照标识键配对比对\n")
+		return
+	}
+
+	// 提交的记录中keyed路径的值必须是文档列表
+	disks := VerKey{Path: "disks", Strategy: Keyed, By: "serial"}
+	if err := disks.validateDoc(oldDoc); err != nil {
+		t.Errorf("文档列表报错 %v\n", err)
+		return
+	}
+	for _, doc := range []map[string]interface{}{{"disks": "S1"}, {"disks": []interface{}{"S1", "S2"}}} {
+		if disks.validateDoc(doc) == nil {
+			t.Errorf("%v 不是文档列表未报错\n", doc)
+			return
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+Webhook
+
+订阅保存在 <注册信息表>.webhooks 中，投递记录保存在 <注册信息表>.deliveries 中。
+Dispatcher 从每个订阅的游标开始读取注册表的变更日志(见changelog.go)，
+生成新版本的变更(insert, version, split)中有订阅的VerKeys发生改变时生成投递记录，
+然后POST到订阅的url:
+
+	{
+		"id": <投递id>, "registry": "db/coll", "seq": <变更序号>, "action": "version",
+		"key": <实体key>, "changed": ["osInfo.kernelRelease"],
+		"old": {"ver": 1, "hash": "...", "doc": {...}}, // insert时为空
+		"new": {"ver": 2, "hash": "...", "doc": {...}}
+	}
+
+投递内容在生成投递记录时读取并保存在投递记录中，重试时投递相同的内容。
+hash是变更时版本的内容哈希(见changelog.go)，生成投递记录时版本已经被修改(例如同一个Interval中再次提交)或者删除时，
+只投递ver和hash，不投递之后的内容。
+读取投递内容失败时投递记录直接标记为失败(死信)，可以通过API重新投递。
+
+请求头 X-Verdb-Signature 为 "sha256=" + hex(HMAC-SHA256(secret, body))。
+返回2xx为投递成功，否则按照退避时间重试，超过最大次数后标记为失败(死信)，
+失败的投递可以通过API重新投递。
+
+多个实例同时运行Dispatcher时:
+
+	* 投递id由订阅id和变更序号组成，同一个变更重复生成投递记录时主键冲突，被忽略
+	* 订阅的游标只向前移动
+	* 投递之前先把nextAttempt推迟DeliveryClaim，只有推迟成功的实例投递
+*/
+
+const (
+	// DeliveryPending 等待投递或者重试
+	DeliveryPending = "pending"
+	// DeliveryDelivered 投递成功
+	DeliveryDelivered = "delivered"
+	// DeliveryFailed 超过最大重试次数，需要手动重新投递
+	DeliveryFailed = "failed"
+)
+
+// SignatureHeader 投递请求中签名的请求头
+const SignatureHeader = "X-Verdb-Signature"
+
+// DeliveryClaim 一次投递的最长时间，投递的实例崩溃时其他实例在这之后重试
+var DeliveryClaim = time.Minute
+
+// Webhook 一个注册表的订阅
+type Webhook struct {
+	ID       bson.ObjectId `json:"id" bson:"_id"`
+	Registry string        `json:"registry" bson:"registry" binding:"required"`
+	URL      string        `json:"url" bson:"url" binding:"required"`
+	Secret   string        `json:"secret,omitempty" bson:"secret"`
+	Keys     []string      `json:"keys" bson:"keys"`     // 只订阅这些VerKeys的改变，可以是模式(见glob.go)，为空时订阅所有改变
+	Cursor   int64         `json:"cursor" bson:"cursor"` // 已经处理的变更序号
+	Created  time.Time     `json:"created" bson:"created"`
+}
+
+// Delivery 一次投递
+type Delivery struct {
+	ID          string        `json:"id" bson:"_id"` // <订阅id>-<变更序号>，见deliveryID
+	Webhook     bson.ObjectId `json:"webhook" bson:"webhook"`
+	Seq         int64         `json:"seq" bson:"seq"`
+	Payload     bson.M        `json:"payload" bson:"payload"`
+	Status      string        `json:"status" bson:"status"`
+	Attempts    int           `json:"attempts" bson:"attempts"`
+	LastError   string        `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	NextAttempt time.Time     `json:"nextAttempt" bson:"nextAttempt"`
+	Created     time.Time     `json:"created" bson:"created"`
+	Updated     time.Time     `json:"updated" bson:"updated"`
+}
+
+// deliveryID 订阅hook投递变更seq的投递id
+func deliveryID(hook bson.ObjectId, seq int64) string {
+	return fmt.Sprintf("%s-%d", hook.Hex(), seq)
+}
+
+// matches 订阅是否关心变更record
+func (hook *Webhook) matches(record *ChangeRecord) bool {
+	switch record.Action {
+	case ActionInsert, ActionVersion, ActionSplit:
+	default:
+		return false
+	}
+	if len(hook.Keys) == 0 {
+		return true
+	}
+	for _, changed := range record.Changed {
+		for _, key := range hook.Keys {
+			if globMatch(key, changed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sign 返回body的签名
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (rm *RegManager) webhooks(sess *mgo.Session) *mgo.Collection {
+	return sess.DB(rm.database).C(rm.collection + ".webhooks")
+}
+
+func (rm *RegManager) deliveries(sess *mgo.Session) *mgo.Collection {
+	return sess.DB(rm.database).C(rm.collection + ".deliveries")
+}
+
+// CreateWebhook 新建订阅，只投递新建之后的变更
+func (rm *RegManager) CreateWebhook(hook *Webhook, sess *mgo.Session) (*Webhook, error) {
+	reg := rm.getRegByName(hook.Registry)
+	if reg == nil {
+		return nil, errors.New("Cant find registry " + hook.Registry)
+	}
+	if hook.URL == "" {
+		return nil, errors.New("webhook url cant be empty")
+	}
+
+	var last ChangeRecord
+	err := reg.changes(sess).Find(nil).Sort("-_id").One(&last)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	hook.ID = bson.NewObjectId()
+	hook.Cursor = last.Seq
+	hook.Created = time.Now()
+	return hook, rm.webhooks(sess).Insert(hook)
+}
+
+// Webhooks 返回注册表registry的订阅，registry为空时返回所有订阅
+func (rm *RegManager) Webhooks(registry string, sess *mgo.Session) ([]Webhook, error) {
+	query := bson.M{}
+	if registry != "" {
+		query["registry"] = registry
+	}
+	hooks := []Webhook{}
+	if err := rm.webhooks(sess).Find(query).All(&hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// DeleteWebhook 删除订阅和它的投递记录
+func (rm *RegManager) DeleteWebhook(id string, sess *mgo.Session) error {
+	if !bson.IsObjectIdHex(id) {
+		return errors.New("invalid webhook id " + id)
+	}
+	if err := rm.webhooks(sess).RemoveId(bson.ObjectIdHex(id)); err != nil {
+		return err
+	}
+	_, err := rm.deliveries(sess).RemoveAll(bson.M{"webhook": bson.ObjectIdHex(id)})
+	return err
+}
+
+// Deliveries 返回订阅的投递记录，status为空时返回所有状态
+func (rm *RegManager) Deliveries(id, status string, sess *mgo.Session) ([]Delivery, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("invalid webhook id " + id)
+	}
+	query := bson.M{"webhook": bson.ObjectIdHex(id)}
+	if status != "" {
+		query["status"] = status
+	}
+	deliveries := []Delivery{}
+	if err := rm.deliveries(sess).Find(query).Sort("-seq").All(&deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Redeliver 重置投递记录，由Dispatcher重新投递
+func (rm *RegManager) Redeliver(id string, sess *mgo.Session) error {
+	return rm.deliveries(sess).UpdateId(id, bson.M{"$set": bson.M{
+		"status":      DeliveryPending,
+		"attempts":    0,
+		"nextAttempt": time.Now(),
+		"updated":     time.Now(),
+	}})
+}
+
+// Dispatcher 投递webhook
+type Dispatcher struct {
+	rm          *RegManager
+	Client      *http.Client
+	MaxAttempts int                              // 最大投递次数
+	Backoff     func(attempts int) time.Duration // 第attempts次失败后的等待时间
+}
+
+// NewDispatcher 返回默认配置的Dispatcher: 最多8次，等待时间从1秒开始加倍
+func NewDispatcher(rm *RegManager) *Dispatcher {
+	return &Dispatcher{
+		rm:          rm,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 8,
+		Backoff: func(attempts int) time.Duration {
+			return time.Second << uint(attempts-1)
+		},
+	}
+}
+
+// Run 每隔interval处理一次，阻塞直到stop被关闭
+func (d *Dispatcher) Run(interval time.Duration, stop <-chan struct{}, sess *mgo.Session) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		dsess := sess.Copy()
+		if err := d.Poll(dsess); err != nil {
+			log.Println("Webhook", err)
+		}
+		dsess.Close()
+	}
+}
+
+// Poll 为新的变更生成投递记录，然后投递所有到期的投递记录
+func (d *Dispatcher) Poll(sess *mgo.Session) error {
+	hooks, err := d.rm.Webhooks("", sess)
+	if err != nil {
+		return err
+	}
+	// 一个订阅出错时继续处理其他订阅，返回第一个错误
+	var first error
+	fail := func(err error) {
+		log.Println("Webhook", err)
+		if first == nil {
+			first = err
+		}
+	}
+	for i := range hooks {
+		if err = d.enqueue(&hooks[i], sess); err != nil {
+			fail(err)
+		}
+	}
+
+	var due []Delivery
+	err = d.rm.deliveries(sess).Find(bson.M{
+		"status":      DeliveryPending,
+		"nextAttempt": bson.M{"$lte": time.Now()},
+	}).Sort("created").All(&due)
+	if err != nil {
+		return err
+	}
+	byID := map[bson.ObjectId]*Webhook{}
+	for i := range hooks {
+		byID[hooks[i].ID] = &hooks[i]
+	}
+	for i := range due {
+		if hook := byID[due[i].Webhook]; hook != nil {
+			if err = d.deliver(&due[i], hook, sess); err != nil {
+				fail(err)
+			}
+		}
+	}
+	return first
+}
+
+// enqueue 读取订阅游标之后的变更，生成投递记录并移动游标，其他实例已经生成的投递记录被忽略
+// 读取投递内容失败的变更生成失败的投递记录，不阻塞之后的变更
+func (d *Dispatcher) enqueue(hook *Webhook, sess *mgo.Session) error {
+	reg := d.rm.getRegByName(hook.Registry)
+	if reg == nil {
+		return nil
+	}
+	for {
+		records, err := reg.Changes(hook.Cursor, 100, sess)
+		if err != nil || len(records) == 0 {
+			return err
+		}
+		for i := range records {
+			if !hook.matches(&records[i]) {
+				continue
+			}
+			now := time.Now()
+			delivery := Delivery{
+				ID:          deliveryID(hook.ID, records[i].Seq),
+				Webhook:     hook.ID,
+				Seq:         records[i].Seq,
+				Status:      DeliveryPending,
+				NextAttempt: now,
+				Created:     now,
+				Updated:     now,
+			}
+			payload, err := reg.payload(&records[i], sess)
+			if err != nil {
+				payload = reg.payloadHeader(&records[i])
+				delivery.Status, delivery.LastError = DeliveryFailed, err.Error()
+			}
+			payload["id"] = delivery.ID
+			delivery.Payload = payload
+			if err = d.rm.deliveries(sess).Insert(delivery); err != nil && !mgo.IsDup(err) {
+				return err
+			}
+		}
+		hook.Cursor = records[len(records)-1].Seq
+		if err = d.rm.webhooks(sess).UpdateId(hook.ID, bson.M{"$max": bson.M{"cursor": hook.Cursor}}); err != nil {
+			return err
+		}
+	}
+}
+
+// payloadHeader 返回变更record的投递内容中不需要读取版本的部分
+func (reg *Registry) payloadHeader(record *ChangeRecord) bson.M {
+	return bson.M{
+		"registry": reg.Name,
+		"seq":      record.Seq,
+		"action":   record.Action,
+		"key":      record.Key,
+		"changed":  record.Changed,
+	}
+}
+
+// payload 返回变更record的投递内容，版本的内容哈希和变更时不同时不包含内容
+func (reg *Registry) payload(record *ChangeRecord, sess *mgo.Session) (bson.M, error) {
+	collection := sess.DB(reg.DatabaseName).C(reg.CollectionName)
+	version := func(ver int64, hash string) (bson.M, error) {
+		v := bson.M{"ver": ver}
+		if hash != "" {
+			v["hash"] = hash
+		}
+		var doc map[string]interface{}
+		err := collection.Find(And(reg.keyQuery(record.Key), during(ver, ver))).One(&doc)
+		if err == mgo.ErrNotFound || (err == nil && hash != "" && doc[Hash] != hash) {
+			return v, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if v["doc"], err = reg.decodeOne(doc, sess); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	payload := reg.payloadHeader(record)
+	newVer, err := version(record.Ver, record.Hash)
+	if err != nil {
+		return nil, err
+	}
+	payload["new"] = newVer
+	if record.Action != ActionInsert {
+		oldVer, err := version(record.Prev, record.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		payload["old"] = oldVer
+	}
+	return payload, nil
+}
+
+// deliver 投递一次并更新投递记录，投递记录已经被其他实例认领时不投递
+func (d *Dispatcher) deliver(delivery *Delivery, hook *Webhook, sess *mgo.Session) error {
+	body, err := json.Marshal(delivery.Payload)
+	if err != nil {
+		return err
+	}
+
+	err = d.rm.deliveries(sess).Update(
+		bson.M{"_id": delivery.ID, "status": DeliveryPending, "nextAttempt": delivery.NextAttempt},
+		bson.M{"$set": bson.M{"nextAttempt": time.Now().Add(DeliveryClaim)}},
+	)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = d.post(delivery, hook, body)
+	delivery.Attempts++
+	update := bson.M{"attempts": delivery.Attempts, "updated": time.Now()}
+	switch {
+	case err == nil:
+		update["status"] = DeliveryDelivered
+		update["lastError"] = ""
+	case delivery.Attempts >= d.MaxAttempts:
+		update["status"] = DeliveryFailed
+		update["lastError"] = err.Error()
+	default:
+		update["lastError"] = err.Error()
+		update["nextAttempt"] = time.Now().Add(d.Backoff(delivery.Attempts))
+	}
+	return d.rm.deliveries(sess).UpdateId(delivery.ID, bson.M{"$set": update})
+}
+
+func (d *Dispatcher) post(delivery *Delivery, hook *Webhook, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+	req.Header.Set("X-Verdb-Delivery", delivery.ID)
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package models
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	hook := &Webhook{Keys: []string{"osInfo.kernelRelease"}}
+	cases := []struct {
+		record  ChangeRecord
+		matches bool
+	}{
+		{ChangeRecord{Action: ActionVersion, Changed: []string{"osInfo.kernelRelease"}}, true},
+		{ChangeRecord{Action: ActionVersion, Changed: []string{"disks"}}, false},
+		{ChangeRecord{Action: ActionExtend}, false},
+		{ChangeRecord{Action: ActionInsert, Changed: []string{"disks", "osInfo.kernelRelease"}}, true},
+	}
+	for _, c := range cases {
+		if hook.matches(&c.record) != c.matches {
+			t.Errorf("订阅过滤错误 %+v\n", c.record)
+			return
+		}
+	}
+	if (&Webhook{}).matches(&ChangeRecord{Action: ActionDelete}) {
+		t.Errorf("删除不应该投递\n")
+		return
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	const (
+		database   = "metaInfo"
+		collection = "webhookregs"
+	)
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+	for _, name := range []string{"", ".webhooks", ".deliveries"} {
+		sess.DB(database).C(collection + name).DropCollection()
+	}
+
+	rm := NewRegManger(database, collection, sess)
+	reg, err := rm.CreateRegistry(&Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testwebhook",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}, {Path: "b"}},
+	}, sess)
+	if err != nil {
+		t.Errorf("注册失败 %v\n", err)
+		return
+	}
+	for _, name := range []string{"", ".changes", ".counters"} {
+		sess.DB(reg.DatabaseName).C(reg.CollectionName + name).DropCollection()
+	}
+
+	// 接收端前三次返回错误
+	var mux sync.Mutex
+	var calls int
+	var payloads []bson.M
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != Sign("secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if calls <= 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var payload bson.M
+		json.Unmarshal(body, &payload)
+		payloads = append(payloads, payload)
+	}))
+	defer receiver.Close()
+
+	hook, err := rm.CreateWebhook(&Webhook{
+		Registry: reg.Name,
+		URL:      receiver.URL,
+		Secret:   "secret",
+		Keys:     []string{"a"},
+	}, sess)
+	if err != nil {
+		t.Errorf("新建订阅失败 %v\n", err)
+		return
+	}
+
+	reg.Versionize(map[string]interface{}{"pk": 1, "a": 1, "b": 1}, sess) // 投递
+	reg.Versionize(map[string]interface{}{"pk": 1, "a": 1, "b": 2}, sess) // 只有b改变，不投递
+	reg.Versionize(map[string]interface{}{"pk": 1, "a": 2, "b": 2}, sess) // 投递
+
+	d := NewDispatcher(rm)
+	d.MaxAttempts = 2
+	d.Backoff = func(int) time.Duration { return 0 }
+
+	// 第一轮两次投递都失败，第二轮第一次投递超过最大次数，第二次投递成功
+	d.Poll(sess)
+	d.Poll(sess)
+	failed, _ := rm.Deliveries(hook.ID.Hex(), DeliveryFailed, sess)
+	delivered, _ := rm.Deliveries(hook.ID.Hex(), DeliveryDelivered, sess)
+	if len(failed) != 1 || len(delivered) != 1 {
+		t.Errorf("投递状态错误 failed: %v delivered: %v\n", failed, delivered)
+		return
+	}
+
+	// 重新投递死信
+	if err = rm.Redeliver(failed[0].ID, sess); err != nil {
+		t.Errorf("重新投递失败 %v\n", err)
+		return
+	}
+	d.Poll(sess)
+	if delivered, _ = rm.Deliveries(hook.ID.Hex(), DeliveryDelivered, sess); len(delivered) != 2 {
+		t.Errorf("重新投递后状态错误 %v\n", delivered)
+		return
+	}
+
+	if len(payloads) != 2 {
+		t.Errorf("接收到的投递数目错误 %v\n", payloads)
+		return
+	}
+
+	// 其他实例使用旧的游标重新处理同样的变更，不重复生成投递记录
+	stale := *hook
+	if err = d.enqueue(&stale, sess); err != nil {
+		t.Errorf("重复处理变更失败 %v\n", err)
+		return
+	}
+	if n, _ := rm.deliveries(sess).Find(bson.M{"webhook": hook.ID}).Count(); n != 2 {
+		t.Errorf("重复生成投递记录 %d\n", n)
+		return
+	}
+	var stored Webhook
+	rm.webhooks(sess).FindId(hook.ID).One(&stored)
+	if stored.Cursor != 3 {
+		t.Errorf("订阅游标错误 %d\n", stored.Cursor)
+		return
+	}
+
+	// 已经被认领的投递记录不再投递
+	rm.Redeliver(failed[0].ID, sess)
+	var pending Delivery
+	rm.deliveries(sess).FindId(failed[0].ID).One(&pending)
+	claimed := pending
+	if err = d.deliver(&pending, hook, sess); err != nil || d.deliver(&claimed, hook, sess) != nil {
+		t.Errorf("投递失败 %v\n", err)
+		return
+	}
+	if len(payloads) != 3 {
+		t.Errorf("认领之后重复投递 %d\n", len(payloads))
+		return
+	}
+	for _, payload := range payloads {
+		if payload["action"] == ActionVersion {
+			old, _ := payload["old"].(map[string]interface{})
+			changed, _ := payload["changed"].([]interface{})
+			if old == nil || len(changed) != 1 || changed[0] != "a" {
+				t.Errorf("投递内容错误 %v\n", payload)
+				return
+			}
+		}
+	}
+}
+
+func TestDispatcherSnapshot(t *testing.T) {
+	const (
+		database   = "metaInfo"
+		collection = "webhooksnapshots"
+	)
+
+	// 链接数据库
+	sess, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Errorf("无法连接mongodb %s", err.Error())
+		return
+	}
+	defer sess.Close()
+	for _, name := range []string{"", ".webhooks", ".deliveries"} {
+		sess.DB(database).C(collection + name).DropCollection()
+	}
+
+	rm := NewRegManger(database, collection, sess)
+	broken, err := rm.CreateRegistry(&Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testwebhookbroken",
+		CompareKey:     "pk",
+		VerInterval:    0, // 每次提交都是新的版本
+		VerKeys:        []VerKey{{Path: "a"}},
+		Delta:          &Delta{SnapshotEvery: 3},
+	}, sess)
+	if err != nil {
+		t.Errorf("注册失败 %v\n", err)
+		return
+	}
+	daily, err := rm.CreateRegistry(&Registry{
+		DatabaseName:   "testdb",
+		CollectionName: "testwebhookdaily",
+		CompareKey:     "pk",
+		VerInterval:    Daily,
+		VerKeys:        []VerKey{{Path: "a"}},
+	}, sess)
+	if err != nil {
+		t.Errorf("注册失败 %v\n", err)
+		return
+	}
+	for _, reg := range []*Registry{broken, daily} {
+		for _, name := range []string{"", ".changes", ".counters"} {
+			sess.DB(reg.DatabaseName).C(reg.CollectionName + name).DropCollection()
+		}
+	}
+
+	var mux sync.Mutex
+	var payloads []bson.M
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		var payload bson.M
+		json.Unmarshal(body, &payload)
+		payloads = append(payloads, payload)
+	}))
+	defer receiver.Close()
+
+	var hooks []*Webhook
+	for _, reg := range []*Registry{broken, daily} {
+		hook, err := rm.CreateWebhook(&Webhook{Registry: reg.Name, URL: receiver.URL}, sess)
+		if err != nil {
+			t.Errorf("新建订阅失败 %v\n", err)
+			return
+		}
+		hooks = append(hooks, hook)
+	}
+
+	// 最早的增量版本的基准丢失，读取它的投递内容失败
+	for a := 1; a <= 4; a++ {
+		broken.Versionize(map[string]interface{}{"pk": 1, "a": a}, sess)
+	}
+	data := sess.DB(broken.DatabaseName).C(broken.CollectionName)
+	var first bson.M
+	data.Find(bson.M{"pk": 1}).Sort("_ver").One(&first)
+	if err = data.UpdateId(first["_id"], bson.M{"$set": bson.M{"_base": bson.NewObjectId()}}); err != nil {
+		t.Errorf("修改增量基准失败 %v\n", err)
+		return
+	}
+
+	// 同一个Interval中再次提交，生成投递记录时版本已经不是变更时的内容
+	inserted, _ := daily.Versionize(map[string]interface{}{"pk": 1, "a": 1}, sess)
+	daily.Versionize(map[string]interface{}{"pk": 1, "a": 2}, sess)
+
+	d := NewDispatcher(rm)
+	if err = d.Poll(sess); err != nil {
+		t.Errorf("投递出错 %v\n", err)
+		return
+	}
+	failed, _ := rm.Deliveries(hooks[0].ID.Hex(), DeliveryFailed, sess)
+	delivered, _ := rm.Deliveries(hooks[0].ID.Hex(), DeliveryDelivered, sess)
+	if len(failed) != 2 || failed[0].LastError == "" || len(delivered) != 2 {
+		t.Errorf("读取投递内容失败的投递状态错误 failed: %v delivered: %v\n", failed, delivered)
+		return
+	}
+
+	delivered, _ = rm.Deliveries(hooks[1].ID.Hex(), DeliveryDelivered, sess)
+	if len(delivered) != 1 {
+		t.Errorf("其他订阅没有投递 %v\n", delivered)
+		return
+	}
+	newVer, _ := delivered[0].Payload["new"].(bson.M)
+	if newVer == nil || newVer["hash"] != inserted.Hash || newVer["doc"] != nil {
+		t.Errorf("投递了变更之后的内容 %v\n", delivered[0].Payload)
+		return
+	}
+}
@@ -39,6 +39,10 @@ type Registry struct {
 
 	verGen       func() int
 	lastCleanTxn time.Time
+
+	// for test purpose, called between inserting the new version
+	// and closing the last version
+	afterInsert func() error
 }
 
 func (self *Registry) GenVer() int {
@@ -118,21 +122,36 @@ func (self *Registry) Versionize(newDoc map[string]interface{}, sess *mgo.Sessio
 	newDoc["_is_latest"] = true
 
 	// query old doc from db
-	var oldDoc map[string]interface{}
+	// more than one latest doc means the last transition was interrupted
+	// after inserting the new version, close the older ones
+	var oldDocs []map[string]interface{}
 	err := repo.Find(bson.M{
 		self.CompareKey: newDoc[self.CompareKey],
 		"_is_latest":    true,
-	}).One(&oldDoc)
+	}).Sort("-_ver").All(&oldDocs)
+	if err != nil {
+		return err
+	}
 
 	// oldDoc not found, just insert newDoc as first version
-	if err == mgo.ErrNotFound {
+	if len(oldDocs) == 0 {
 		return repo.Insert(newDoc)
-	} else if err != nil {
-		return err
+	}
+	oldDoc := oldDocs[0]
+	for _, doc := range oldDocs[1:] {
+		if err = repo.UpdateId(
+			doc["_id"],
+			bson.M{"$set": bson.M{
+				"_next":      toInt(oldDoc["_ver"]) - 1,
+				"_is_latest": false,
+			}},
+		); err != nil {
+			return err
+		}
 	}
 
 	// old._ver == new._ver, update doc with new value
-	if oldDoc["_ver"] == newDoc["_ver"] {
+	if toInt(oldDoc["_ver"]) == ver {
 		return repo.UpdateId(oldDoc["_id"], newDoc)
 	}
 
@@ -152,38 +171,25 @@ func (self *Registry) Versionize(newDoc map[string]interface{}, sess *mgo.Sessio
 		)
 	}
 
-	// if changed, update last version's _next to ver-1, insert new version
-	/*
-		runner := self.txnRunner(sess)
-		ops := []txn.Op{{
-			C:  self.Repo,
-			Id: oldDoc["_id"],
-			Update: bson.M{"$set": bson.M{
-				"_next":      ver - 1,
-				"_is_latest": false,
-			}},
-		}, {
-			C:      self.Repo,
-			Id:     bson.NewObjectId(),
-			Insert: newDoc,
-		}}
-		id := bson.NewObjectId()
-		err = runner.Run(ops, id, nil)
-		if err != nil {
-			runner.Resume(id)
+	// if changed, insert new version first, then close last version
+	// by setting _next to ver-1. if interrupted between the two writes,
+	// the entity is left with two latest docs, which is fixed above
+	// on next versionize.
+	if err = repo.Insert(newDoc); err != nil {
+		return err
+	}
+	if self.afterInsert != nil {
+		if err = self.afterInsert(); err != nil {
+			return err
 		}
-	*/
-	// FIXME: transaction disabled!
-	if err = repo.UpdateId(
+	}
+	return repo.UpdateId(
 		oldDoc["_id"],
 		bson.M{"$set": bson.M{
 			"_next":      ver - 1,
 			"_is_latest": false,
 		}},
-	); err != nil {
-		return err
-	}
-	return repo.Insert(newDoc)
+	)
 }
 
 type RegManager struct {
@@ -1,12 +1,14 @@
 package verdb
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const (
@@ -164,3 +166,46 @@ func TestRegister(t *testing.T) {
 		}
 	})
 }
+
+func TestVersionizeInterrupted(t *testing.T) {
+	Convey("Test Versionize interrupted between writes", t, func() {
+		ver := 10
+		reg := &Registry{
+			DbName:     testDb,
+			Repo:       "testinterrupted",
+			Name:       testDb + "/testinterrupted",
+			CompareKey: "server_id",
+			VerKeys:    []string{"a"},
+			verGen:     func() int { return ver },
+		}
+
+		sess, err := mgo.Dial("localhost")
+		So(err, ShouldBeNil)
+		defer sess.Close()
+
+		repo := sess.DB(reg.DbName).C(reg.Repo)
+		repo.DropCollection()
+
+		So(reg.Versionize(map[string]interface{}{"server_id": 1, "a": 1}, sess), ShouldBeNil)
+
+		// crash after inserting the new version, the last version is still latest
+		ver = 11
+		reg.afterInsert = func() error { return errors.New("crash") }
+		So(reg.Versionize(map[string]interface{}{"server_id": 1, "a": 2}, sess), ShouldNotBeNil)
+		n, err := repo.Find(bson.M{"server_id": 1, "_is_latest": true}).Count()
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+
+		// next versionize closes the interrupted version
+		ver = 12
+		reg.afterInsert = nil
+		So(reg.Versionize(map[string]interface{}{"server_id": 1, "a": 3}, sess), ShouldBeNil)
+		var docs []map[string]interface{}
+		So(repo.Find(bson.M{"server_id": 1}).Sort("_ver").All(&docs), ShouldBeNil)
+		So(len(docs), ShouldEqual, 3)
+		for i, next := range []int{10, 11, 12} {
+			So(docs[i]["_next"], ShouldEqual, next)
+			So(docs[i]["_is_latest"], ShouldEqual, i == 2)
+		}
+	})
+}
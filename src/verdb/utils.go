@@ -24,6 +24,21 @@ func getVal(rdoc map[string]interface{}, ks []string) interface{} {
 	return nil
 }
 
+// convert number read from db to int
+func toInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
 // compare two docs
 func isChanged(ldoc, rdoc map[string]interface{}, keys []string) bool {
 	for _, key := range keys {